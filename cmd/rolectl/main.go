@@ -0,0 +1,161 @@
+// rolectl runs role command subcommands straight against role-srv and perms-srv, for
+// when Discord is down or for scripting.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	proto "github.com/chremoas/chremoas/proto"
+	"github.com/chremoas/services-common/config"
+	"github.com/micro/go-micro/broker"
+	"github.com/micro/go-micro/client"
+	"github.com/micro/go-micro/client/selector"
+	"github.com/micro/go-micro/registry"
+	"github.com/micro/go-micro/registry/consul"
+	"go.uber.org/zap"
+
+	"github.com/chremoas/role-cmd/command"
+	"github.com/chremoas/role-cmd/events"
+	"github.com/chremoas/role-cmd/health"
+	"github.com/chremoas/role-cmd/logging"
+	"github.com/chremoas/role-cmd/settings"
+	"github.com/chremoas/role-cmd/upstream"
+	"github.com/chremoas/role-cmd/webhooks"
+)
+
+var (
+	Version = "SET ME YOU KNOB"
+	Commit  = "unknown"
+	Branch  = "unknown"
+)
+
+// rolectl shows up as its own platform and channel in logs and traces
+const senderPrefix = "cli:rolectl:"
+
+func main() {
+	defaultConfig := os.Getenv("CONFIGURATION_FILE")
+	if len(defaultConfig) == 0 {
+		defaultConfig = "/etc/chremoas/chremoas.yaml"
+	}
+
+	configFile := flag.String("config", defaultConfig, "The chremoas.yaml to load services and settings from")
+	output := flag.String("output", "", "Output format: table, json or yaml (default from settings)")
+	as := flag.String("as", "", "User ID to run as instead of the configured admin")
+	timeout := flag.Duration("timeout", 30*time.Second, "How long to wait for the subcommand")
+	verbose := flag.Bool("verbose", false, "Log to stderr")
+
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] <subcommand> [arguments]\n\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "Subcommands are the same as !role, run '%s help' to list them.\n\nFlags:\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if err := run(*configFile, *output, *as, *timeout, *verbose, flag.Args()); err != nil {
+		fmt.Fprintf(os.Stderr, "rolectl: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(configFile, output, as string, timeout time.Duration, verbose bool, args []string) error {
+	conf := config.Configuration{}
+	if err := conf.Load(configFile); err != nil {
+		return err
+	}
+
+	s, err := settings.Load()
+	if err != nil {
+		return err
+	}
+
+	if len(output) == 0 {
+		output = s.CLI.Output
+	}
+	printer, ok := printers[output]
+	if !ok {
+		return fmt.Errorf("unknown output format: %s", output)
+	}
+
+	admin := as
+	if len(admin) == 0 {
+		admin = s.CLI.Admin
+	}
+	if len(admin) == 0 {
+		return fmt.Errorf("no identity to run as, set extensions.roleCmd.cli.admin or pass -as")
+	}
+
+	logger := zap.NewNop()
+	if verbose {
+		if logger, err = logging.New(settings.Logging{Level: "debug", Format: "console"}); err != nil {
+			return err
+		}
+	}
+	defer logger.Sync()
+
+	reg := consul.NewRegistry(registry.Addrs(registryAddress(&conf)))
+	c := client.NewClient(
+		client.Registry(reg),
+		client.Selector(selector.NewSelector(selector.Registry(reg))),
+	)
+	factory := upstream.NewFactory(&conf, upstream.Wrap(c, s.Upstream, logger))
+
+	checker := health.NewChecker(health.Build{Version: Version, Commit: Commit, Branch: Branch}, s.Health.Timeout)
+	factory.AddHealthChecks(checker)
+
+	// Changes made from here are changes all the same, so they get published too
+	var sinks []events.Sink
+	if s.Events.Enabled {
+		publisher, err := events.NewPublisher(s.Events, broker.NewBroker(broker.Registry(reg)))
+		if err != nil {
+			return err
+		}
+		sinks = append(sinks, publisher)
+	}
+
+	hooks, err := webhooks.NewDispatcher(s.Webhooks, logger)
+	if err != nil {
+		return err
+	}
+	// Don't exit before the webhooks have had their events, within reason
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		hooks.Close(ctx)
+	}()
+	if len(hooks.Hooks()) != 0 {
+		sinks = append(sinks, hooks)
+	}
+
+	cmd, err := command.NewCommand("role", factory, s, checker, events.Fanout(sinks...), hooks, logger)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	table, err := cmd.Query(ctx, &proto.ExecRequest{
+		Sender: senderPrefix + admin,
+		Args:   append([]string{"role"}, args...),
+	})
+	if err != nil {
+		return err
+	}
+
+	// Failures come back from Query as errors, whatever a successful result's text says
+	return printer(os.Stdout, table)
+}
+
+// Same as config.NewService does for the service
+func registryAddress(conf *config.Configuration) string {
+	if addr, ok := os.LookupEnv("MICRO_REGISTRY_ADDRESS"); ok {
+		return addr
+	}
+
+	return conf.Registry.Hostname + ":" + strconv.Itoa(conf.Registry.Port)
+}
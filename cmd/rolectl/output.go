@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/chremoas/role-cmd/command"
+)
+
+type printer func(w io.Writer, table *command.Table) error
+
+var printers = map[string]printer{
+	"table": printTable,
+	"json":  printJSON,
+	"yaml":  printYAML,
+}
+
+func printTable(w io.Writer, table *command.Table) error {
+	// Subcommands without a table just have their text, which reads better as is
+	if len(table.Columns) == 1 && table.Columns[0] == "result" {
+		for _, row := range table.Rows {
+			if _, err := fmt.Fprintln(w, row[0]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.ToUpper(strings.Join(table.Columns, "\t")))
+	for _, row := range table.Rows {
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+
+	return tw.Flush()
+}
+
+func printJSON(w io.Writer, table *command.Table) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+
+	return encoder.Encode(table.Records())
+}
+
+func printYAML(w io.Writer, table *command.Table) error {
+	out, err := yaml.Marshal(table.Records())
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(out)
+	return err
+}
@@ -0,0 +1,541 @@
+package command
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	proto "github.com/chremoas/chremoas/proto"
+	rolesrv "github.com/chremoas/role-srv/proto"
+
+	"github.com/chremoas/role-cmd/settings"
+)
+
+const (
+	apiPlatform    = "http"
+	apiPrefix      = "/api/v1"
+	apiMaxBodySize = 1 << 20
+)
+
+// apiFunc is what every API endpoint implements. Whatever it returns is sent back as
+// JSON, nil means there's nothing to send.
+type apiFunc func(ctx context.Context, sender *Sender, call *apiCall) (interface{}, error)
+
+type apiCall struct {
+	params map[string]string
+	body   []byte
+	result interface{}
+}
+
+type apiCallKey struct{}
+
+// apiRoute is one endpoint. Each route is registered as a subcommand on the API's own
+// dispatcher, so it gets the same permission checks, rate limits, logging, metrics and
+// tracing as the chat subcommands.
+type apiRoute struct {
+	method   string
+	segments []string
+	status   int
+	sub      *subcommand
+}
+
+// API serves the role command over HTTP/JSON, for the alliance web portal.
+type API struct {
+	conf       settings.API
+	dispatcher *dispatcher
+	routes     []*apiRoute
+}
+
+// NewAPI builds the admin API. It shares everything with the Command, so NewCommand has
+// to have been called first.
+func NewAPI(conf settings.API) (*API, error) {
+	if len(conf.Secret) == 0 {
+		return nil, fmt.Errorf("the admin API needs a secret, without one anyone who can reach %s could act as any user", conf.Address)
+	}
+
+	a := &API{conf: conf, dispatcher: newDispatcher("api")}
+
+	a.add("GET", "/roles", http.StatusOK, &subcommand{name: "roles.list"}, listRolesAPI)
+	a.add("POST", "/roles", http.StatusCreated, &subcommand{name: "roles.create", admin: true}, createRoleAPI)
+	a.add("GET", "/roles/{role}", http.StatusOK, &subcommand{name: "roles.get", admin: true}, getRoleAPI)
+	a.add("PATCH", "/roles/{role}", http.StatusOK, &subcommand{name: "roles.update", admin: true}, updateRoleAPI)
+	a.add("DELETE", "/roles/{role}", http.StatusNoContent, &subcommand{name: "roles.delete", admin: true}, deleteRoleAPI)
+	a.add("GET", "/roles/{role}/members", http.StatusOK, &subcommand{name: "roles.members", expensive: true}, roleMembersAPI)
+	a.add("GET", "/filters", http.StatusOK, &subcommand{name: "filters.list", admin: true}, listFiltersAPI)
+	a.add("POST", "/filters", http.StatusCreated, &subcommand{name: "filters.create", admin: true}, createFilterAPI)
+	a.add("DELETE", "/filters/{filter}", http.StatusNoContent, &subcommand{name: "filters.delete", admin: true}, deleteFilterAPI)
+	a.add("GET", "/filters/{filter}/members", http.StatusOK, &subcommand{name: "filters.members", admin: true}, filterMembersAPI)
+	a.add("POST", "/filters/{filter}/members", http.StatusNoContent, &subcommand{name: "filters.members.add", admin: true}, addFilterMembersAPI)
+	a.add("DELETE", "/filters/{filter}/members", http.StatusNoContent, &subcommand{name: "filters.members.remove", admin: true}, removeFilterMembersAPI)
+	a.add("POST", "/sync", http.StatusNoContent, &subcommand{name: "sync", expensive: true}, syncAPI)
+
+	return a, nil
+}
+
+func (a *API) add(method, path string, status int, sub *subcommand, fn apiFunc) {
+	sub.handler = func(ctx context.Context, sender *Sender, req *proto.ExecRequest) (string, error) {
+		call := ctx.Value(apiCallKey{}).(*apiCall)
+
+		var err error
+		call.result, err = fn(ctx, sender, call)
+		return "", err
+	}
+	a.dispatcher.add(sub)
+
+	a.routes = append(a.routes, &apiRoute{
+		method:   method,
+		segments: strings.Split(strings.Trim(path, "/"), "/"),
+		status:   status,
+		sub:      sub,
+	})
+}
+
+// match finds the route for a request. A path that exists under another method gives
+// a route of nil and allowed true.
+func (a *API) match(method, path string) (route *apiRoute, params map[string]string, allowed bool) {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+
+	for _, r := range a.routes {
+		if len(r.segments) != len(segments) {
+			continue
+		}
+
+		p := make(map[string]string)
+		matched := true
+		for i, segment := range r.segments {
+			if strings.HasPrefix(segment, "{") {
+				p[strings.Trim(segment, "{}")] = segments[i]
+			} else if segment != segments[i] {
+				matched = false
+				break
+			}
+		}
+
+		if !matched {
+			continue
+		}
+		if r.method == method {
+			return r, p, true
+		}
+		allowed = true
+	}
+
+	return nil, nil, allowed
+}
+
+type apiError struct {
+	Error     string `json:"error"`
+	Message   string `json:"message"`
+	RequestID string `json:"requestId,omitempty"`
+}
+
+var apiStatus = map[errorKind]int{
+	errUsage:       http.StatusBadRequest,
+	errPermission:  http.StatusForbidden,
+	errNotFound:    http.StatusNotFound,
+	errRateLimited: http.StatusTooManyRequests,
+	errUnavailable: http.StatusServiceUnavailable,
+	errInternal:    http.StatusInternalServerError,
+}
+
+func (a *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, apiPrefix+"/") {
+		writeJSON(w, http.StatusNotFound, apiError{Error: "not_found", Message: "No such endpoint"})
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, apiPrefix)
+
+	if path == "/openapi.json" && r.Method == "GET" {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(openAPIDocument))
+		return
+	}
+
+	route, params, allowed := a.match(r.Method, path)
+	if route == nil {
+		if allowed {
+			writeJSON(w, http.StatusMethodNotAllowed, apiError{Error: "usage", Message: "Method not allowed"})
+		} else {
+			writeJSON(w, http.StatusNotFound, apiError{Error: "not_found", Message: "No such endpoint"})
+		}
+		return
+	}
+
+	authorization := r.Header.Get("Authorization")
+	token := strings.TrimPrefix(authorization, "Bearer ")
+	if token == authorization || subtle.ConstantTimeCompare([]byte(token), []byte(a.conf.Secret)) != 1 {
+		writeJSON(w, http.StatusUnauthorized, apiError{Error: "permission", Message: "Missing or wrong API secret"})
+		return
+	}
+
+	user := r.Header.Get(a.conf.UserHeader)
+	if !userIdPattern.MatchString(user) {
+		writeJSON(w, http.StatusUnauthorized, apiError{Error: "permission", Message: fmt.Sprintf("%s must hold a user ID", a.conf.UserHeader)})
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, apiMaxBodySize))
+	if err != nil {
+		writeJSON(w, http.StatusRequestEntityTooLarge, apiError{Error: "usage", Message: "Request body too large"})
+		return
+	}
+
+	req := &proto.ExecRequest{Sender: apiPlatform + ":api:" + user, Args: []string{"api", route.sub.name}}
+	ctx, sender, err := begin(r.Context(), req)
+	w.Header().Set("X-Request-Id", requestID(ctx))
+
+	call := &apiCall{params: params, body: body}
+	if err == nil {
+		_, err = route.sub.chain(context.WithValue(ctx, apiCallKey{}, call), sender, req)
+	}
+
+	if err != nil {
+		e := a.dispatcher.failed(ctx, req, err)
+		writeJSON(w, apiStatus[e.kind], apiError{Error: string(e.kind), Message: e.message, RequestID: requestID(ctx)})
+		return
+	}
+
+	if call.result == nil {
+		w.WriteHeader(route.status)
+		return
+	}
+
+	writeJSON(w, route.status, call.result)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (c *apiCall) decode(v interface{}) error {
+	if err := json.Unmarshal(c.body, v); err != nil {
+		return usageError(fmt.Sprintf("Malformed request body: %s", err))
+	}
+	return nil
+}
+
+type apiRole struct {
+	ShortName   string `json:"shortName"`
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	FilterA     string `json:"filterA"`
+	FilterB     string `json:"filterB"`
+	Sig         bool   `json:"sig"`
+	Joinable    bool   `json:"joinable"`
+	Sync        bool   `json:"sync"`
+	Color       int32  `json:"color"`
+	Hoist       bool   `json:"hoist"`
+	Position    int32  `json:"position"`
+	Permissions int32  `json:"permissions"`
+	Managed     bool   `json:"managed"`
+	Mentionable bool   `json:"mentionable"`
+}
+
+func newAPIRole(r *rolesrv.Role) apiRole {
+	return apiRole{
+		ShortName:   r.ShortName,
+		Name:        r.Name,
+		Type:        r.Type,
+		FilterA:     r.FilterA,
+		FilterB:     r.FilterB,
+		Sig:         r.Sig,
+		Joinable:    r.Joinable,
+		Sync:        r.Sync,
+		Color:       r.Color,
+		Hoist:       r.Hoist,
+		Position:    r.Position,
+		Permissions: r.Permissions,
+		Managed:     r.Managed,
+		Mentionable: r.Mentionable,
+	}
+}
+
+type apiMember struct {
+	UserID string `json:"userId"`
+	Name   string `json:"name"`
+}
+
+type apiFilter struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+type apiMembers struct {
+	Members []string `json:"members"`
+}
+
+// The keys UpdateRole takes, by their name in the API
+var apiRoleKeys = map[string]string{
+	"color":       "Color",
+	"hoist":       "Hoist",
+	"position":    "Position",
+	"permissions": "Permissions",
+	"managed":     "Managed",
+	"mentionable": "Mentionable",
+	"sync":        "Sync",
+}
+
+// Changes only show up in Discord after a sync, same as the chat subcommands do it
+func syncAfterChange(ctx context.Context, sender *Sender) error {
+	if _, err := role.RoleClient.SyncToChatService(ctx, role.GetSyncRequest(sender.String(), false)); err != nil {
+		return upstreamError(err)
+	}
+	return nil
+}
+
+func listRolesAPI(ctx context.Context, sender *Sender, call *apiCall) (interface{}, error) {
+	roles, err := role.RoleClient.GetRoles(ctx, &rolesrv.NilMessage{})
+	if err != nil {
+		return nil, upstreamError(err)
+	}
+
+	result := make([]apiRole, 0, len(roles.Roles))
+	for _, r := range roles.Roles {
+		result = append(result, newAPIRole(r))
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].ShortName < result[j].ShortName })
+
+	return result, nil
+}
+
+func getRoleAPI(ctx context.Context, sender *Sender, call *apiCall) (interface{}, error) {
+	r, err := role.RoleClient.GetRole(ctx, &rolesrv.Role{ShortName: call.params["role"]})
+	if err != nil {
+		return nil, upstreamError(err)
+	}
+
+	return newAPIRole(r), nil
+}
+
+func createRoleAPI(ctx context.Context, sender *Sender, call *apiCall) (interface{}, error) {
+	var r apiRole
+	if err := call.decode(&r); err != nil {
+		return nil, err
+	}
+
+	if len(r.ShortName) == 0 || len(r.FilterA) == 0 {
+		return nil, usageError("shortName and filterA are required")
+	}
+	// Same as !role create, SIGs are made through !sig
+	if r.Sig || r.Joinable {
+		return nil, usageError("sig and joinable are for SIGs, which are created through !sig")
+	}
+	if len(r.Type) == 0 {
+		r.Type = "discord"
+	}
+	if len(r.FilterB) == 0 {
+		r.FilterB = "wildcard"
+	}
+
+	_, err := role.RoleClient.AddRole(ctx, &rolesrv.Role{
+		ShortName: r.ShortName,
+		Name:      r.Name,
+		Type:      r.Type,
+		FilterA:   r.FilterA,
+		FilterB:   r.FilterB,
+	})
+	if err != nil {
+		return nil, upstreamError(err)
+	}
+
+	if err = syncAfterChange(ctx, sender); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func updateRoleAPI(ctx context.Context, sender *Sender, call *apiCall) (interface{}, error) {
+	var changes map[string]interface{}
+	if err := call.decode(&changes); err != nil {
+		return nil, err
+	}
+
+	// Every change is checked before any is made, and made in the same order every time
+	keys := make([]string, 0, len(changes))
+	for key := range changes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	updates := make([]*rolesrv.UpdateInfo, 0, len(keys))
+	for _, key := range keys {
+		name, ok := apiRoleKeys[key]
+		if !ok {
+			return nil, usageError(fmt.Sprintf("Unknown key: %s", key))
+		}
+
+		value := changes[key]
+		v := fmt.Sprint(value)
+		if f, ok := value.(float64); ok {
+			v = strconv.FormatInt(int64(f), 10)
+		}
+		// Colors can be given as #rrggbb like in chat
+		if name == "Color" && strings.HasPrefix(v, "#") {
+			i, err := strconv.ParseInt(v[1:], 16, 64)
+			if err != nil {
+				return nil, usageError(fmt.Sprintf("Not a color: %s", v))
+			}
+			v = strconv.Itoa(int(i))
+		}
+
+		updates = append(updates, &rolesrv.UpdateInfo{Name: call.params["role"], Key: name, Value: v})
+	}
+
+	for _, update := range updates {
+		if _, err := role.RoleClient.UpdateRole(ctx, update); err != nil {
+			return nil, upstreamError(err)
+		}
+	}
+
+	if err := syncAfterChange(ctx, sender); err != nil {
+		return nil, err
+	}
+
+	return getRoleAPI(ctx, sender, call)
+}
+
+// deleteRoleAPI refuses SIGs like !role destroy does, they're removed through !sig.
+func deleteRoleAPI(ctx context.Context, sender *Sender, call *apiCall) (interface{}, error) {
+	r, err := role.RoleClient.GetRole(ctx, &rolesrv.Role{ShortName: call.params["role"]})
+	if err != nil {
+		return nil, upstreamError(err)
+	}
+	if r.Sig {
+		return nil, notFoundError("'%s' doesn't exist", call.params["role"])
+	}
+
+	if _, err = role.RoleClient.RemoveRole(ctx, &rolesrv.Role{ShortName: call.params["role"]}); err != nil {
+		return nil, upstreamError(err)
+	}
+
+	return nil, syncAfterChange(ctx, sender)
+}
+
+func roleMembersAPI(ctx context.Context, sender *Sender, call *apiCall) (interface{}, error) {
+	members, err := role.RoleClient.GetRoleMembership(ctx, &rolesrv.RoleMembershipRequest{Name: call.params["role"]})
+	if err != nil {
+		return nil, upstreamError(err)
+	}
+
+	return apiMemberList(ctx, members.Members)
+}
+
+func apiMemberList(ctx context.Context, members []string) ([]apiMember, error) {
+	ids, names, err := renderMembers(ctx, members)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]apiMember, len(ids))
+	for i := range ids {
+		result[i] = apiMember{UserID: ids[i], Name: names[i]}
+	}
+
+	return result, nil
+}
+
+func listFiltersAPI(ctx context.Context, sender *Sender, call *apiCall) (interface{}, error) {
+	filters, err := role.RoleClient.GetFilters(ctx, &rolesrv.NilMessage{})
+	if err != nil {
+		return nil, upstreamError(err)
+	}
+
+	result := make([]apiFilter, 0, len(filters.FilterList))
+	for _, f := range filters.FilterList {
+		result = append(result, apiFilter{Name: f.Name, Description: f.Description})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+
+	return result, nil
+}
+
+func createFilterAPI(ctx context.Context, sender *Sender, call *apiCall) (interface{}, error) {
+	var f apiFilter
+	if err := call.decode(&f); err != nil {
+		return nil, err
+	}
+
+	if len(f.Name) == 0 {
+		return nil, usageError("name is required")
+	}
+
+	if _, err := role.RoleClient.AddFilter(ctx, &rolesrv.Filter{Name: f.Name, Description: f.Description}); err != nil {
+		return nil, upstreamError(err)
+	}
+
+	return f, nil
+}
+
+func deleteFilterAPI(ctx context.Context, sender *Sender, call *apiCall) (interface{}, error) {
+	if _, err := role.RoleClient.RemoveFilter(ctx, &rolesrv.Filter{Name: call.params["filter"]}); err != nil {
+		return nil, upstreamError(err)
+	}
+
+	return nil, nil
+}
+
+func filterMembersAPI(ctx context.Context, sender *Sender, call *apiCall) (interface{}, error) {
+	members, err := role.RoleClient.GetMembers(ctx, &rolesrv.Filter{Name: call.params["filter"]})
+	if err != nil {
+		return nil, upstreamError(err)
+	}
+
+	return apiMemberList(ctx, members.Members)
+}
+
+func (c *apiCall) members() (*rolesrv.Members, error) {
+	var m apiMembers
+	if err := c.decode(&m); err != nil {
+		return nil, err
+	}
+
+	if len(m.Members) == 0 {
+		return nil, usageError("members is required")
+	}
+	for _, id := range m.Members {
+		if !userIdPattern.MatchString(id) {
+			return nil, usageError(fmt.Sprintf("Not a user ID: %s", id))
+		}
+	}
+
+	return &rolesrv.Members{Name: m.Members, Filter: c.params["filter"]}, nil
+}
+
+func addFilterMembersAPI(ctx context.Context, sender *Sender, call *apiCall) (interface{}, error) {
+	members, err := call.members()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = role.RoleClient.AddMembers(ctx, members); err != nil {
+		return nil, upstreamError(err)
+	}
+
+	return nil, syncAfterChange(ctx, sender)
+}
+
+func removeFilterMembersAPI(ctx context.Context, sender *Sender, call *apiCall) (interface{}, error) {
+	members, err := call.members()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = role.RoleClient.RemoveMembers(ctx, members); err != nil {
+		return nil, upstreamError(err)
+	}
+
+	return nil, syncAfterChange(ctx, sender)
+}
+
+func syncAPI(ctx context.Context, sender *Sender, call *apiCall) (interface{}, error) {
+	return nil, syncAfterChange(ctx, sender)
+}
@@ -0,0 +1,153 @@
+package command
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	rolesrv "github.com/chremoas/role-srv/proto"
+
+	"github.com/chremoas/role-cmd/settings"
+)
+
+const testSecret = "s3cret"
+
+func newTestAPI(t *testing.T) (*API, *testCommand, func()) {
+	tc, cleanup := newTestCommand(t)
+
+	api, err := NewAPI(settings.API{UserHeader: "X-Chremoas-User", Secret: testSecret})
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+
+	return api, tc, cleanup
+}
+
+func call(api *API, method, path, authorization, user, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "/api/v1"+path, strings.NewReader(body))
+	if len(authorization) != 0 {
+		req.Header.Set("Authorization", authorization)
+	}
+	if len(user) != 0 {
+		req.Header.Set("X-Chremoas-User", user)
+	}
+
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+
+	return w
+}
+
+func TestNewAPIWithoutSecret(t *testing.T) {
+	if _, err := NewAPI(settings.API{Address: "127.0.0.1:8080"}); err == nil {
+		t.Error("NewAPI started without a secret")
+	}
+}
+
+func TestAPIAuth(t *testing.T) {
+	api, tc, cleanup := newTestAPI(t)
+	defer cleanup()
+
+	tc.roles.role(&rolesrv.Role{ShortName: "pilots", FilterA: "pilots"})
+
+	tests := []struct {
+		name          string
+		authorization string
+		user          string
+		path          string
+		status        int
+	}{
+		{"no credentials", "", testAdmin, "/roles", http.StatusUnauthorized},
+		{"secret without a scheme", testSecret, testAdmin, "/roles", http.StatusUnauthorized},
+		{"another scheme", "Basic " + testSecret, testAdmin, "/roles", http.StatusUnauthorized},
+		{"wrong secret", "Bearer nope", testAdmin, "/roles", http.StatusUnauthorized},
+		{"no user", "Bearer " + testSecret, "", "/roles", http.StatusUnauthorized},
+		{"user that isn't an ID", "Bearer " + testSecret, "someone", "/roles", http.StatusUnauthorized},
+		{"anyone may list roles", "Bearer " + testSecret, "2000", "/roles", http.StatusOK},
+		{"only admins may look at one", "Bearer " + testSecret, "2000", "/roles/pilots", http.StatusForbidden},
+		{"admin", "Bearer " + testSecret, testAdmin, "/roles/pilots", http.StatusOK},
+		{"unknown role", "Bearer " + testSecret, testAdmin, "/roles/nope", http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		w := call(api, "GET", test.path, test.authorization, test.user, "")
+		if w.Code != test.status {
+			t.Errorf("%s: status %d, want %d (%s)", test.name, w.Code, test.status, w.Body)
+		}
+	}
+}
+
+func TestAPIUpdateRole(t *testing.T) {
+	api, tc, cleanup := newTestAPI(t)
+	defer cleanup()
+
+	tc.roles.role(&rolesrv.Role{ShortName: "pilots", FilterA: "pilots"})
+	patch := func(body string) *httptest.ResponseRecorder {
+		return call(api, "PATCH", "/roles/pilots", "Bearer "+testSecret, testAdmin, body)
+	}
+
+	// Nothing is changed, or synced, when any of it is refused
+	for _, body := range []string{
+		`{"color": "#ff0000", "hoist": true, "shortName": "other"}`,
+		`{"mentionable": true, "color": "#nothex"}`,
+	} {
+		if w := patch(body); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", body, w.Code)
+		}
+	}
+	if len(tc.roles.updates) != 0 || tc.roles.syncs != 0 {
+		t.Fatalf("refused changes made %d updates and %d syncs", len(tc.roles.updates), tc.roles.syncs)
+	}
+
+	w := patch(`{"position": 3, "color": "#ff0000", "hoist": true}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d, want 200 (%s)", w.Code, w.Body)
+	}
+
+	var keys []string
+	for _, u := range tc.roles.updates {
+		keys = append(keys, u.Key)
+	}
+	if !reflect.DeepEqual(keys, []string{"Color", "Hoist", "Position"}) {
+		t.Errorf("updated %v, want Color, Hoist and Position in that order", keys)
+	}
+	if tc.roles.syncs != 1 {
+		t.Errorf("synced %d times, want once", tc.roles.syncs)
+	}
+
+	var got apiRole
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Color != 0xff0000 || !got.Hoist || got.Position != 3 {
+		t.Errorf("role after the changes = %+v", got)
+	}
+}
+
+func TestAPILeavesSIGsToSigCmd(t *testing.T) {
+	api, tc, cleanup := newTestAPI(t)
+	defer cleanup()
+
+	tc.roles.role(&rolesrv.Role{ShortName: "caps", FilterA: "caps-a", FilterB: "caps", Sig: true})
+
+	if w := call(api, "DELETE", "/roles/caps", "Bearer "+testSecret, testAdmin, ""); w.Code != http.StatusNotFound {
+		t.Errorf("deleting a SIG: status %d, want 404", w.Code)
+	}
+	if _, ok := tc.roles.roles["caps"]; !ok {
+		t.Error("the SIG was deleted")
+	}
+
+	w := call(api, "POST", "/roles", "Bearer "+testSecret, testAdmin, `{"shortName": "dreads", "filterA": "dreads", "sig": true}`)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("creating a SIG: status %d, want 400", w.Code)
+	}
+
+	w = call(api, "POST", "/roles", "Bearer "+testSecret, testAdmin, `{"shortName": "dreads", "filterA": "dreads"}`)
+	if w.Code != http.StatusCreated {
+		t.Errorf("creating a role: status %d, want 201 (%s)", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,57 @@
+package command
+
+import (
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Changes made by role-cmd itself, e.g. expiring grants, are made as this sender.
+var systemSender = &Sender{Platform: "system", ChannelID: "role-cmd", UserID: "role-cmd"}
+
+// backgroundContext is what begin does for a request, for work nobody asked for.
+func backgroundContext(ctx context.Context, task string) context.Context {
+	id := newRequestID()
+	ctx = withRequestID(ctx, id)
+	ctx = withSender(ctx, systemSender)
+
+	return withLogger(ctx, logger.With(zap.String("request_id", id), zap.String("task", task)))
+}
+
+// RunBackground does the periodic work the service is responsible for, like expiring
+// grants and join requests, promoting from waitlists, catching up with changes made
+// straight to role-srv and reconciling dynamic filters, until ctx is done. Only the
+// service runs it, not rolectl.
+func (c *Command) RunBackground(ctx context.Context) {
+	sweep := time.NewTicker(sweepInterval)
+	defer sweep.Stop()
+	reconcile := time.NewTicker(reconcileInterval)
+	defer reconcile.Stop()
+	prerequisiteSweep := time.NewTicker(prerequisiteInterval)
+	defer prerequisiteSweep.Stop()
+
+	c.sweep(ctx)
+	dynamicFilterSet.sweep(backgroundContext(ctx, "dynamic_filter_reconciler"))
+	requirements.sweep(backgroundContext(ctx, "prerequisite_sweeper"))
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sweep.C:
+			c.sweep(ctx)
+		case <-reconcile.C:
+			dynamicFilterSet.sweep(backgroundContext(ctx, "dynamic_filter_reconciler"))
+		case <-prerequisiteSweep.C:
+			requirements.sweep(backgroundContext(ctx, "prerequisite_sweeper"))
+		}
+	}
+}
+
+func (c *Command) sweep(ctx context.Context) {
+	grants.sweep(backgroundContext(ctx, "grant_sweeper"))
+	joinRequests.sweep(backgroundContext(ctx, "join_request_sweeper"))
+	waitlist.sweep(backgroundContext(ctx, "waitlist_sweeper"))
+	groups.sweep(backgroundContext(ctx, "group_sweeper"))
+}
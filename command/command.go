@@ -8,11 +8,20 @@ import (
 	permsrv "github.com/chremoas/perms-srv/proto"
 	rclient "github.com/chremoas/role-srv/client"
 	rolesrv "github.com/chremoas/role-srv/proto"
-	"github.com/chremoas/chremoas/args"
 	common "github.com/chremoas/services-common/command"
 	"go.uber.org/zap"
 	"golang.org/x/net/context"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/chremoas/role-cmd/events"
+	"github.com/chremoas/role-cmd/health"
+	"github.com/chremoas/role-cmd/settings"
+	"github.com/chremoas/role-cmd/store"
+	"github.com/chremoas/role-cmd/webhooks"
 )
 
 type ClientFactory interface {
@@ -23,48 +32,109 @@ type ClientFactory interface {
 var role rclient.Roles
 var cmdName = "role"
 var clientFactory ClientFactory
+var logger *zap.Logger
+var permCache *permissionCache
+var directory *userDirectory
+var renderer *memberRenderer
+var checker *health.Checker
+var webhookDispatcher *webhooks.Dispatcher
+var grants *grantSchedule
+var joinRequests *joinQueue
+var groups *roleGroups
+var requirements *prerequisites
+var waitlist *waitlists
+var dynamicFilterSet *dynamicFilters
+var eventSink events.Sink
+var sweepInterval time.Duration
+var reconcileInterval time.Duration
+var prerequisiteInterval time.Duration
+
+var userIdPattern = regexp.MustCompile(`^\d+$`)
+
+// common.ExtractUserId panics on anything IsDiscordUser lets through that has no digits
+var mentionPattern = regexp.MustCompile(`^<@!?\d+>$`)
+var clientType = map[bool]string{true: "SIG", false: "Role"}
 
 type Command struct {
 	//Store anything you need the Help or Exec functions to have access to here
-	name    string
-	factory ClientFactory
+	name       string
+	factory    ClientFactory
+	dispatcher *dispatcher
 }
 
 func (c *Command) Help(ctx context.Context, req *proto.HelpRequest, rsp *proto.HelpResponse) error {
 	rsp.Usage = c.name
-	rsp.Description = "Administrate Roles, Rules and Filters"
+	rsp.Description = fmt.Sprintf("Administrate Roles, Rules and Filters (%s)", checker.Build().Version)
 	return nil
 }
 
 func (c *Command) Exec(ctx context.Context, req *proto.ExecRequest, rsp *proto.ExecResponse) error {
-	cmd := args.NewArg(cmdName)
-	cmd.Add("list", &args.Command{listRoles, "List all Roles"})
-	cmd.Add("create", &args.Command{addRole, "Add Role"})
-	cmd.Add("destroy", &args.Command{removeRole, "Delete role"})
-	cmd.Add("info", &args.Command{roleInfo, "Get Role Info"})
-	cmd.Add("keys", &args.Command{roleKeys, "Get valid role keys"})
-	// this isn't currently used.
-	//cmd.Add("types", &args.Command{roleTypes, "Get valid role types"})
-	cmd.Add("sync", &args.Command{syncRoles, "Sync Roles to chat service"})
-	cmd.Add("set", &args.Command{setRoles, "Set role key"})
-	cmd.Add("list_members", &args.Command{getMembers, "List Role members"})
-	cmd.Add("list_roles", &args.Command{listUserRoles, "List user Roles"})
-	err := cmd.Exec(ctx, req, rsp)
+	ctx, sender, err := begin(ctx, req)
+	if err == nil {
+		var result string
+		result, err = c.dispatcher.exec(ctx, sender, req)
+		rsp.Result = []byte(result)
+	}
 
-	// I don't 100% love this, but it'll do for now. -brian
 	if err != nil {
-		rsp.Result = []byte(common.SendError(err.Error()))
+		e := c.dispatcher.failed(ctx, req, err)
+		rsp.Result = []byte(e.render(requestID(ctx)))
+		rsp.Error = fmt.Sprintf("%s: %s", e.kind, e.message)
 	}
+
+	// Errors are reported in the response, returning them would just get the bot a
+	// generic RPC error instead.
 	return nil
 }
 
-func roleKeys(ctx context.Context, req *proto.ExecRequest) string {
+// Query runs a subcommand like Exec does, but returns its result as a table for
+// callers that want data rather than chat markdown. Subcommands that don't produce a
+// table give a single "result" column holding their text.
+func (c *Command) Query(ctx context.Context, req *proto.ExecRequest) (*Table, error) {
+	ctx, sender, err := begin(ctx, req)
+	if err != nil {
+		return nil, c.dispatcher.failed(ctx, req, err)
+	}
+
+	table, err := c.dispatcher.query(ctx, sender, req)
+	if err != nil {
+		return nil, c.dispatcher.failed(ctx, req, err)
+	}
+
+	return table, nil
+}
+
+// begin sets up the request ID and request scoped logger and parses the sender.
+func begin(ctx context.Context, req *proto.ExecRequest) (context.Context, *Sender, error) {
+	id := newRequestID()
+	ctx = withRequestID(ctx, id)
+
+	fields := []zap.Field{zap.String("request_id", id), zap.String("sender", req.Sender)}
+	if len(req.Args) > 1 {
+		fields = append(fields, zap.String("subcommand", req.Args[1]))
+	}
+
+	sender, err := ParseSender(req.Sender)
+	if err != nil {
+		err = usageError(fmt.Sprintf("Unable to work out who sent this: %s", err))
+	} else {
+		ctx = withSender(ctx, sender)
+		fields = append(fields,
+			zap.String("platform", sender.Platform),
+			zap.String("channel", sender.ChannelID),
+			zap.String("user", sender.UserID),
+		)
+	}
+
+	return withLogger(ctx, logger.With(fields...)), sender, err
+}
+
+func roleKeys(ctx context.Context, sender *Sender, req *proto.ExecRequest) (string, error) {
 	var buffer bytes.Buffer
 
-	roleClient := clientFactory.NewRoleClient()
-	keys, err := roleClient.GetRoleKeys(ctx, &rolesrv.NilMessage{})
+	keys, err := role.RoleClient.GetRoleKeys(ctx, &rolesrv.NilMessage{})
 	if err != nil {
-		return common.SendFatal(err.Error())
+		return "", upstreamError(err)
 	}
 
 	buffer.WriteString("Keys:\n")
@@ -72,16 +142,15 @@ func roleKeys(ctx context.Context, req *proto.ExecRequest) string {
 		buffer.WriteString(fmt.Sprintf("\t%s\n", keys.Value[key]))
 	}
 
-	return common.SendSuccess(fmt.Sprintf("```%s```\n", buffer.String()))
+	return common.SendSuccess(fmt.Sprintf("```%s```\n", buffer.String())), nil
 }
 
-func roleTypes(ctx context.Context, req *proto.ExecRequest) string {
+func roleTypes(ctx context.Context, sender *Sender, req *proto.ExecRequest) (string, error) {
 	var buffer bytes.Buffer
 
-	roleClient := clientFactory.NewRoleClient()
-	keys, err := roleClient.GetRoleTypes(ctx, &rolesrv.NilMessage{})
+	keys, err := role.RoleClient.GetRoleTypes(ctx, &rolesrv.NilMessage{})
 	if err != nil {
-		return common.SendFatal(err.Error())
+		return "", upstreamError(err)
 	}
 
 	buffer.WriteString("Types:\n")
@@ -89,123 +158,423 @@ func roleTypes(ctx context.Context, req *proto.ExecRequest) string {
 		buffer.WriteString(fmt.Sprintf("\t%s\n", keys.Value[key]))
 	}
 
-	return common.SendSuccess(fmt.Sprintf("```%s```\n", buffer.String()))
+	return common.SendSuccess(fmt.Sprintf("```%s```\n", buffer.String())), nil
 }
 
-func addRole(ctx context.Context, req *proto.ExecRequest) string {
-	if len(req.Args) < 5 {
-		return common.SendError("Usage: !role create <role_name> <filter> <role_description>")
+func addRole(ctx context.Context, sender *Sender, req *proto.ExecRequest) (string, error) {
+	roleName := strings.Join(req.Args[4:], " ")
+
+	if common.IsDiscordUser(req.Args[2]) {
+		return "", usageError("Discord users may not be roles")
 	}
 
-	canPerform, err := role.Permissions.CanPerform(ctx, req.Sender)
+	if common.IsDiscordUser(roleName) {
+		return "", usageError("Discord users may not be descriptions")
+	}
+
+	// rclient used to strip quotes around the description, keep doing that
+	roleName = strings.TrimSuffix(strings.TrimPrefix(roleName, `"`), `"`)
+
+	_, err := role.RoleClient.AddRole(ctx, &rolesrv.Role{
+		ShortName: req.Args[2],
+		Type:      "discord",
+		Name:      roleName,
+		FilterA:   req.Args[3],
+		FilterB:   "wildcard",
+		Joinable:  false, // Not a SIG, so no
+		Sig:       false,
+	})
 	if err != nil {
-		return common.SendFatal(err.Error())
+		return "", upstreamError(err)
 	}
 
-	if !canPerform {
-		return common.SendError("User doesn't have permission to this command")
+	if err = syncAfterChange(ctx, sender); err != nil {
+		return "", err
 	}
 
-	roleName := strings.Join(req.Args[4:], " ")
+	return common.SendSuccess(fmt.Sprintf("Added: %s\n", req.Args[2])), nil
+}
 
-	if common.IsDiscordUser(req.Args[2]) {
-		return common.SendError("Discord users may not be roles")
+// listRoles still takes "all", which only ever made a difference to SIGs and they aren't
+// listed here.
+func listRoles(ctx context.Context, sender *Sender, req *proto.ExecRequest) (string, error) {
+	table, err := listRolesTable(ctx, sender, req)
+	if err != nil {
+		return "", err
 	}
 
-	if common.IsDiscordUser(roleName) {
-		return common.SendError("Discord users may not be descriptions")
+	if len(table.Rows) == 0 {
+		return "", notFoundError("No Roles")
 	}
 
-	return role.AddRole(ctx,
-		req.Sender,
-		req.Args[2], // shortName
-		"discord",   // roleType
-		req.Args[3], // filterA
-		"wildcard",  // filterB
-		false,       // Is this SIG joinable? (Not a SIG, so no)
-		roleName,    // roleName
-		false,       // Is this a SIG?
-	)
+	var buffer bytes.Buffer
+	buffer.WriteString("Roles:\n")
+	for _, row := range table.Rows {
+		buffer.WriteString(fmt.Sprintf("\t%s\n", row[0]))
+	}
+
+	return fmt.Sprintf("```%s```", buffer.String()), nil
 }
 
-func listRoles(ctx context.Context, req *proto.ExecRequest) string {
-	var all = false
-	if len(req.Args) == 3 {
-		if req.Args[2] == "all" {
-			all = true
+func removeRole(ctx context.Context, sender *Sender, req *proto.ExecRequest) (string, error) {
+	r, err := role.RoleClient.GetRole(ctx, &rolesrv.Role{ShortName: req.Args[2]})
+	if err != nil {
+		return "", upstreamError(err)
+	}
+
+	// SIGs are destroyed through !sig
+	if r.Sig {
+		return "", notFoundError("'%s' doesn't exist", req.Args[2])
+	}
+
+	if _, err = role.RoleClient.RemoveRole(ctx, &rolesrv.Role{ShortName: req.Args[2]}); err != nil {
+		return "", upstreamError(err)
+	}
+
+	if err = syncAfterChange(ctx, sender); err != nil {
+		return "", err
+	}
+
+	return common.SendSuccess(fmt.Sprintf("Removed: %s\n", req.Args[2])), nil
+}
+
+func roleInfo(ctx context.Context, sender *Sender, req *proto.ExecRequest) (string, error) {
+	info, err := role.RoleClient.GetRole(ctx, &rolesrv.Role{ShortName: req.Args[2]})
+	if err != nil {
+		return "", upstreamError(err)
+	}
+
+	var buffer bytes.Buffer
+	buffer.WriteString(fmt.Sprintf("ShortName: %s\n", info.ShortName))
+	buffer.WriteString(fmt.Sprintf("Type: %s\n", info.Type))
+	buffer.WriteString(fmt.Sprintf("FilterA: %s\n", info.FilterA))
+	buffer.WriteString(fmt.Sprintf("FilterB: %s\n", info.FilterB))
+	buffer.WriteString(fmt.Sprintf("Name: %s\n", info.Name))
+	buffer.WriteString(fmt.Sprintf("Color: %d\n", info.Color))
+	buffer.WriteString(fmt.Sprintf("Hoist: %t\n", info.Hoist))
+	buffer.WriteString(fmt.Sprintf("Position: %d\n", info.Position))
+	buffer.WriteString(fmt.Sprintf("Permissions: %d\n", info.Permissions))
+	buffer.WriteString(fmt.Sprintf("Managed: %t\n", info.Managed))
+	buffer.WriteString(fmt.Sprintf("Mentionable: %t\n", info.Mentionable))
+	buffer.WriteString(fmt.Sprintf("Sync: %t\n", info.Sync))
+
+	return fmt.Sprintf("```%s```", buffer.String()), nil
+}
+
+func syncRoles(ctx context.Context, sender *Sender, req *proto.ExecRequest) (string, error) {
+	// role-srv tells the channel how the sync went itself
+	if _, err := role.RoleClient.SyncToChatService(ctx, role.GetSyncRequest(sender.String(), true)); err != nil {
+		return "", upstreamError(err)
+	}
+
+	return "", nil
+}
+
+func setRoles(ctx context.Context, sender *Sender, req *proto.ExecRequest) (string, error) {
+	name, key, value := req.Args[2], req.Args[3], req.Args[4]
+
+	valid := false
+	var keys []string
+	for _, k := range apiRoleKeys {
+		valid = valid || k == key
+		keys = append(keys, k)
+	}
+	if !valid {
+		sort.Strings(keys)
+		return "", usageError(fmt.Sprintf("Unknown key: %s\nValid Options are: %s", key, strings.Join(keys, ", ")))
+	}
+
+	if key == "Color" && strings.HasPrefix(value, "#") {
+		i, err := strconv.ParseInt(value[1:], 16, 64)
+		if err != nil {
+			return "", usageError(fmt.Sprintf("Not a color: %s", value))
 		}
+		value = strconv.Itoa(int(i))
 	}
 
-	return role.ListRoles(ctx, all, false)
+	if _, err := role.RoleClient.UpdateRole(ctx, &rolesrv.UpdateInfo{Name: name, Key: key, Value: value}); err != nil {
+		return "", upstreamError(err)
+	}
+
+	if err := syncAfterChange(ctx, sender); err != nil {
+		return "", err
+	}
+
+	return common.SendSuccess(fmt.Sprintf("Set '%s' to '%s' for '%s'", key, value, name)), nil
 }
 
-func removeRole(ctx context.Context, req *proto.ExecRequest) string {
-	if len(req.Args) != 3 {
-		return common.SendError("Usage: !role destroy <role_name>")
+func getMembers(ctx context.Context, sender *Sender, req *proto.ExecRequest) (string, error) {
+	members, err := role.RoleClient.GetRoleMembership(ctx, &rolesrv.RoleMembershipRequest{Name: req.Args[2]})
+	if err != nil {
+		return "", upstreamError(err)
 	}
 
-	canPerform, err := role.Permissions.CanPerform(ctx, req.Sender)
+	buffer, _, err := renderer.Render(ctx, members.Members)
 	if err != nil {
-		return common.SendFatal(err.Error())
+		return "", upstreamError(err)
 	}
 
-	if !canPerform {
-		return common.SendError("User doesn't have permission to this command")
+	if buffer.Len() == 0 {
+		return "```Empty list```\n", nil
 	}
 
-	return role.RemoveRole(ctx, req.Sender, req.Args[2], false)
+	return fmt.Sprintf("```%s Members:\n%s```\n", req.Args[2], buffer.String()), nil
 }
 
-func roleInfo(ctx context.Context, req *proto.ExecRequest) string {
-	if len(req.Args) != 3 {
-		return common.SendError("Usage: !role info <role_name>")
+func listUserRoles(ctx context.Context, sender *Sender, req *proto.ExecRequest) (string, error) {
+	name, roles, err := userRoles(ctx, sender, req)
+	if err != nil {
+		return "", err
+	}
+
+	var buffer bytes.Buffer
+	buffer.WriteString(fmt.Sprintf("Roles for %s:\n", name))
+	for r := range roles {
+		buffer.WriteString(fmt.Sprintf("\t%s (%s) filters: %s, %s\n",
+			roles[r].ShortName,
+			clientType[roles[r].Sig],
+			roles[r].FilterA,
+			roles[r].FilterB,
+		))
 	}
 
-	return role.RoleInfo(ctx, req.Sender, req.Args[2], false)
+	return fmt.Sprintf("```%s```\n", buffer.String()), nil
 }
 
-func syncRoles(ctx context.Context, req *proto.ExecRequest) string {
-	return role.SyncRoles(ctx, req.Sender)
+// parseUser takes a user as either a mention or a bare ID.
+func parseUser(arg string) (string, bool) {
+	switch {
+	case mentionPattern.MatchString(arg):
+		return common.ExtractUserId(arg), true
+	case userIdPattern.MatchString(arg):
+		return arg, true
+	default:
+		return "", false
+	}
 }
 
-func setRoles(ctx context.Context, req *proto.ExecRequest) string {
-	if len(req.Args) != 5 {
-		return common.SendError("Usage: !role set <role_name> <key> <value>")
+// userRoles looks up the roles of the sender, or of the user named in the arguments.
+func userRoles(ctx context.Context, sender *Sender, req *proto.ExecRequest) (string, []*rolesrv.Role, error) {
+	userId := sender.UserID
+
+	if len(req.Args) == 3 {
+		var ok bool
+		if userId, ok = parseUser(req.Args[2]); !ok {
+			return "", nil, usageError("Usage: !role list_roles [@user|user_id]")
+		}
+	}
+
+	// Anyone can look at their own roles, looking at someone else's is for admins
+	if userId != sender.UserID {
+		if err := requireRoleAdmin(ctx, sender); err != nil {
+			return "", nil, err
+		}
+	}
+
+	roles, err := role.RoleClient.ListUserRoles(ctx, &rolesrv.ListUserRolesRequest{UserId: userId})
+	if err != nil {
+		return "", nil, upstreamError(err)
 	}
 
-	canPerform, err := role.Permissions.CanPerform(ctx, req.Sender)
+	_, names, err := renderer.Render(ctx, []string{userId})
 	if err != nil {
-		return common.SendFatal(err.Error())
+		return "", nil, upstreamError(err)
 	}
 
-	if !canPerform {
-		return common.SendError("User doesn't have permission to this command")
+	if len(roles.Roles) == 0 {
+		return "", nil, notFoundError("%s has no roles", names[0])
 	}
 
-	return role.Set(ctx, req.Sender, req.Args[2], req.Args[3], req.Args[4])
+	return names[0], roles.Roles, nil
+}
+
+func version(ctx context.Context, sender *Sender, req *proto.ExecRequest) (string, error) {
+	build := checker.Build()
+	return fmt.Sprintf("```Version: %s\nCommit: %s\nBranch: %s```", build.Version, build.Commit, build.Branch), nil
 }
 
-func getMembers(ctx context.Context, req *proto.ExecRequest) string {
-	if len(req.Args) != 3 {
-		return common.SendError("Usage: !role list_members <sig_name>")
+func status(ctx context.Context, sender *Sender, req *proto.ExecRequest) (string, error) {
+	var buffer bytes.Buffer
+
+	buffer.WriteString(fmt.Sprintf("Version: %s\n", checker.Build()))
+	buffer.WriteString(fmt.Sprintf("Uptime: %s\n", checker.Uptime().Truncate(time.Second)))
+
+	results, _ := checker.Run(ctx)
+	for _, result := range results {
+		if result.Healthy {
+			buffer.WriteString(fmt.Sprintf("%s: ok (%s)\n", result.Name, result.Latency.Truncate(time.Millisecond)))
+		} else {
+			buffer.WriteString(fmt.Sprintf("%s: unavailable (%s)\n", result.Name, result.Error))
+		}
+	}
+
+	buffer.WriteString(fmt.Sprintf("Cached permission checks: %d\n", permCache.Len()))
+	if age := directory.Age(); age > 0 {
+		buffer.WriteString(fmt.Sprintf("User directory: %d users, %s old\n", directory.Len(), age.Truncate(time.Second)))
+	} else {
+		buffer.WriteString("User directory: not loaded yet\n")
 	}
 
-	return role.GetMembers(ctx, req.Args[2])
+	return fmt.Sprintf("```%s```", buffer.String()), nil
 }
 
-func listUserRoles(ctx context.Context, request *proto.ExecRequest) string {
-	s := strings.Split(request.Sender, ":")
-	return role.ListUserRoles(ctx, s[1], false)
+func permissionCacheStats(ctx context.Context, sender *Sender, req *proto.ExecRequest) (string, error) {
+	if len(req.Args) == 3 {
+		if req.Args[2] != "flush" {
+			return "", usageError("Usage: !role cache [flush]")
+		}
+
+		if err := requireRoleAdmin(ctx, sender); err != nil {
+			return "", err
+		}
+
+		return common.SendSuccess(fmt.Sprintf("Flushed %d cached permission checks", permCache.Flush())), nil
+	}
+
+	return fmt.Sprintf("```Cached permission checks: %d\nHit ratio: %.2f```\n", permCache.Len(), permCache.hitRatio()), nil
 }
 
-func NewCommand(name string, factory ClientFactory, log *zap.Logger) *Command {
+// NewCommand sets up the role command. Without a sink no events are sent anywhere, and
+// hooks may be nil if no webhooks are configured.
+func NewCommand(name string, factory ClientFactory, conf *settings.Settings, health *health.Checker, sink events.Sink, hooks *webhooks.Dispatcher, log *zap.Logger) (*Command, error) {
 	clientFactory = factory
+	logger = log
+	checker = health
+	webhookDispatcher = hooks
+	eventSink = sink
+	// Everything shares the one cache so the checks rclient does internally get cached too
+	permCache = newPermissionCache(clientFactory.NewPermsClient(), conf.PermissionCache)
+	var roleClient rolesrv.RolesService = syncRecorder{clientFactory.NewRoleClient()}
+	if sink != nil {
+		roleClient = eventRecorder{RolesService: roleClient, sink: sink}
+	}
+	// Outside the recorder so the removals they make are published too. Users only go on
+	// a waitlist, and rivals are only removed, once the prerequisites have let the
+	// addition through, and their removal cascades like any other.
+	roleClient = capacityEnforcer{roleClient}
+	roleClient = prerequisiteEnforcer{roleClient}
+	roleClient = groupEnforcer{roleClient}
+	directory = newUserDirectory(roleClient, conf.UserDirectory)
+	renderer = newMemberRenderer(conf.Names)
+	configureRateLimits(conf.RateLimits)
+
+	grantFile, err := store.Open(conf.Storage.Directory, "grants")
+	if err != nil {
+		return nil, err
+	}
+	if grants, err = newGrantSchedule(grantFile, conf.Grants); err != nil {
+		return nil, err
+	}
+	sweepInterval = conf.Grants.SweepInterval
+
+	requestFile, err := store.Open(conf.Storage.Directory, "join_requests")
+	if err != nil {
+		return nil, err
+	}
+	if joinRequests, err = newJoinQueue(requestFile, conf.JoinRequests); err != nil {
+		return nil, err
+	}
+
+	groupFile, err := store.Open(conf.Storage.Directory, "groups")
+	if err != nil {
+		return nil, err
+	}
+	if groups, err = newRoleGroups(groupFile); err != nil {
+		return nil, err
+	}
+
+	prerequisiteFile, err := store.Open(conf.Storage.Directory, "prerequisites")
+	if err != nil {
+		return nil, err
+	}
+	if requirements, err = newPrerequisites(prerequisiteFile, conf.Prerequisites); err != nil {
+		return nil, err
+	}
+	prerequisiteInterval = conf.Prerequisites.SweepInterval
+
+	waitlistFile, err := store.Open(conf.Storage.Directory, "waitlists")
+	if err != nil {
+		return nil, err
+	}
+	if waitlist, err = newWaitlists(waitlistFile); err != nil {
+		return nil, err
+	}
+
+	dynamicFile, err := store.Open(conf.Storage.Directory, "dynamic_filters")
+	if err != nil {
+		return nil, err
+	}
+	if dynamicFilterSet, err = newDynamicFilters(dynamicFile, conf.DynamicFilters); err != nil {
+		return nil, err
+	}
+	reconcileInterval = conf.DynamicFilters.ReconcileInterval
+
 	role = rclient.Roles{
-		RoleClient:  clientFactory.NewRoleClient(),
-		PermsClient: clientFactory.NewPermsClient(),
-		Permissions: pclient.NewPermission(clientFactory.NewPermsClient(), []string{"role_admins"}),
-		Logger: log,
+		RoleClient:  roleClient,
+		PermsClient: permCache,
+		Permissions: pclient.NewPermission(permCache, []string{roleAdmins}),
+		Logger:      log,
 	}
 
-	return &Command{name: name, factory: factory}
+	d := newDispatcher(cmdName)
+	d.add(&subcommand{name: "list", help: "List all Roles", usage: "[all]",
+		maxArgs: 1, handler: listRoles, table: listRolesTable})
+	d.add(&subcommand{name: "create", help: "Add Role", usage: "<role_name> <filter> <role_description>",
+		minArgs: 3, maxArgs: unlimited, admin: true, handler: addRole})
+	d.add(&subcommand{name: "destroy", help: "Delete role", usage: "<role_name>",
+		minArgs: 1, maxArgs: 1, admin: true, handler: removeRole})
+	d.add(&subcommand{name: "info", help: "Get Role Info", usage: "<role_name>",
+		minArgs: 1, maxArgs: 1, admin: true, handler: roleInfo, table: roleInfoTable})
+	d.add(&subcommand{name: "keys", help: "Get valid role keys",
+		handler: roleKeys, table: roleKeysTable})
+	// this isn't currently used.
+	//d.add(&subcommand{name: "types", help: "Get valid role types", handler: roleTypes})
+	d.add(&subcommand{name: "sync", help: "Sync Roles to chat service",
+		expensive: true, handler: syncRoles})
+	d.add(&subcommand{name: "set", help: "Set role key", usage: "<role_name> <key> <value>",
+		minArgs: 3, maxArgs: 3, admin: true, handler: setRoles})
+	d.add(&subcommand{name: "list_members", help: "List Role members", usage: "<role_name>",
+		minArgs: 1, maxArgs: 1, expensive: true, handler: getMembers, table: getMembersTable})
+	d.add(&subcommand{name: "list_roles", help: "List your Roles, or another user's", usage: "[@user|user_id]",
+		maxArgs: 1, handler: listUserRoles, table: listUserRolesTable})
+	d.add(&subcommand{name: "cache", help: "Show or flush the permission cache", usage: "[flush]",
+		maxArgs: 1, handler: permissionCacheStats})
+	d.add(&subcommand{name: "status", help: "Show version, uptime, upstream health and caches",
+		handler: status})
+	d.add(&subcommand{name: "version", help: "Show which build is running",
+		handler: version, table: versionTable})
+	d.add(&subcommand{name: "webhooks", help: "List webhooks or send one a test event", usage: "list|test <webhook>",
+		minArgs: 1, maxArgs: 2, admin: true, handler: webhookAdmin})
+	d.add(&subcommand{name: "grant", help: "Give someone a role for a while, or extend or revoke a grant", usage: "<@user|user_id> <role_name> <duration> | extend <id> <duration> | revoke <id>",
+		minArgs: 2, maxArgs: 3, admin: true, handler: grantRole})
+	d.add(&subcommand{name: "grants", help: "List pending grants", usage: "[role_name]",
+		maxArgs: 1, admin: true, handler: listGrants, table: listGrantsTable})
+	// Role admins only hear about a request through an event, so without anywhere to send
+	// one a request would just sit there until it expired
+	if sink != nil {
+		d.add(&subcommand{name: "request", help: "Ask to join a SIG that isn't joinable", usage: "<sig> [reason]",
+			minArgs: 1, maxArgs: unlimited, handler: requestJoin})
+	} else {
+		log.Warn("No event broker or webhooks configured, so !role request is disabled")
+	}
+	d.add(&subcommand{name: "approve", help: "Approve a request to join a SIG", usage: "<id>",
+		minArgs: 1, maxArgs: 1, admin: true, handler: approveJoin})
+	d.add(&subcommand{name: "deny", help: "Deny a request to join a SIG", usage: "<id> [reason]",
+		minArgs: 1, maxArgs: unlimited, admin: true, handler: denyJoin})
+	d.add(&subcommand{name: "requests", help: "List open requests to join SIGs", usage: "[sig]",
+		maxArgs: 1, admin: true, handler: listJoinRequests, table: listJoinRequestsTable})
+	d.add(&subcommand{name: "group", help: "Manage role groups", usage: "create <group> [exclusive] | add <group> <role_name> | remove <group> [role_name] | list",
+		minArgs: 1, maxArgs: 3, admin: true, handler: groupAdmin})
+	d.add(&subcommand{name: "lint", help: "Report users holding more than one role of an exclusive group",
+		admin: true, handler: lint, table: lintTable})
+	d.add(&subcommand{name: "deps", help: "Show a role's prerequisites and dependent roles, or change them", usage: "<role_name> [add|remove <role_name>]",
+		minArgs: 1, maxArgs: 3, handler: roleDeps, table: tableWhen(argCount(3), roleDepsTable, roleDeps)})
+	d.add(&subcommand{name: "capacity", help: "Show or set how many members a role may have", usage: "<role_name> [seats|none]",
+		minArgs: 1, maxArgs: 2, handler: roleCapacity})
+	d.add(&subcommand{name: "waitlist", help: "Show who is waiting for a full role, or leave its waitlist", usage: "<role_name> [leave]",
+		minArgs: 1, maxArgs: 2, handler: roleWaitlist, table: tableWhen(argCount(3), roleWaitlistTable, roleWaitlist)})
+	d.add(&subcommand{name: "dynamic", help: "Manage filters whose members come from a rule", usage: "set <filter> <rule> | preview <filter> | enable|disable|remove <filter> | list",
+		minArgs: 1, maxArgs: unlimited, admin: true, handler: dynamicAdmin, table: tableWhen(isPreview, previewDynamicFilterTable, dynamicAdmin)})
+
+	return &Command{name: name, factory: factory, dispatcher: d}, nil
 }
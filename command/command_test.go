@@ -0,0 +1,344 @@
+package command
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	proto "github.com/chremoas/chremoas/proto"
+	permsrv "github.com/chremoas/perms-srv/proto"
+	rolesrv "github.com/chremoas/role-srv/proto"
+	"github.com/micro/go-micro/client"
+	"github.com/micro/go-micro/errors"
+	"go.uber.org/zap"
+
+	"github.com/chremoas/role-cmd/events"
+	"github.com/chremoas/role-cmd/health"
+	"github.com/chremoas/role-cmd/settings"
+)
+
+// fakeRoles is role-srv in memory. A role's members are the users in its member filter,
+// which is all role-cmd looks at.
+type fakeRoles struct {
+	rolesrv.RolesService
+	roles   map[string]*rolesrv.Role
+	filters map[string]map[string]bool
+	syncs   int
+	updates []*rolesrv.UpdateInfo
+}
+
+func newFakeRoles() *fakeRoles {
+	return &fakeRoles{roles: make(map[string]*rolesrv.Role), filters: make(map[string]map[string]bool)}
+}
+
+func notFound(format string, a ...interface{}) error {
+	return errors.NotFound("chremoas.roles", format, a...)
+}
+
+// role adds a role and its member filter with the members given.
+func (f *fakeRoles) role(r *rolesrv.Role, members ...string) {
+	if len(r.FilterB) == 0 {
+		r.FilterB = "wildcard"
+	}
+	f.roles[r.ShortName] = r
+	if f.filters[memberFilter(r)] == nil {
+		f.filters[memberFilter(r)] = make(map[string]bool)
+	}
+	for _, m := range members {
+		f.filters[memberFilter(r)][m] = true
+	}
+}
+
+// members returns the role's members in order.
+func (f *fakeRoles) members(name string) []string {
+	var members []string
+	for m := range f.filters[memberFilter(f.roles[name])] {
+		members = append(members, m)
+	}
+	sort.Strings(members)
+
+	return members
+}
+
+func (f *fakeRoles) AddRole(ctx context.Context, in *rolesrv.Role, opts ...client.CallOption) (*rolesrv.NilMessage, error) {
+	if _, ok := f.roles[in.ShortName]; ok {
+		return nil, errors.Conflict("chremoas.roles", "role %s exists", in.ShortName)
+	}
+	r := *in
+	f.role(&r)
+
+	return &rolesrv.NilMessage{}, nil
+}
+
+func (f *fakeRoles) GetRole(ctx context.Context, in *rolesrv.Role, opts ...client.CallOption) (*rolesrv.Role, error) {
+	r, ok := f.roles[in.ShortName]
+	if !ok {
+		return nil, notFound("sql: no rows in result set")
+	}
+	copied := *r
+
+	return &copied, nil
+}
+
+func (f *fakeRoles) GetRoles(ctx context.Context, in *rolesrv.NilMessage, opts ...client.CallOption) (*rolesrv.GetRolesResponse, error) {
+	rsp := &rolesrv.GetRolesResponse{}
+	for _, r := range f.roles {
+		copied := *r
+		rsp.Roles = append(rsp.Roles, &copied)
+	}
+	sort.Slice(rsp.Roles, func(i, j int) bool { return rsp.Roles[i].ShortName < rsp.Roles[j].ShortName })
+
+	return rsp, nil
+}
+
+func (f *fakeRoles) RemoveRole(ctx context.Context, in *rolesrv.Role, opts ...client.CallOption) (*rolesrv.NilMessage, error) {
+	if _, ok := f.roles[in.ShortName]; !ok {
+		return nil, notFound("sql: no rows in result set")
+	}
+	delete(f.roles, in.ShortName)
+
+	return &rolesrv.NilMessage{}, nil
+}
+
+func (f *fakeRoles) UpdateRole(ctx context.Context, in *rolesrv.UpdateInfo, opts ...client.CallOption) (*rolesrv.NilMessage, error) {
+	r, ok := f.roles[in.Name]
+	if !ok {
+		return nil, notFound("sql: no rows in result set")
+	}
+
+	switch in.Key {
+	case "Color", "Position", "Permissions":
+		i, err := strconv.Atoi(in.Value)
+		if err != nil {
+			return nil, errors.BadRequest("chremoas.roles", "bad value for %s: %s", in.Key, in.Value)
+		}
+		*map[string]*int32{"Color": &r.Color, "Position": &r.Position, "Permissions": &r.Permissions}[in.Key] = int32(i)
+	case "Hoist", "Managed", "Mentionable", "Sync":
+		b, err := strconv.ParseBool(in.Value)
+		if err != nil {
+			return nil, errors.BadRequest("chremoas.roles", "bad value for %s: %s", in.Key, in.Value)
+		}
+		*map[string]*bool{"Hoist": &r.Hoist, "Managed": &r.Managed, "Mentionable": &r.Mentionable, "Sync": &r.Sync}[in.Key] = b
+	default:
+		return nil, errors.BadRequest("chremoas.roles", "unknown key %s", in.Key)
+	}
+	f.updates = append(f.updates, in)
+
+	return &rolesrv.NilMessage{}, nil
+}
+
+func (f *fakeRoles) GetRoleMembership(ctx context.Context, in *rolesrv.RoleMembershipRequest, opts ...client.CallOption) (*rolesrv.RoleMembershipResponse, error) {
+	if _, ok := f.roles[in.Name]; !ok {
+		return nil, notFound("sql: no rows in result set")
+	}
+
+	return &rolesrv.RoleMembershipResponse{Members: f.members(in.Name)}, nil
+}
+
+func (f *fakeRoles) ListUserRoles(ctx context.Context, in *rolesrv.ListUserRolesRequest, opts ...client.CallOption) (*rolesrv.ListUserRolesResponse, error) {
+	roles, _ := f.GetRoles(ctx, &rolesrv.NilMessage{})
+
+	rsp := &rolesrv.ListUserRolesResponse{}
+	for _, r := range roles.Roles {
+		if f.filters[memberFilter(r)][in.UserId] {
+			rsp.Roles = append(rsp.Roles, r)
+		}
+	}
+
+	return rsp, nil
+}
+
+func (f *fakeRoles) GetFilters(ctx context.Context, in *rolesrv.NilMessage, opts ...client.CallOption) (*rolesrv.FilterList, error) {
+	rsp := &rolesrv.FilterList{}
+	for name := range f.filters {
+		rsp.FilterList = append(rsp.FilterList, &rolesrv.Filter{Name: name})
+	}
+	sort.Slice(rsp.FilterList, func(i, j int) bool { return rsp.FilterList[i].Name < rsp.FilterList[j].Name })
+
+	return rsp, nil
+}
+
+func (f *fakeRoles) GetMembers(ctx context.Context, in *rolesrv.Filter, opts ...client.CallOption) (*rolesrv.MemberList, error) {
+	members, ok := f.filters[in.Name]
+	if !ok {
+		return nil, notFound("sql: no rows in result set")
+	}
+
+	rsp := &rolesrv.MemberList{}
+	for m := range members {
+		rsp.Members = append(rsp.Members, m)
+	}
+	sort.Strings(rsp.Members)
+
+	return rsp, nil
+}
+
+func (f *fakeRoles) AddMembers(ctx context.Context, in *rolesrv.Members, opts ...client.CallOption) (*rolesrv.NilMessage, error) {
+	members, ok := f.filters[in.Filter]
+	if !ok {
+		return nil, notFound("sql: no rows in result set")
+	}
+	for _, m := range in.Name {
+		members[m] = true
+	}
+
+	return &rolesrv.NilMessage{}, nil
+}
+
+func (f *fakeRoles) RemoveMembers(ctx context.Context, in *rolesrv.Members, opts ...client.CallOption) (*rolesrv.NilMessage, error) {
+	members, ok := f.filters[in.Filter]
+	if !ok {
+		return nil, notFound("sql: no rows in result set")
+	}
+	for _, m := range in.Name {
+		delete(members, m)
+	}
+
+	return &rolesrv.NilMessage{}, nil
+}
+
+func (f *fakeRoles) SyncToChatService(ctx context.Context, in *rolesrv.SyncRequest, opts ...client.CallOption) (*rolesrv.NilMessage, error) {
+	f.syncs++
+	return &rolesrv.NilMessage{}, nil
+}
+
+func (f *fakeRoles) GetDiscordUserList(ctx context.Context, in *rolesrv.NilMessage, opts ...client.CallOption) (*rolesrv.GetDiscordUserListResponse, error) {
+	return &rolesrv.GetDiscordUserListResponse{}, nil
+}
+
+type fakeFactory struct {
+	roles *fakeRoles
+	perms *fakePerms
+}
+
+func (f *fakeFactory) NewPermsClient() permsrv.PermissionsService {
+	return f.perms
+}
+
+func (f *fakeFactory) NewRoleClient() rolesrv.RolesService {
+	return f.roles
+}
+
+// recordedEvents keeps whatever is published.
+type recordedEvents struct {
+	events []events.Event
+}
+
+func (r *recordedEvents) Publish(event events.Event) error {
+	r.events = append(r.events, event)
+	return nil
+}
+
+func (r *recordedEvents) types() []string {
+	var types []string
+	for _, e := range r.events {
+		types = append(types, events.Stamp(e).Type)
+	}
+	return types
+}
+
+// The role admin every test command is run as, unless it says otherwise
+const testAdmin = "1000"
+
+type testCommand struct {
+	*Command
+	roles  *fakeRoles
+	perms  *fakePerms
+	events *recordedEvents
+}
+
+// newTestCommand sets the role command up against fake role-srv and perms-srv, with its
+// stores in a fresh directory. Call the function it returns when done.
+func newTestCommand(t *testing.T, configure ...func(conf *settings.Settings)) (*testCommand, func()) {
+	dir, err := ioutil.TempDir("", "role-cmd")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conf := settings.Defaults()
+	conf.Storage.Directory = dir
+	conf.RateLimits = settings.RateLimits{}
+	for _, fn := range configure {
+		fn(conf)
+	}
+
+	tc := &testCommand{
+		roles:  newFakeRoles(),
+		perms:  &fakePerms{allowed: map[string]bool{testAdmin: true}},
+		events: &recordedEvents{},
+	}
+	checker := health.NewChecker(health.Build{Version: "test"}, conf.Health.Timeout)
+	tc.Command, err = NewCommand("role", &fakeFactory{roles: tc.roles, perms: tc.perms}, conf, checker, tc.events, nil, zap.NewNop())
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	return tc, func() { os.RemoveAll(dir) }
+}
+
+// run runs the subcommand as the user like the bot would, returning what it answered
+// and the error it reported, if any.
+func (tc *testCommand) run(user string, args ...string) (result, reported string) {
+	rsp := &proto.ExecResponse{}
+	tc.Exec(context.Background(), &proto.ExecRequest{Sender: "discord:1:" + user, Args: append([]string{"role"}, args...)}, rsp)
+
+	return string(rsp.Result), rsp.Error
+}
+
+// mustRun is run for subcommands that have to work.
+func (tc *testCommand) mustRun(t *testing.T, user string, args ...string) string {
+	t.Helper()
+
+	result, reported := tc.run(user, args...)
+	if len(reported) != 0 {
+		t.Fatalf("!role %s: %s", strings.Join(args, " "), reported)
+	}
+
+	return result
+}
+
+func TestQuery(t *testing.T) {
+	tc, cleanup := newTestCommand(t)
+	defer cleanup()
+
+	tc.roles.role(&rolesrv.Role{ShortName: "pilots", Name: "Careful :warning: hot", FilterA: "pilots"})
+	tc.roles.role(&rolesrv.Role{ShortName: "caps", FilterA: "caps-a", FilterB: "caps", Sig: true})
+
+	tests := []struct {
+		args []string
+		kind errorKind
+	}{
+		// A description quoting chat markup is still a success
+		{[]string{"info", "pilots"}, ""},
+		{[]string{"info", "nope"}, errNotFound},
+		// SIGs are destroyed through !sig
+		{[]string{"destroy", "caps"}, errNotFound},
+		{[]string{"create", "pilots"}, errUsage},
+		{[]string{"frobnicate"}, errUsage},
+	}
+
+	for _, test := range tests {
+		_, err := tc.Query(context.Background(), &proto.ExecRequest{
+			Sender: "cli:rolectl:" + testAdmin,
+			Args:   append([]string{"role"}, test.args...),
+		})
+
+		var kind errorKind
+		if err != nil {
+			e, ok := err.(*commandError)
+			if !ok {
+				t.Errorf("%v: Query returned %T, want a *commandError", test.args, err)
+				continue
+			}
+			kind = e.kind
+		}
+		if kind != test.kind {
+			t.Errorf("%v: Query failed with %q, want %q (%v)", test.args, kind, test.kind, err)
+		}
+	}
+}
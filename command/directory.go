@@ -0,0 +1,96 @@
+package command
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	rolesrv "github.com/chremoas/role-srv/proto"
+
+	"github.com/chremoas/role-cmd/settings"
+)
+
+// userDirectory keeps a copy of the guild's user list indexed by user ID so rendering
+// names doesn't mean pulling every user in the guild from role-srv each time.
+type userDirectory struct {
+	client          rolesrv.RolesService
+	refreshInterval time.Duration
+
+	mutex   sync.RWMutex
+	users   map[string]*rolesrv.GetDiscordUserResponse
+	fetched time.Time
+}
+
+func newUserDirectory(client rolesrv.RolesService, conf settings.UserDirectory) *userDirectory {
+	return &userDirectory{
+		client:          client,
+		refreshInterval: conf.RefreshInterval,
+		users:           make(map[string]*rolesrv.GetDiscordUserResponse),
+	}
+}
+
+func (d *userDirectory) stale() bool {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	return d.fetched.IsZero() || time.Since(d.fetched) > d.refreshInterval
+}
+
+// Refresh pulls the user list from role-srv regardless of how old the cached copy is.
+func (d *userDirectory) Refresh(ctx context.Context) error {
+	list, err := d.client.GetDiscordUserList(ctx, &rolesrv.NilMessage{})
+	if err != nil {
+		return err
+	}
+
+	users := make(map[string]*rolesrv.GetDiscordUserResponse, len(list.Users))
+	for u := range list.Users {
+		users[list.Users[u].Id] = list.Users[u]
+	}
+
+	d.mutex.Lock()
+	d.users = users
+	d.fetched = time.Now()
+	d.mutex.Unlock()
+
+	return nil
+}
+
+// Users returns the cached directory, refreshing it first if it has gone stale. If the
+// refresh fails but an older copy is around, that copy is used and the error returned
+// alongside it.
+func (d *userDirectory) Users(ctx context.Context) (map[string]*rolesrv.GetDiscordUserResponse, error) {
+	var err error
+
+	if d.stale() {
+		err = d.Refresh(ctx)
+	}
+
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	if err != nil && d.fetched.IsZero() {
+		return nil, err
+	}
+
+	return d.users, err
+}
+
+// Age is how long ago the directory was last fetched, zero if it never has been.
+func (d *userDirectory) Age() time.Duration {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	if d.fetched.IsZero() {
+		return 0
+	}
+
+	return time.Since(d.fetched)
+}
+
+func (d *userDirectory) Len() int {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	return len(d.users)
+}
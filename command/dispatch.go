@@ -0,0 +1,187 @@
+package command
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"regexp"
+
+	proto "github.com/chremoas/chremoas/proto"
+	"go.uber.org/zap"
+)
+
+// subcommandFunc is what every subcommand implements. The sender has already been
+// parsed and validated by the time it gets here. Errors should be commandErrors so Exec
+// knows how to report them, anything else is treated as internal.
+type subcommandFunc func(ctx context.Context, sender *Sender, req *proto.ExecRequest) (string, error)
+
+// Arguments are counted after the subcommand name, unlimited means no upper bound.
+const unlimited = -1
+
+// subcommand declares a subcommand and everything the dispatcher should enforce before
+// the handler is called. The dispatcher builds the middleware chain from this, so a new
+// subcommand gets the same checks, logging and metrics as the rest just by being added.
+type subcommand struct {
+	name  string
+	help  string
+	usage string
+
+	minArgs int
+	maxArgs int
+	// Only role admins may run this
+	admin bool
+	// Uses the stricter rate limits, for anything that ends up hitting Discord
+	expensive bool
+
+	handler subcommandFunc
+	// Optional, the same result as data for Query
+	table tableFunc
+
+	chain      subcommandFunc
+	tableChain subcommandFunc
+}
+
+// dispatcher does what chremoas/args does, except that subcommands get the parsed sender
+// and are run through their middleware chain.
+type dispatcher struct {
+	cmdName     string
+	subcommands map[string]*subcommand
+	order       []string
+}
+
+func newDispatcher(cmdName string) *dispatcher {
+	return &dispatcher{cmdName: cmdName, subcommands: make(map[string]*subcommand)}
+}
+
+func (d *dispatcher) add(sub *subcommand) {
+	chain := []middleware{
+		recovery(sub),
+		traced(sub),
+		logging(d, sub),
+		metrics(sub),
+		validateArgs(d.cmdName, sub),
+		rateLimit(sub),
+	}
+	if sub.admin {
+		chain = append(chain, requireAdmin)
+	}
+
+	wrap := func(handler subcommandFunc) subcommandFunc {
+		for i := len(chain) - 1; i >= 0; i-- {
+			handler = chain[i](handler)
+		}
+		return handler
+	}
+
+	sub.chain = wrap(sub.handler)
+	if sub.table != nil {
+		sub.tableChain = wrap(tableHandler(sub.table))
+	}
+
+	d.order = append(d.order, sub.name)
+	d.subcommands[sub.name] = sub
+}
+
+func (d *dispatcher) exec(ctx context.Context, sender *Sender, req *proto.ExecRequest) (string, error) {
+	if len(req.Args) < 2 || req.Args[1] == "help" {
+		return d.help(), nil
+	}
+
+	sub, ok := d.subcommands[req.Args[1]]
+	if !ok {
+		return "", usageError(fmt.Sprintf("not a valid subcommand: %s", req.Args[1]))
+	}
+
+	return sub.chain(ctx, sender, req)
+}
+
+func (d *dispatcher) query(ctx context.Context, sender *Sender, req *proto.ExecRequest) (*Table, error) {
+	if len(req.Args) < 2 || req.Args[1] == "help" {
+		return d.helpTable(), nil
+	}
+
+	sub, ok := d.subcommands[req.Args[1]]
+	if !ok {
+		return nil, usageError(fmt.Sprintf("not a valid subcommand: %s", req.Args[1]))
+	}
+
+	if sub.tableChain == nil {
+		result, err := sub.chain(ctx, sender, req)
+		if err != nil {
+			return nil, err
+		}
+		return textTable(result), nil
+	}
+
+	var table *Table
+	if _, err := sub.tableChain(withTableSink(ctx, &table), sender, req); err != nil {
+		return nil, err
+	}
+
+	return table, nil
+}
+
+// failed logs a failed command at a level that matches how bad it is.
+func (d *dispatcher) failed(ctx context.Context, req *proto.ExecRequest, err error) *commandError {
+	e := classify(err)
+
+	fields := []zap.Field{
+		zap.String("kind", string(e.kind)),
+		zap.Strings("args", d.redactArgs(req.Args)),
+		zap.Error(e),
+	}
+
+	log := loggerFrom(ctx)
+	switch e.kind {
+	case errInternal:
+		log.Error("Command failed", fields...)
+	case errUnavailable:
+		log.Warn("Command failed", fields...)
+	default:
+		log.Info("Command failed", fields...)
+	}
+
+	return e
+}
+
+// Anything that looks like it's carrying a secret, whatever the subcommand
+var secretPattern = regexp.MustCompile(`(?i)^((?:token|secret|password|key)[=:]).+$`)
+
+const redacted = "[REDACTED]"
+
+// redactArgs returns a copy of the arguments that is safe to log. No subcommand takes a
+// secret as such, so this is only for one pasted in by mistake.
+func (d *dispatcher) redactArgs(args []string) []string {
+	safe := make([]string, len(args))
+	for i := range args {
+		safe[i] = secretPattern.ReplaceAllString(args[i], "${1}"+redacted)
+	}
+
+	return safe
+}
+
+func (d *dispatcher) help() string {
+	var buffer bytes.Buffer
+
+	buffer.WriteString(fmt.Sprintf("Usage: !%s <subcommand> <arguments>\n", d.cmdName))
+	buffer.WriteString("\nSubcommands:\n")
+
+	for _, name := range d.order {
+		if len(d.subcommands[name].help) != 0 {
+			buffer.WriteString(fmt.Sprintf("\t%s: %s\n", name, d.subcommands[name].help))
+		}
+	}
+
+	return fmt.Sprintf("```%s```", buffer.String())
+}
+
+func (d *dispatcher) helpTable() *Table {
+	table := &Table{Columns: []string{"subcommand", "usage", "description"}}
+	for _, name := range d.order {
+		if sub := d.subcommands[name]; len(sub.help) != 0 {
+			table.Rows = append(table.Rows, []string{name, sub.usage, sub.help})
+		}
+	}
+
+	return table
+}
@@ -0,0 +1,447 @@
+package command
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	proto "github.com/chremoas/chremoas/proto"
+	rolesrv "github.com/chremoas/role-srv/proto"
+	common "github.com/chremoas/services-common/command"
+	"go.uber.org/zap"
+
+	"github.com/chremoas/role-cmd/settings"
+	"github.com/chremoas/role-cmd/store"
+)
+
+// A dynamicFilter is a filter whose members are worked out from a rule instead of being
+// added by hand. Once it's enabled the reconciler adds and removes members to match, so
+// changing its members any other way doesn't last.
+type dynamicFilter struct {
+	Filter    string    `json:"filter"`
+	Rule      string    `json:"rule"`
+	Enabled   bool      `json:"enabled"`
+	UpdatedBy string    `json:"updatedBy"`
+	Updated   time.Time `json:"updated"`
+	// What the last reconcile did
+	Reconciled time.Time `json:"reconciled,omitempty"`
+	Added      int       `json:"added"`
+	Removed    int       `json:"removed"`
+	LastError  string    `json:"lastError,omitempty"`
+}
+
+type dynamicFilters struct {
+	filters    *store.Collection
+	maxRemoval float64
+}
+
+func newDynamicFilters(file *store.File, conf settings.DynamicFilters) (*dynamicFilters, error) {
+	filters, err := store.NewCollection(file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load dynamic filters from %s: %s", file.Path(), err)
+	}
+
+	return &dynamicFilters{filters: filters, maxRemoval: conf.MaxRemoval}, nil
+}
+
+// A handful of removals is always allowed, however small the filter
+const alwaysRemovable = 5
+
+// checkRemoval refuses to take out more of the filter's members at once than allowed, as
+// a rule that suddenly matches far fewer people is more likely broken, or role-srv
+// answered with less than it should have, than right.
+func (d *dynamicFilters) checkRemoval(filter string, remove []string, members int) error {
+	if len(remove) <= alwaysRemovable || float64(len(remove)) <= d.maxRemoval*float64(members) {
+		return nil
+	}
+
+	return usageError(fmt.Sprintf("Not reconciling %s, it would remove %d of its %d members, more than the %.0f%% allowed at once. "+
+		"Check the rule with !role dynamic preview %s", filter, len(remove), members, d.maxRemoval*100, filter))
+}
+
+// update applies change to a copy of the filter's entry and saves it, nil creating it
+// and change returning nil deleting it, like roleGroups.update.
+func (d *dynamicFilters) update(filter string, change func(f *dynamicFilter) (*dynamicFilter, error)) error {
+	err := d.filters.Update(func(tx *store.Tx) error {
+		var f *dynamicFilter
+		if existing := new(dynamicFilter); tx.Get(filter, existing) {
+			f = existing
+		}
+
+		changed, err := change(f)
+		if err != nil {
+			return err
+		}
+
+		if changed == nil {
+			tx.Delete(filter)
+			return nil
+		}
+		return tx.Put(filter, changed)
+	})
+
+	return storeError(err)
+}
+
+func (d *dynamicFilters) get(filter string) *dynamicFilter {
+	var f dynamicFilter
+	if !d.filters.Get(filter, &f) {
+		return nil
+	}
+	return &f
+}
+
+func (d *dynamicFilters) list() []dynamicFilter {
+	var list []dynamicFilter
+	d.filters.List(&list)
+
+	return list
+}
+
+// delta works out who the rule would add to and remove from the filter right now, out of
+// how many members it has. Its errors are already classified.
+func (f *dynamicFilter) delta(ctx context.Context) (add, remove []string, members int, err error) {
+	r, err := parseRule(strings.Fields(f.Rule))
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	users, err := directory.Users(ctx)
+	if err != nil && users == nil {
+		return nil, nil, 0, upstreamError(err)
+	}
+
+	held := make(map[string]map[string]bool)
+	for _, roleName := range r.roles() {
+		membership, err := role.RoleClient.GetRoleMembership(ctx, &rolesrv.RoleMembershipRequest{Name: roleName})
+		if err != nil {
+			return nil, nil, 0, upstreamError(err)
+		}
+		for _, member := range membership.Members {
+			if held[member] == nil {
+				held[member] = make(map[string]bool)
+			}
+			held[member][roleName] = true
+		}
+	}
+
+	current, err := memberSet(ctx, role.RoleClient, f.Filter)
+	if err != nil {
+		return nil, nil, 0, upstreamError(err)
+	}
+
+	wanted := make(map[string]bool)
+	for id, user := range users {
+		if r.matches(ruleSubject{user: user, roles: held[id]}) {
+			wanted[id] = true
+			if !current[id] {
+				add = append(add, id)
+			}
+		}
+	}
+	for id := range current {
+		if !wanted[id] {
+			remove = append(remove, id)
+		}
+	}
+	sort.Strings(add)
+	sort.Strings(remove)
+
+	return add, remove, len(current), nil
+}
+
+// addDynamicMembers adds the users together if it can, but one at a time if that gets
+// refused, so a prerequisite or full role only keeps out the users it applies to.
+func addDynamicMembers(ctx context.Context, filter string, users []string) int {
+	log := loggerFrom(ctx)
+
+	_, err := role.RoleClient.AddMembers(ctx, &rolesrv.Members{Name: users, Filter: filter})
+	if err == nil {
+		return len(users)
+	}
+	if _, refused := err.(*commandError); !refused || len(users) == 1 {
+		log.Warn("Unable to add dynamic filter members", zap.String("filter", filter), zap.Error(err))
+		return 0
+	}
+
+	added := 0
+	for _, user := range users {
+		if _, err = role.RoleClient.AddMembers(ctx, &rolesrv.Members{Name: []string{user}, Filter: filter}); err != nil {
+			log.Info("Dynamic filter member refused", zap.String("filter", filter), zap.String("user", user), zap.Error(err))
+			continue
+		}
+		added++
+	}
+
+	return added
+}
+
+// reconcile brings the filter's members in line with its rule and records how that went.
+// Its errors are already classified.
+func (d *dynamicFilters) reconcile(ctx context.Context, filter string) (added, removed int, err error) {
+	f := d.get(filter)
+	if f == nil {
+		return 0, 0, notFoundError("%s isn't a dynamic filter", filter)
+	}
+
+	add, remove, members, err := f.delta(ctx)
+	if err == nil {
+		err = d.checkRemoval(filter, remove, members)
+	}
+	if err == nil && len(remove) != 0 {
+		_, err = role.RoleClient.RemoveMembers(ctx, &rolesrv.Members{Name: remove, Filter: filter})
+		if err == nil {
+			removed = len(remove)
+		}
+		err = upstreamError(err)
+	}
+	if err == nil && len(add) != 0 {
+		added = addDynamicMembers(ctx, filter, add)
+	}
+
+	saveErr := d.update(filter, func(f *dynamicFilter) (*dynamicFilter, error) {
+		if f == nil {
+			return nil, nil
+		}
+		f.Reconciled = time.Now().UTC()
+		f.Added, f.Removed, f.LastError = added, removed, ""
+		if err != nil {
+			f.LastError = err.Error()
+		}
+		return f, nil
+	})
+	if saveErr != nil {
+		loggerFrom(ctx).Error("Unable to save dynamic filters", zap.Error(saveErr))
+	}
+
+	return added, removed, err
+}
+
+// sweep reconciles every enabled filter and syncs once if any of them changed.
+func (d *dynamicFilters) sweep(ctx context.Context) {
+	log := loggerFrom(ctx)
+
+	changed := false
+	for _, f := range d.list() {
+		if !f.Enabled {
+			continue
+		}
+
+		added, removed, err := d.reconcile(ctx, f.Filter)
+		if err != nil {
+			log.Warn("Unable to reconcile dynamic filter", zap.String("filter", f.Filter), zap.Error(err))
+		}
+		if added+removed != 0 {
+			changed = true
+			log.Info("Reconciled dynamic filter", zap.String("filter", f.Filter), zap.Int("added", added), zap.Int("removed", removed))
+		}
+	}
+
+	if changed {
+		if err := syncAfterChange(ctx, senderFrom(ctx)); err != nil {
+			log.Warn("Unable to sync after reconciling dynamic filters", zap.Error(err))
+		}
+	}
+}
+
+const dynamicUsage = "Usage: !role dynamic set <filter> <rule> | preview <filter> | enable|disable|remove <filter> | list"
+
+func dynamicAdmin(ctx context.Context, sender *Sender, req *proto.ExecRequest) (string, error) {
+	args := req.Args[2:]
+
+	switch {
+	case args[0] == "list" && len(args) == 1:
+		return listDynamicFilters()
+	case args[0] == "set" && len(args) >= 3:
+		return setDynamicFilter(ctx, sender, args[1], args[2:])
+	case args[0] == "preview" && len(args) == 2:
+		return previewDynamicFilter(ctx, sender, req)
+	case args[0] == "enable" && len(args) == 2:
+		return enableDynamicFilter(ctx, sender, args[1])
+	case args[0] == "disable" && len(args) == 2:
+		return disableDynamicFilter(sender, args[1])
+	case args[0] == "remove" && len(args) == 2:
+		return removeDynamicFilter(args[1])
+	default:
+		return "", usageError(dynamicUsage)
+	}
+}
+
+func listDynamicFilters() (string, error) {
+	list := dynamicFilterSet.list()
+	if len(list) == 0 {
+		return "```No dynamic filters```\n", nil
+	}
+
+	var buffer bytes.Buffer
+	buffer.WriteString("Dynamic filters:\n")
+	for _, f := range list {
+		state := "disabled"
+		if f.Enabled {
+			state = "enabled"
+		}
+		buffer.WriteString(fmt.Sprintf("\t%s (%s): %s\n", f.Filter, state, f.Rule))
+		if !f.Reconciled.IsZero() {
+			buffer.WriteString(fmt.Sprintf("\t\tlast reconciled %s ago, added %d, removed %d\n",
+				time.Since(f.Reconciled).Truncate(time.Second), f.Added, f.Removed))
+		}
+		if len(f.LastError) != 0 {
+			buffer.WriteString(fmt.Sprintf("\t\tlast error: %s\n", f.LastError))
+		}
+	}
+
+	return fmt.Sprintf("```%s```\n", buffer.String()), nil
+}
+
+// setDynamicFilter sets the filter's rule, leaving it disabled so the change can be
+// previewed before it's enabled.
+func setDynamicFilter(ctx context.Context, sender *Sender, filter string, tokens []string) (string, error) {
+	r, err := parseRule(tokens)
+	if err != nil {
+		return "", err
+	}
+
+	filters, err := role.RoleClient.GetFilters(ctx, &rolesrv.NilMessage{})
+	if err != nil {
+		return "", upstreamError(err)
+	}
+	found := false
+	for _, f := range filters.FilterList {
+		found = found || f.Name == filter
+	}
+	if !found {
+		return "", notFoundError("No filter called %s", filter)
+	}
+
+	// A rule that looks at a role kept in the filter itself would chase its own tail
+	for _, roleName := range r.roles() {
+		referenced, err := role.RoleClient.GetRole(ctx, &rolesrv.Role{ShortName: roleName})
+		if err != nil {
+			return "", upstreamError(err)
+		}
+		if memberFilter(referenced) == filter {
+			return "", usageError(fmt.Sprintf("The rule can't use %s, its members are kept in %s", roleName, filter))
+		}
+	}
+
+	err = dynamicFilterSet.update(filter, func(f *dynamicFilter) (*dynamicFilter, error) {
+		return &dynamicFilter{Filter: filter, Rule: r.source, UpdatedBy: sender.UserID, Updated: time.Now().UTC()}, nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return common.SendSuccess(fmt.Sprintf("Set the rule for %s, check it with !role dynamic preview %s then enable it", filter, filter)), nil
+}
+
+func previewDynamicFilter(ctx context.Context, sender *Sender, req *proto.ExecRequest) (string, error) {
+	table, err := previewDynamicFilterTable(ctx, sender, req)
+	if err != nil {
+		return "", err
+	}
+
+	filter := req.Args[3]
+	if len(table.Rows) == 0 {
+		return fmt.Sprintf("```%s already matches its rule```\n", filter), nil
+	}
+
+	var buffer bytes.Buffer
+	buffer.WriteString(fmt.Sprintf("Enabling %s would:\n", filter))
+	for _, row := range table.Rows {
+		buffer.WriteString(fmt.Sprintf("\t%s %s\n", row[0], row[2]))
+	}
+
+	return fmt.Sprintf("```%s```\n", buffer.String()), nil
+}
+
+func previewDynamicFilterTable(ctx context.Context, sender *Sender, req *proto.ExecRequest) (*Table, error) {
+	filter := req.Args[3]
+
+	f := dynamicFilterSet.get(filter)
+	if f == nil {
+		return nil, notFoundError("%s isn't a dynamic filter", filter)
+	}
+
+	add, remove, _, err := f.delta(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	_, names, err := renderer.Render(ctx, append(append([]string(nil), add...), remove...))
+	if err != nil {
+		return nil, upstreamError(err)
+	}
+
+	table := &Table{Columns: []string{"change", "user_id", "name"}}
+	for i, id := range add {
+		table.Rows = append(table.Rows, []string{"add", id, names[i]})
+	}
+	for i, id := range remove {
+		table.Rows = append(table.Rows, []string{"remove", id, names[len(add)+i]})
+	}
+
+	return table, nil
+}
+
+func enableDynamicFilter(ctx context.Context, sender *Sender, filter string) (string, error) {
+	err := dynamicFilterSet.update(filter, func(f *dynamicFilter) (*dynamicFilter, error) {
+		if f == nil {
+			return nil, notFoundError("%s isn't a dynamic filter", filter)
+		}
+		f.Enabled, f.UpdatedBy, f.Updated = true, sender.UserID, time.Now().UTC()
+		return f, nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	added, removed, err := dynamicFilterSet.reconcile(ctx, filter)
+	if err != nil {
+		return "", err
+	}
+
+	if added+removed != 0 {
+		if err = syncAfterChange(ctx, sender); err != nil {
+			return "", err
+		}
+	}
+
+	return common.SendSuccess(fmt.Sprintf("Enabled %s, added %d and removed %d members", filter, added, removed)), nil
+}
+
+func disableDynamicFilter(sender *Sender, filter string) (string, error) {
+	err := dynamicFilterSet.update(filter, func(f *dynamicFilter) (*dynamicFilter, error) {
+		if f == nil {
+			return nil, notFoundError("%s isn't a dynamic filter", filter)
+		}
+		f.Enabled, f.UpdatedBy, f.Updated = false, sender.UserID, time.Now().UTC()
+		return f, nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return common.SendSuccess(fmt.Sprintf("Disabled %s, its members stay as they are", filter)), nil
+}
+
+func removeDynamicFilter(filter string) (string, error) {
+	err := dynamicFilterSet.update(filter, func(f *dynamicFilter) (*dynamicFilter, error) {
+		if f == nil {
+			return nil, notFoundError("%s isn't a dynamic filter", filter)
+		}
+		return nil, nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return common.SendSuccess(fmt.Sprintf("%s is an ordinary filter again, its members stay as they are", filter)), nil
+}
+
+// isPreview is the only dynamic subcommand with a table.
+func isPreview(req *proto.ExecRequest) bool {
+	return req.Args[2] == "preview" && len(req.Args) == 4
+}
@@ -0,0 +1,113 @@
+package command
+
+import (
+	"fmt"
+	"strings"
+
+	common "github.com/chremoas/services-common/command"
+	"github.com/micro/go-micro/errors"
+
+	"github.com/chremoas/role-cmd/upstream"
+)
+
+type errorKind string
+
+const (
+	errUsage       errorKind = "usage"
+	errPermission  errorKind = "permission"
+	errNotFound    errorKind = "not_found"
+	errRateLimited errorKind = "rate_limited"
+	errUnavailable errorKind = "upstream_unavailable"
+	errInternal    errorKind = "internal"
+)
+
+// commandError is an error a subcommand hands back to Exec. The kind decides how it's
+// shown to the user and logged, the message is what the user sees.
+type commandError struct {
+	kind    errorKind
+	message string
+	err     error
+}
+
+func (e *commandError) Error() string {
+	if e.err != nil {
+		return fmt.Sprintf("%s: %s: %v", e.kind, e.message, e.err)
+	}
+	return fmt.Sprintf("%s: %s", e.kind, e.message)
+}
+
+func usageError(usage string) error {
+	return &commandError{kind: errUsage, message: usage}
+}
+
+func permissionError() error {
+	return &commandError{kind: errPermission, message: "User doesn't have permission to this command"}
+}
+
+func notFoundError(format string, a ...interface{}) error {
+	return &commandError{kind: errNotFound, message: fmt.Sprintf(format, a...)}
+}
+
+func internalError(err error) error {
+	return &commandError{kind: errInternal, message: "Something went wrong", err: err}
+}
+
+// upstreamError classifies an error from a role-srv or perms-srv call.
+func upstreamError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if _, ok := err.(*commandError); ok {
+		return err
+	}
+
+	if unavailable, ok := err.(*upstream.UnavailableError); ok {
+		return &commandError{kind: errUnavailable, message: unavailable.Error()}
+	}
+
+	if upstream.IsUnavailable(err) {
+		return &commandError{kind: errUnavailable, message: "Upstream service unavailable, try again later", err: err}
+	}
+
+	e := errors.Parse(err.Error())
+	switch {
+	case e.Code == 404, strings.Contains(e.Detail, "no rows in result set"):
+		return &commandError{kind: errNotFound, message: "Not found", err: err}
+	default:
+		return internalError(err)
+	}
+}
+
+// storeError classifies an error from changing one of role-cmd's own stores. An error
+// the change itself returned is kept, anything else means it couldn't be saved.
+func storeError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if _, ok := err.(*commandError); ok {
+		return err
+	}
+	return internalError(err)
+}
+
+func classify(err error) *commandError {
+	if e, ok := err.(*commandError); ok {
+		return e
+	}
+	return internalError(err).(*commandError)
+}
+
+// render is what the user sees for an error. Anything other than a usage error carries
+// the request ID so it can be matched up with the logs.
+func (e *commandError) render(requestID string) string {
+	switch e.kind {
+	case errUsage, errRateLimited:
+		return common.SendError(e.message)
+	case errPermission, errNotFound:
+		return common.SendError(fmt.Sprintf("%s (reference: %s)", e.message, requestID))
+	default:
+		return common.SendFatal(fmt.Sprintf("%s (reference: %s)", e.message, requestID))
+	}
+}
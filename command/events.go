@@ -0,0 +1,192 @@
+package command
+
+import (
+	"context"
+
+	rolesrv "github.com/chremoas/role-srv/proto"
+	"github.com/micro/go-micro/client"
+	"go.uber.org/zap"
+
+	"github.com/chremoas/role-cmd/events"
+)
+
+// eventRecorder publishes an event for every change that goes through role-srv, whether
+// a subcommand, the API or rclient made it. It looks roles and memberships up before
+// and after the change so the events can say what changed.
+type eventRecorder struct {
+	rolesrv.RolesService
+	sink events.Sink
+}
+
+func eventHeader(ctx context.Context, eventType string) events.Header {
+	h := events.Header{Type: eventType, RequestID: requestID(ctx)}
+	if sender := senderFrom(ctx); sender != nil {
+		h.Actor = events.Actor{Platform: sender.Platform, ChannelID: sender.ChannelID, UserID: sender.UserID}
+	}
+
+	return h
+}
+
+// Losing an event isn't worth failing a change that has already been made
+func (e eventRecorder) publish(ctx context.Context, event events.Event) {
+	if err := e.sink.Publish(event); err != nil {
+		loggerFrom(ctx).Warn("Unable to publish event", zap.Error(err))
+	}
+}
+
+// notify publishes an event about something other than a role-srv change, like a join
+// request. Without a sink it goes nowhere.
+func notify(ctx context.Context, event events.Event) {
+	if eventSink == nil {
+		return
+	}
+
+	if err := eventSink.Publish(event); err != nil {
+		loggerFrom(ctx).Warn("Unable to publish event", zap.Error(err))
+	}
+}
+
+func (e eventRecorder) getRole(ctx context.Context, name string) *rolesrv.Role {
+	r, err := e.RolesService.GetRole(ctx, &rolesrv.Role{ShortName: name})
+	if err != nil {
+		return nil
+	}
+	return r
+}
+
+func (e eventRecorder) getFilter(ctx context.Context, name string) *events.Filter {
+	filters, err := e.RolesService.GetFilters(ctx, &rolesrv.NilMessage{})
+	if err != nil {
+		return nil
+	}
+
+	for _, f := range filters.FilterList {
+		if f.Name == name {
+			return &events.Filter{Name: f.Name, Description: f.Description}
+		}
+	}
+	return nil
+}
+
+func (e eventRecorder) getMembers(ctx context.Context, filter string) []string {
+	members, err := e.RolesService.GetMembers(ctx, &rolesrv.Filter{Name: filter})
+	if err != nil {
+		return nil
+	}
+	return members.Members
+}
+
+func (e eventRecorder) AddRole(ctx context.Context, in *rolesrv.Role, opts ...client.CallOption) (*rolesrv.NilMessage, error) {
+	rsp, err := e.RolesService.AddRole(ctx, in, opts...)
+	if err == nil {
+		e.publish(ctx, &events.RoleChanged{
+			Header: eventHeader(ctx, events.RoleCreated),
+			Target: in.ShortName,
+			After:  events.NewRole(e.getRole(ctx, in.ShortName)),
+		})
+	}
+
+	return rsp, err
+}
+
+func (e eventRecorder) RemoveRole(ctx context.Context, in *rolesrv.Role, opts ...client.CallOption) (*rolesrv.NilMessage, error) {
+	before := e.getRole(ctx, in.ShortName)
+
+	rsp, err := e.RolesService.RemoveRole(ctx, in, opts...)
+	if err == nil {
+		e.publish(ctx, &events.RoleChanged{
+			Header: eventHeader(ctx, events.RoleDestroyed),
+			Target: in.ShortName,
+			Before: events.NewRole(before),
+		})
+	}
+
+	return rsp, err
+}
+
+func (e eventRecorder) UpdateRole(ctx context.Context, in *rolesrv.UpdateInfo, opts ...client.CallOption) (*rolesrv.NilMessage, error) {
+	before := e.getRole(ctx, in.Name)
+
+	rsp, err := e.RolesService.UpdateRole(ctx, in, opts...)
+	if err == nil {
+		e.publish(ctx, &events.RoleChanged{
+			Header: eventHeader(ctx, events.RoleUpdated),
+			Target: in.Name,
+			Before: events.NewRole(before),
+			After:  events.NewRole(e.getRole(ctx, in.Name)),
+		})
+	}
+
+	return rsp, err
+}
+
+func (e eventRecorder) AddFilter(ctx context.Context, in *rolesrv.Filter, opts ...client.CallOption) (*rolesrv.NilMessage, error) {
+	rsp, err := e.RolesService.AddFilter(ctx, in, opts...)
+	if err == nil {
+		e.publish(ctx, &events.FilterChanged{
+			Header: eventHeader(ctx, events.FilterCreated),
+			Target: in.Name,
+			After:  &events.Filter{Name: in.Name, Description: in.Description},
+		})
+	}
+
+	return rsp, err
+}
+
+func (e eventRecorder) RemoveFilter(ctx context.Context, in *rolesrv.Filter, opts ...client.CallOption) (*rolesrv.NilMessage, error) {
+	before := e.getFilter(ctx, in.Name)
+
+	rsp, err := e.RolesService.RemoveFilter(ctx, in, opts...)
+	if err == nil {
+		e.publish(ctx, &events.FilterChanged{
+			Header: eventHeader(ctx, events.FilterDestroyed),
+			Target: in.Name,
+			Before: before,
+		})
+	}
+
+	return rsp, err
+}
+
+func (e eventRecorder) AddMembers(ctx context.Context, in *rolesrv.Members, opts ...client.CallOption) (*rolesrv.NilMessage, error) {
+	before := e.getMembers(ctx, in.Filter)
+
+	rsp, err := e.RolesService.AddMembers(ctx, in, opts...)
+	if err == nil {
+		e.publish(ctx, &events.MembershipChanged{
+			Header:  eventHeader(ctx, events.MembersAdded),
+			Filter:  in.Filter,
+			Members: in.Name,
+			Before:  before,
+			After:   e.getMembers(ctx, in.Filter),
+		})
+	}
+
+	return rsp, err
+}
+
+func (e eventRecorder) RemoveMembers(ctx context.Context, in *rolesrv.Members, opts ...client.CallOption) (*rolesrv.NilMessage, error) {
+	before := e.getMembers(ctx, in.Filter)
+
+	rsp, err := e.RolesService.RemoveMembers(ctx, in, opts...)
+	if err == nil {
+		e.publish(ctx, &events.MembershipChanged{
+			Header:  eventHeader(ctx, events.MembersRemoved),
+			Filter:  in.Filter,
+			Members: in.Name,
+			Before:  before,
+			After:   e.getMembers(ctx, in.Filter),
+		})
+	}
+
+	return rsp, err
+}
+
+func (e eventRecorder) SyncToChatService(ctx context.Context, in *rolesrv.SyncRequest, opts ...client.CallOption) (*rolesrv.NilMessage, error) {
+	rsp, err := e.RolesService.SyncToChatService(ctx, in, opts...)
+	if err == nil {
+		e.publish(ctx, &events.SyncRequested{Header: eventHeader(ctx, events.Synced)})
+	}
+
+	return rsp, err
+}
@@ -0,0 +1,409 @@
+package command
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	proto "github.com/chremoas/chremoas/proto"
+	rolesrv "github.com/chremoas/role-srv/proto"
+	common "github.com/chremoas/services-common/command"
+	"go.uber.org/zap"
+
+	"github.com/chremoas/role-cmd/settings"
+	"github.com/chremoas/role-cmd/store"
+)
+
+// A grant is a temporary role membership, the user is taken back out of the role's
+// filter when it expires.
+type grant struct {
+	ID        string    `json:"id"`
+	UserID    string    `json:"userId"`
+	Role      string    `json:"role"`
+	Filter    string    `json:"filter"`
+	GrantedBy string    `json:"grantedBy"`
+	Granted   time.Time `json:"granted"`
+	Expires   time.Time `json:"expires"`
+}
+
+// grantSchedule holds the pending grants, saving them on every change so they outlive
+// restarts.
+type grantSchedule struct {
+	grants      *store.Collection
+	maxDuration time.Duration
+}
+
+func newGrantSchedule(file *store.File, conf settings.Grants) (*grantSchedule, error) {
+	grants, err := store.NewCollection(file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load grants from %s: %s", file.Path(), err)
+	}
+
+	return &grantSchedule{grants: grants, maxDuration: conf.MaxDuration}, nil
+}
+
+// add saves the grant, unless the user already has one for the role. Both happen under
+// the store's lock so two grants can't be made at once.
+func (g *grantSchedule) add(gr *grant) error {
+	err := g.grants.Update(func(tx *store.Tx) error {
+		var pending []grant
+		tx.List(&pending)
+		for _, existing := range pending {
+			if existing.UserID == gr.UserID && existing.Role == gr.Role {
+				return usageError(fmt.Sprintf("There's already a grant for that, extend it instead: !role grant extend %s <duration>", existing.ID))
+			}
+		}
+
+		return tx.Put(gr.ID, gr)
+	})
+
+	return storeError(err)
+}
+
+func (g *grantSchedule) remove(id string) error {
+	return g.grants.Update(func(tx *store.Tx) error {
+		tx.Delete(id)
+		return nil
+	})
+}
+
+// get returns a copy of the grant, or nil.
+func (g *grantSchedule) get(id string) *grant {
+	var gr grant
+	if !g.grants.Get(id, &gr) {
+		return nil
+	}
+	return &gr
+}
+
+func (g *grantSchedule) extend(id string, by time.Duration) (*grant, error) {
+	var gr grant
+	err := g.grants.Update(func(tx *store.Tx) error {
+		if !tx.Get(id, &gr) {
+			return notFoundError("No grant %s", id)
+		}
+
+		gr.Expires = gr.Expires.Add(by)
+		if time.Until(gr.Expires) > g.maxDuration {
+			return usageError(fmt.Sprintf("Grants can't run for more than %s", formatDuration(g.maxDuration)))
+		}
+
+		return tx.Put(id, &gr)
+	})
+	if err != nil {
+		return nil, storeError(err)
+	}
+
+	return &gr, nil
+}
+
+// list returns the grants for a role, or all of them, soonest to expire first.
+func (g *grantSchedule) list(role string) []grant {
+	var all, list []grant
+	g.grants.List(&all)
+	for _, gr := range all {
+		if len(role) == 0 || gr.Role == role {
+			list = append(list, gr)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Expires.Before(list[j].Expires) })
+
+	return list
+}
+
+func (g *grantSchedule) expired(now time.Time) []grant {
+	var expired []grant
+	for _, gr := range g.list("") {
+		if !gr.Expires.After(now) {
+			expired = append(expired, gr)
+		}
+	}
+
+	return expired
+}
+
+// sweep takes everyone whose grant has expired out of the role and syncs once if it
+// did anything. A grant that can't be removed is left for the next sweep, unless its
+// filter is gone, which leaves nothing to take them out of.
+func (g *grantSchedule) sweep(ctx context.Context) {
+	log := loggerFrom(ctx)
+
+	removed := 0
+	for _, gr := range g.expired(time.Now()) {
+		_, err := role.RoleClient.RemoveMembers(ctx, &rolesrv.Members{Name: []string{gr.UserID}, Filter: gr.Filter})
+		if err != nil && classify(upstreamError(err)).kind != errNotFound {
+			log.Warn("Unable to remove expired grant, will try again",
+				zap.String("grant", gr.ID), zap.String("user", gr.UserID), zap.String("role", gr.Role), zap.Error(err))
+			continue
+		}
+
+		if removeErr := g.remove(gr.ID); removeErr != nil {
+			log.Error("Unable to save grants", zap.Error(removeErr))
+		}
+
+		if err != nil {
+			log.Warn("Dropped expired grant, its filter no longer exists",
+				zap.String("grant", gr.ID), zap.String("user", gr.UserID), zap.String("role", gr.Role),
+				zap.String("filter", gr.Filter), zap.Error(err))
+			continue
+		}
+		removed++
+
+		log.Info("Grant expired",
+			zap.String("grant", gr.ID), zap.String("user", gr.UserID), zap.String("role", gr.Role))
+	}
+
+	if removed > 0 {
+		if err := syncAfterChange(ctx, senderFrom(ctx)); err != nil {
+			log.Warn("Unable to sync after expiring grants", zap.Error(err))
+		}
+	}
+}
+
+// Durations can also be given in days or weeks, e.g. 3d or 2w, which time.ParseDuration
+// doesn't do.
+var longDurationPattern = regexp.MustCompile(`^(\d+)([dw])$`)
+
+// longestDuration keeps days and weeks well clear of overflowing a time.Duration. Grants
+// are limited far more tightly by their own maximum.
+const longestDuration = 100 * 365 * 24 * time.Hour
+
+func parseDuration(arg string) (time.Duration, error) {
+	invalid := usageError(fmt.Sprintf("Not a duration: %s (try 12h, 3d or 2w)", arg))
+
+	var d time.Duration
+	if m := longDurationPattern.FindStringSubmatch(arg); m != nil {
+		unit := 24 * time.Hour
+		if m[2] == "w" {
+			unit *= 7
+		}
+		n, err := strconv.ParseInt(m[1], 10, 64)
+		if err != nil || n > int64(longestDuration/unit) {
+			return 0, invalid
+		}
+		d = time.Duration(n) * unit
+	} else {
+		var err error
+		if d, err = time.ParseDuration(arg); err != nil {
+			return 0, invalid
+		}
+	}
+
+	if d <= 0 || d > longestDuration {
+		return 0, invalid
+	}
+
+	return d, nil
+}
+
+func formatDuration(d time.Duration) string {
+	if d >= 48*time.Hour {
+		return fmt.Sprintf("%dd", int(d.Hours()/24))
+	}
+	return d.Truncate(time.Minute).String()
+}
+
+// memberFilter is the filter users are added to for the role: a SIG's members are kept
+// in filter B, like JoinSIG does, and a role's in filter A.
+func memberFilter(r *rolesrv.Role) string {
+	if r.Sig {
+		return r.FilterB
+	}
+	return r.FilterA
+}
+
+// newShortID is short enough to type back in, e.g. for !role grant revoke.
+func newShortID() string {
+	return newRequestID()[:8]
+}
+
+const grantUsage = "Usage: !role grant <@user|user_id> <role_name> <duration> | grant extend <id> <duration> | grant revoke <id>"
+
+func grantRole(ctx context.Context, sender *Sender, req *proto.ExecRequest) (string, error) {
+	switch {
+	case req.Args[2] == "extend" && len(req.Args) == 5:
+		return extendGrant(ctx, req.Args[3], req.Args[4])
+	case req.Args[2] == "revoke" && len(req.Args) == 4:
+		return revokeGrant(ctx, sender, req.Args[3])
+	case len(req.Args) == 5:
+		return addGrant(ctx, sender, req.Args[2], req.Args[3], req.Args[4])
+	default:
+		return "", usageError(grantUsage)
+	}
+}
+
+func addGrant(ctx context.Context, sender *Sender, user, roleName, duration string) (string, error) {
+	userID, ok := parseUser(user)
+	if !ok {
+		return "", usageError(grantUsage)
+	}
+
+	d, err := parseDuration(duration)
+	if err != nil {
+		return "", err
+	}
+	if d > grants.maxDuration {
+		return "", usageError(fmt.Sprintf("Grants can't run for more than %s", formatDuration(grants.maxDuration)))
+	}
+
+	r, err := role.RoleClient.GetRole(ctx, &rolesrv.Role{ShortName: roleName})
+	if err != nil {
+		return "", upstreamError(err)
+	}
+
+	// Joining one role of an exclusive group takes them out of the others for good, and
+	// expiring the grant wouldn't give that back
+	if len(groups.rivals(roleName)) != 0 {
+		return "", usageError(fmt.Sprintf("%s is in an exclusive group, so it can only be given for good", roleName))
+	}
+
+	// Expiring the grant would take away a membership they had before it
+	members, err := role.RoleClient.GetMembers(ctx, &rolesrv.Filter{Name: memberFilter(r)})
+	if err != nil {
+		return "", upstreamError(err)
+	}
+	for _, member := range members.Members {
+		if member == userID {
+			return "", usageError(fmt.Sprintf("They already have %s without a grant", roleName))
+		}
+	}
+
+	// A grant on a full role would only put them on the waitlist, and whoever promotes them
+	// later wouldn't know the membership was meant to expire
+	if seats := waitlist.capacity(roleName); seats != 0 && len(members.Members) >= seats {
+		return "", usageError(fmt.Sprintf("%s is full (%d seats), so it can't be granted until someone leaves", roleName, seats))
+	}
+
+	now := time.Now().UTC()
+	gr := &grant{
+		ID:        newShortID(),
+		UserID:    userID,
+		Role:      roleName,
+		Filter:    memberFilter(r),
+		GrantedBy: sender.UserID,
+		Granted:   now,
+		Expires:   now.Add(d),
+	}
+
+	// Saved first, so there's never a membership nothing will take away
+	if err = grants.add(gr); err != nil {
+		return "", err
+	}
+
+	if _, err = role.RoleClient.AddMembers(ctx, &rolesrv.Members{Name: []string{userID}, Filter: gr.Filter}); err != nil {
+		if removeErr := grants.remove(gr.ID); removeErr != nil {
+			loggerFrom(ctx).Error("Unable to save grants", zap.Error(removeErr))
+		}
+		// Filled up since we looked, don't leave them queued for a seat with no expiry
+		if waitlist.position(roleName, userID) != 0 {
+			if removeErr := waitlist.dequeue(roleName, userID); removeErr != nil {
+				loggerFrom(ctx).Error("Unable to save waitlists", zap.Error(removeErr))
+			}
+		}
+		return "", upstreamError(err)
+	}
+
+	if err = syncAfterChange(ctx, sender); err != nil {
+		return "", err
+	}
+
+	_, names, err := renderer.Render(ctx, []string{userID})
+	if err != nil {
+		return "", upstreamError(err)
+	}
+
+	return common.SendSuccess(fmt.Sprintf("Granted %s to %s for %s, until %s (grant %s)",
+		roleName, names[0], formatDuration(d), gr.Expires.Format(time.RFC1123), gr.ID)), nil
+}
+
+func extendGrant(ctx context.Context, id, duration string) (string, error) {
+	d, err := parseDuration(duration)
+	if err != nil {
+		return "", err
+	}
+
+	gr, err := grants.extend(id, d)
+	if err != nil {
+		return "", err
+	}
+
+	return common.SendSuccess(fmt.Sprintf("Grant %s now runs until %s", gr.ID, gr.Expires.Format(time.RFC1123))), nil
+}
+
+func revokeGrant(ctx context.Context, sender *Sender, id string) (string, error) {
+	gr := grants.get(id)
+	if gr == nil {
+		return "", notFoundError("No grant %s", id)
+	}
+
+	if _, err := role.RoleClient.RemoveMembers(ctx, &rolesrv.Members{Name: []string{gr.UserID}, Filter: gr.Filter}); err != nil {
+		return "", upstreamError(err)
+	}
+
+	if err := grants.remove(gr.ID); err != nil {
+		return "", internalError(err)
+	}
+
+	if err := syncAfterChange(ctx, sender); err != nil {
+		return "", err
+	}
+
+	return common.SendSuccess(fmt.Sprintf("Revoked grant %s of %s", gr.ID, gr.Role)), nil
+}
+
+func listGrants(ctx context.Context, sender *Sender, req *proto.ExecRequest) (string, error) {
+	table, err := listGrantsTable(ctx, sender, req)
+	if err != nil {
+		return "", err
+	}
+
+	if len(table.Rows) == 0 {
+		return "```No pending grants```\n", nil
+	}
+
+	var buffer bytes.Buffer
+	buffer.WriteString("Pending grants:\n")
+	for _, row := range table.Rows {
+		buffer.WriteString(fmt.Sprintf("\t%s: %s has %s, expires in %s (granted by %s)\n",
+			row[0], row[2], row[3], row[5], row[6]))
+	}
+
+	return fmt.Sprintf("```%s```\n", buffer.String()), nil
+}
+
+func listGrantsTable(ctx context.Context, sender *Sender, req *proto.ExecRequest) (*Table, error) {
+	var roleName string
+	if len(req.Args) == 3 {
+		roleName = req.Args[2]
+	}
+
+	pending := grants.list(roleName)
+
+	ids := make([]string, 0, 2*len(pending))
+	for _, gr := range pending {
+		ids = append(ids, gr.UserID, gr.GrantedBy)
+	}
+	_, names, err := renderer.Render(ctx, ids)
+	if err != nil {
+		return nil, upstreamError(err)
+	}
+
+	table := &Table{Columns: []string{"id", "user_id", "name", "role", "expires", "remaining", "granted_by"}}
+	for i, gr := range pending {
+		table.Rows = append(table.Rows, []string{
+			gr.ID,
+			gr.UserID,
+			names[2*i],
+			gr.Role,
+			gr.Expires.Format(time.RFC3339),
+			formatDuration(time.Until(gr.Expires)),
+			names[2*i+1],
+		})
+	}
+
+	return table, nil
+}
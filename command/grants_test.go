@@ -0,0 +1,161 @@
+package command
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	rolesrv "github.com/chremoas/role-srv/proto"
+
+	"github.com/chremoas/role-cmd/store"
+)
+
+func TestParseDuration(t *testing.T) {
+	day := 24 * time.Hour
+
+	tests := []struct {
+		arg  string
+		want time.Duration // 0 for an error
+	}{
+		{"12h", 12 * time.Hour},
+		{"90m", 90 * time.Minute},
+		{"3d", 3 * day},
+		{"2w", 14 * day},
+		{"1h30m", 90 * time.Minute},
+		{"0d", 0},
+		{"0w", 0},
+		{"0h", 0},
+		{"-1h", 0},
+		{"-1d", 0},
+		{"1.5d", 0},
+		{"d", 0},
+		{"soon", 0},
+		{"", 0},
+		// Would overflow a time.Duration
+		{"99999999999999999999d", 0},
+		{"9999999999w", 0},
+		{"999999h", 0},
+	}
+
+	for _, test := range tests {
+		got, err := parseDuration(test.arg)
+		if test.want == 0 {
+			if err == nil {
+				t.Errorf("parseDuration(%q) = %s, want an error", test.arg, got)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("parseDuration(%q): %s", test.arg, err)
+		} else if got != test.want {
+			t.Errorf("parseDuration(%q) = %s, want %s", test.arg, got, test.want)
+		}
+	}
+}
+
+// expire makes every pending grant run out now.
+func expire(t *testing.T) {
+	err := grants.grants.Update(func(tx *store.Tx) error {
+		for _, id := range tx.Keys() {
+			var gr grant
+			tx.Get(id, &gr)
+			gr.Expires = time.Now().Add(-time.Second)
+			if err := tx.Put(id, &gr); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGrant(t *testing.T) {
+	tc, cleanup := newTestCommand(t)
+	defer cleanup()
+
+	tc.roles.role(&rolesrv.Role{ShortName: "pilots", FilterA: "pilots"}, "2000")
+
+	tc.mustRun(t, testAdmin, "grant", "2001", "pilots", "3d")
+	if !tc.roles.filters["pilots"]["2001"] {
+		t.Fatal("grant didn't add them to the role")
+	}
+
+	refused := []struct {
+		name string
+		args []string
+		kind errorKind
+	}{
+		{"twice", []string{"grant", "2001", "pilots", "1d"}, errUsage},
+		{"already a member", []string{"grant", "2000", "pilots", "1d"}, errUsage},
+		{"too long", []string{"grant", "2002", "pilots", "1000d"}, errUsage},
+		{"unknown role", []string{"grant", "2002", "nope", "1d"}, errNotFound},
+		{"not an admin", []string{"grant", "2002", "pilots", "1d"}, errPermission},
+	}
+	for _, test := range refused {
+		user := testAdmin
+		if test.kind == errPermission {
+			user = "2000"
+		}
+		if _, reported := tc.run(user, test.args...); !strings.HasPrefix(reported, string(test.kind)+":") {
+			t.Errorf("%s: reported %q, want %s", test.name, reported, test.kind)
+		}
+	}
+	if n := len(grants.list("")); n != 1 {
+		t.Fatalf("%d grants pending, want 1", n)
+	}
+
+	expire(t)
+	syncs := tc.roles.syncs
+	grants.sweep(backgroundContext(context.Background(), "grant_sweeper"))
+
+	if tc.roles.filters["pilots"]["2001"] {
+		t.Error("expired grant left them in the role")
+	}
+	if !tc.roles.filters["pilots"]["2000"] {
+		t.Error("sweep took out a member without a grant")
+	}
+	if n := len(grants.list("")); n != 0 {
+		t.Errorf("%d grants pending after the sweep, want 0", n)
+	}
+	if tc.roles.syncs != syncs+1 {
+		t.Errorf("sweep synced %d times, want once", tc.roles.syncs-syncs)
+	}
+}
+
+func TestGrantSweepDropsGoneFilters(t *testing.T) {
+	tc, cleanup := newTestCommand(t)
+	defer cleanup()
+
+	tc.roles.role(&rolesrv.Role{ShortName: "pilots", FilterA: "pilots"})
+	tc.mustRun(t, testAdmin, "grant", "2001", "pilots", "1d")
+	delete(tc.roles.filters, "pilots")
+
+	expire(t)
+	grants.sweep(backgroundContext(context.Background(), "grant_sweeper"))
+
+	if n := len(grants.list("")); n != 0 {
+		t.Errorf("%d grants left for a filter that's gone, want 0", n)
+	}
+}
+
+func TestGrantRefusesExclusiveGroups(t *testing.T) {
+	tc, cleanup := newTestCommand(t)
+	defer cleanup()
+
+	tc.roles.role(&rolesrv.Role{ShortName: "eu", FilterA: "eu"}, "2001")
+	tc.roles.role(&rolesrv.Role{ShortName: "us", FilterA: "us"})
+	tc.mustRun(t, testAdmin, "group", "create", "timezones", "exclusive")
+	tc.mustRun(t, testAdmin, "group", "add", "timezones", "eu")
+	tc.mustRun(t, testAdmin, "group", "add", "timezones", "us")
+
+	if _, reported := tc.run(testAdmin, "grant", "2001", "us", "1d"); !strings.HasPrefix(reported, "usage:") {
+		t.Errorf("granting a role of an exclusive group reported %q, want a usage error", reported)
+	}
+	if !tc.roles.filters["eu"]["2001"] || tc.roles.filters["us"]["2001"] {
+		t.Error("a refused grant changed their roles")
+	}
+}
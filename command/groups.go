@@ -0,0 +1,471 @@
+package command
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	proto "github.com/chremoas/chremoas/proto"
+	rolesrv "github.com/chremoas/role-srv/proto"
+	common "github.com/chremoas/services-common/command"
+	"github.com/micro/go-micro/client"
+	"go.uber.org/zap"
+
+	"github.com/chremoas/role-cmd/store"
+)
+
+// A roleGroup is a set of roles, e.g. the timezone roles. In an exclusive group a user
+// may only hold one of them.
+type roleGroup struct {
+	Name      string   `json:"name"`
+	Exclusive bool     `json:"exclusive"`
+	Roles     []string `json:"roles"`
+	// The role each member of an exclusive group held at the last sweep
+	Holders map[string]string `json:"holders,omitempty"`
+}
+
+type roleGroups struct {
+	groups *store.Collection
+}
+
+func newRoleGroups(file *store.File) (*roleGroups, error) {
+	groups, err := store.NewCollection(file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load role groups from %s: %s", file.Path(), err)
+	}
+
+	return &roleGroups{groups: groups}, nil
+}
+
+// update applies change to a copy of the group and saves it. A nil group is created, and
+// change returning nil deletes it.
+func (g *roleGroups) update(name string, change func(group *roleGroup) (*roleGroup, error)) error {
+	err := g.groups.Update(func(tx *store.Tx) error {
+		var group *roleGroup
+		if existing := new(roleGroup); tx.Get(name, existing) {
+			group = existing
+		}
+
+		changed, err := change(group)
+		if err != nil {
+			return err
+		}
+
+		if changed == nil {
+			tx.Delete(name)
+			return nil
+		}
+		return tx.Put(name, changed)
+	})
+
+	return storeError(err)
+}
+
+// list returns copies of every group, by name.
+func (g *roleGroups) list() []roleGroup {
+	var list []roleGroup
+	g.groups.List(&list)
+
+	return list
+}
+
+// exclusive returns the groups a user can only hold one role of.
+func (g *roleGroups) exclusive() []roleGroup {
+	var exclusive []roleGroup
+	for _, group := range g.list() {
+		if group.Exclusive {
+			exclusive = append(exclusive, group)
+		}
+	}
+
+	return exclusive
+}
+
+// rivals returns the roles that share an exclusive group with the role.
+func (g *roleGroups) rivals(role string) []string {
+	seen := make(map[string]bool)
+	var rivals []string
+	for _, group := range g.exclusive() {
+		if !containsString(group.Roles, role) {
+			continue
+		}
+		for _, other := range group.Roles {
+			if other != role && !seen[other] {
+				seen[other] = true
+				rivals = append(rivals, other)
+			}
+		}
+	}
+
+	return rivals
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// groupEnforcer takes users out of the other roles of an exclusive group when they're
+// added to one of them through role-cmd. The caller's sync picks the removals up along
+// with the addition. sig-cmd goes straight to role-srv, so roleGroups.sweep catches up
+// with those.
+type groupEnforcer struct {
+	rolesrv.RolesService
+}
+
+func (g groupEnforcer) AddMembers(ctx context.Context, in *rolesrv.Members, opts ...client.CallOption) (*rolesrv.NilMessage, error) {
+	rsp, err := g.RolesService.AddMembers(ctx, in, opts...)
+	if err == nil && len(groups.exclusive()) != 0 {
+		g.removeFromRivals(ctx, in)
+	}
+
+	return rsp, err
+}
+
+func (g groupEnforcer) removeFromRivals(ctx context.Context, in *rolesrv.Members) {
+	log := loggerFrom(ctx)
+
+	roles, err := g.RolesService.GetRoles(ctx, &rolesrv.NilMessage{})
+	if err != nil {
+		log.Warn("Unable to look roles up for exclusive groups", zap.Error(err))
+		return
+	}
+
+	byName := make(map[string]*rolesrv.Role)
+	for _, r := range roles.Roles {
+		byName[r.ShortName] = r
+	}
+
+	done := map[string]bool{in.Filter: true, "wildcard": true}
+	for _, r := range roles.Roles {
+		if memberFilter(r) != in.Filter {
+			continue
+		}
+
+		for _, name := range groups.rivals(r.ShortName) {
+			rival, ok := byName[name]
+			if !ok || done[memberFilter(rival)] {
+				continue
+			}
+			done[memberFilter(rival)] = true
+
+			_, err := g.RolesService.RemoveMembers(ctx, &rolesrv.Members{Name: in.Name, Filter: memberFilter(rival)})
+			if err != nil {
+				log.Warn("Unable to remove members from an exclusive group rival",
+					zap.String("role", r.ShortName), zap.String("rival", rival.ShortName), zap.Error(err))
+				continue
+			}
+
+			log.Info("Removed members from exclusive group rival",
+				zap.String("role", r.ShortName), zap.String("rival", rival.ShortName), zap.Strings("members", in.Name))
+		}
+	}
+}
+
+const groupUsage = "Usage: !role group create <group> [exclusive] | group add <group> <role_name> | group remove <group> [role_name] | group list"
+
+func groupAdmin(ctx context.Context, sender *Sender, req *proto.ExecRequest) (string, error) {
+	args := req.Args[2:]
+
+	switch {
+	case args[0] == "list" && len(args) == 1:
+		return listGroups()
+	case args[0] == "create" && len(args) == 2:
+		return createGroup(args[1], false)
+	case args[0] == "create" && len(args) == 3 && args[2] == "exclusive":
+		return createGroup(args[1], true)
+	case args[0] == "add" && len(args) == 3:
+		return addToGroup(ctx, args[1], args[2])
+	case args[0] == "remove" && len(args) == 2:
+		return removeGroup(args[1])
+	case args[0] == "remove" && len(args) == 3:
+		return removeFromGroup(args[1], args[2])
+	default:
+		return "", usageError(groupUsage)
+	}
+}
+
+func listGroups() (string, error) {
+	list := groups.list()
+	if len(list) == 0 {
+		return "```No role groups```\n", nil
+	}
+
+	var buffer bytes.Buffer
+	buffer.WriteString("Role groups:\n")
+	for _, group := range list {
+		mode := ""
+		if group.Exclusive {
+			mode = " (exclusive)"
+		}
+		buffer.WriteString(fmt.Sprintf("\t%s%s: %s\n", group.Name, mode, strings.Join(group.Roles, ", ")))
+	}
+
+	return fmt.Sprintf("```%s```\n", buffer.String()), nil
+}
+
+func createGroup(name string, exclusive bool) (string, error) {
+	err := groups.update(name, func(group *roleGroup) (*roleGroup, error) {
+		if group != nil {
+			return nil, usageError(fmt.Sprintf("There's already a group called %s", name))
+		}
+		return &roleGroup{Name: name, Exclusive: exclusive}, nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return common.SendSuccess(fmt.Sprintf("Created group %s", name)), nil
+}
+
+func addToGroup(ctx context.Context, name, roleName string) (string, error) {
+	if _, err := role.RoleClient.GetRole(ctx, &rolesrv.Role{ShortName: roleName}); err != nil {
+		return "", upstreamError(err)
+	}
+
+	err := groups.update(name, func(group *roleGroup) (*roleGroup, error) {
+		if group == nil {
+			return nil, notFoundError("No group called %s", name)
+		}
+		if containsString(group.Roles, roleName) {
+			return nil, usageError(fmt.Sprintf("%s is already in %s", roleName, name))
+		}
+		group.Roles = append(group.Roles, roleName)
+		sort.Strings(group.Roles)
+		return group, nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return common.SendSuccess(fmt.Sprintf("Added %s to group %s", roleName, name)), nil
+}
+
+func removeFromGroup(name, roleName string) (string, error) {
+	err := groups.update(name, func(group *roleGroup) (*roleGroup, error) {
+		if group == nil {
+			return nil, notFoundError("No group called %s", name)
+		}
+		if !containsString(group.Roles, roleName) {
+			return nil, notFoundError("%s isn't in %s", roleName, name)
+		}
+
+		var roles []string
+		for _, r := range group.Roles {
+			if r != roleName {
+				roles = append(roles, r)
+			}
+		}
+		group.Roles = roles
+		return group, nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return common.SendSuccess(fmt.Sprintf("Removed %s from group %s", roleName, name)), nil
+}
+
+func removeGroup(name string) (string, error) {
+	err := groups.update(name, func(group *roleGroup) (*roleGroup, error) {
+		if group == nil {
+			return nil, notFoundError("No group called %s", name)
+		}
+		return nil, nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return common.SendSuccess(fmt.Sprintf("Removed group %s", name)), nil
+}
+
+func lint(ctx context.Context, sender *Sender, req *proto.ExecRequest) (string, error) {
+	table, err := lintTable(ctx, sender, req)
+	if err != nil {
+		return "", err
+	}
+
+	if len(table.Rows) == 0 {
+		return common.SendSuccess("No problems found"), nil
+	}
+
+	var buffer bytes.Buffer
+	buffer.WriteString("Users holding more than one role of an exclusive group:\n")
+	for _, row := range table.Rows {
+		buffer.WriteString(fmt.Sprintf("\t%s: %s has %s\n", row[0], row[2], row[3]))
+	}
+
+	return fmt.Sprintf("```%s```\n", buffer.String()), nil
+}
+
+// exclusiveHolders returns the roles of the group each of its members holds, and the
+// members in order.
+func exclusiveHolders(ctx context.Context, group roleGroup) (map[string][]string, []string, error) {
+	held := make(map[string][]string)
+	var users []string
+
+	for _, roleName := range group.Roles {
+		r, err := role.RoleClient.GetRole(ctx, &rolesrv.Role{ShortName: roleName})
+		if err != nil {
+			return nil, nil, err
+		}
+
+		members, err := role.RoleClient.GetMembers(ctx, &rolesrv.Filter{Name: memberFilter(r)})
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for _, member := range members.Members {
+			if len(member) == 0 {
+				continue
+			}
+			if len(held[member]) == 0 {
+				users = append(users, member)
+			}
+			held[member] = append(held[member], roleName)
+		}
+	}
+	sort.Strings(users)
+
+	return held, users, nil
+}
+
+// lintTable finds the users holding more than one role of an exclusive group, e.g. from
+// before the group was set up or joins made somewhere other than role-cmd.
+func lintTable(ctx context.Context, sender *Sender, req *proto.ExecRequest) (*Table, error) {
+	type violation struct {
+		group  string
+		userID string
+		roles  []string
+	}
+	var violations []violation
+
+	for _, group := range groups.exclusive() {
+		held, users, err := exclusiveHolders(ctx, group)
+		if err != nil {
+			return nil, upstreamError(err)
+		}
+
+		for _, user := range users {
+			if len(held[user]) > 1 {
+				violations = append(violations, violation{group: group.Name, userID: user, roles: held[user]})
+			}
+		}
+	}
+
+	ids := make([]string, 0, len(violations))
+	for _, v := range violations {
+		ids = append(ids, v.userID)
+	}
+	_, names, err := renderer.Render(ctx, ids)
+	if err != nil {
+		return nil, upstreamError(err)
+	}
+
+	table := &Table{Columns: []string{"group", "user_id", "name", "roles"}}
+	for i, v := range violations {
+		table.Rows = append(table.Rows, []string{v.group, v.userID, names[i], strings.Join(v.roles, ", ")})
+	}
+
+	return table, nil
+}
+
+// sweep does what groupEnforcer would have for members who joined a rival role past
+// role-cmd, e.g. with !sig join straight to role-srv: someone who held one role of an
+// exclusive group at the last sweep and has picked up one other since is taken out of
+// the old one. Anything less clear cut is left for !role lint.
+func (g *roleGroups) sweep(ctx context.Context) {
+	log := loggerFrom(ctx)
+
+	removed := false
+	for _, group := range g.exclusive() {
+		held, users, err := exclusiveHolders(ctx, group)
+		if err != nil {
+			log.Warn("Unable to look up exclusive group members", zap.String("group", group.Name), zap.Error(err))
+			continue
+		}
+
+		holders := make(map[string]string)
+		for _, userID := range users {
+			roles := held[userID]
+			if len(roles) == 1 {
+				holders[userID] = roles[0]
+				continue
+			}
+
+			previous, ok := group.Holders[userID]
+			if !ok || len(roles) != 2 || !containsString(roles, previous) {
+				log.Warn("Member holds several roles of an exclusive group",
+					zap.String("group", group.Name), zap.String("user", userID), zap.Strings("roles", roles))
+				continue
+			}
+
+			kept := roles[0]
+			if kept == previous {
+				kept = roles[1]
+			}
+
+			if err = removeFromRole(ctx, userID, previous); err != nil {
+				log.Warn("Unable to remove member from an exclusive group rival",
+					zap.String("group", group.Name), zap.String("user", userID), zap.String("role", previous), zap.Error(err))
+				continue
+			}
+			holders[userID] = kept
+			removed = true
+			log.Info("Removed member from exclusive group rival",
+				zap.String("group", group.Name), zap.String("user", userID), zap.String("role", kept), zap.String("rival", previous))
+		}
+
+		// Most sweeps find nobody has changed roles
+		if sameHolders(group.Holders, holders) {
+			continue
+		}
+		err = g.update(group.Name, func(current *roleGroup) (*roleGroup, error) {
+			if current != nil {
+				current.Holders = holders
+			}
+			return current, nil
+		})
+		if err != nil {
+			log.Error("Unable to save role groups", zap.Error(err))
+		}
+	}
+
+	if removed {
+		if err := syncAfterChange(ctx, senderFrom(ctx)); err != nil {
+			log.Warn("Unable to sync after sweeping exclusive groups", zap.Error(err))
+		}
+	}
+}
+
+func sameHolders(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for userID, role := range a {
+		if b[userID] != role {
+			return false
+		}
+	}
+
+	return true
+}
+
+// removeFromRole takes the user out of the role's member filter through the whole role
+// client, so prerequisites and waitlists follow.
+func removeFromRole(ctx context.Context, userID, roleName string) error {
+	r, err := role.RoleClient.GetRole(ctx, &rolesrv.Role{ShortName: roleName})
+	if err != nil {
+		return err
+	}
+
+	_, err = role.RoleClient.RemoveMembers(ctx, &rolesrv.Members{Name: []string{userID}, Filter: memberFilter(r)})
+	return err
+}
@@ -0,0 +1,107 @@
+package command
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	rolesrv "github.com/chremoas/role-srv/proto"
+)
+
+func newTimezones(t *testing.T, exclusive bool) (*testCommand, func()) {
+	tc, cleanup := newTestCommand(t)
+
+	tc.roles.role(&rolesrv.Role{ShortName: "eu", FilterA: "eu"}, "2001", "2002")
+	tc.roles.role(&rolesrv.Role{ShortName: "us", FilterA: "us"}, "2002")
+	tc.roles.role(&rolesrv.Role{ShortName: "caps", FilterA: "caps-a", FilterB: "caps", Sig: true})
+
+	create := []string{"group", "create", "timezones"}
+	if exclusive {
+		create = append(create, "exclusive")
+	}
+	tc.mustRun(t, testAdmin, create...)
+	tc.mustRun(t, testAdmin, "group", "add", "timezones", "eu")
+	tc.mustRun(t, testAdmin, "group", "add", "timezones", "us")
+	tc.mustRun(t, testAdmin, "group", "add", "timezones", "caps")
+
+	return tc, cleanup
+}
+
+func TestExclusiveGroup(t *testing.T) {
+	tc, cleanup := newTimezones(t, true)
+	defer cleanup()
+
+	// Anything adding members through role-cmd goes through the enforcer
+	_, err := role.RoleClient.AddMembers(context.Background(), &rolesrv.Members{Name: []string{"2001"}, Filter: "caps"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !tc.roles.filters["caps"]["2001"] {
+		t.Error("they weren't added")
+	}
+	if tc.roles.filters["eu"]["2001"] {
+		t.Error("they kept their rival role")
+	}
+	if !tc.roles.filters["eu"]["2002"] {
+		t.Error("someone else lost their role")
+	}
+
+	result := tc.mustRun(t, testAdmin, "lint")
+	if !strings.Contains(result, "2002") || strings.Contains(result, "2001") {
+		t.Errorf("lint = %q, want only 2002, who holds eu and us", result)
+	}
+}
+
+func TestGroupWithoutExclusivity(t *testing.T) {
+	tc, cleanup := newTimezones(t, false)
+	defer cleanup()
+
+	_, err := role.RoleClient.AddMembers(context.Background(), &rolesrv.Members{Name: []string{"2001"}, Filter: "us"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !tc.roles.filters["eu"]["2001"] || !tc.roles.filters["us"]["2001"] {
+		t.Error("a group that isn't exclusive took a role away")
+	}
+}
+
+func TestGroupSweep(t *testing.T) {
+	tc, cleanup := newTimezones(t, true)
+	defer cleanup()
+
+	sweep := func() { groups.sweep(backgroundContext(context.Background(), "group_sweeper")) }
+
+	// The first sweep only takes note of who holds what
+	sweep()
+	info, err := os.Stat(groups.groups.Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	sweep()
+	if again, err := os.Stat(groups.groups.Path()); err != nil || !again.ModTime().Equal(info.ModTime()) {
+		t.Error("a sweep that found nothing new saved the groups")
+	}
+
+	// Joined past role-cmd, e.g. with !sig join
+	tc.roles.filters["caps"]["2001"] = true
+	tc.roles.filters["caps"]["2002"] = true
+	syncs := tc.roles.syncs
+	sweep()
+
+	if tc.roles.filters["eu"]["2001"] || !tc.roles.filters["caps"]["2001"] {
+		t.Error("sweep didn't swap 2001's eu for the SIG they joined")
+	}
+	// Held eu and us already, so it isn't clear which to keep
+	if !tc.roles.filters["eu"]["2002"] || !tc.roles.filters["us"]["2002"] || !tc.roles.filters["caps"]["2002"] {
+		t.Error("sweep changed the roles of someone who held several already")
+	}
+	if tc.roles.syncs != syncs+1 {
+		t.Errorf("sweep synced %d times, want once", tc.roles.syncs-syncs)
+	}
+}
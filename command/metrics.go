@@ -0,0 +1,123 @@
+package command
+
+import (
+	"context"
+	"time"
+
+	rolesrv "github.com/chremoas/role-srv/proto"
+	"github.com/micro/go-micro/client"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var subcommandInvocations = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "role_cmd_subcommand_invocations_total",
+	Help: "Subcommands run, by outcome: success, usage, denied (permissions or rate limits) or error (not found, upstream or internal).",
+}, []string{"subcommand", "outcome"})
+
+var subcommandDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "role_cmd_subcommand_duration_seconds",
+	Help:    "How long subcommands took to run.",
+	Buckets: prometheus.DefBuckets,
+}, []string{"subcommand"})
+
+var permCacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "role_cmd_permission_cache_requests_total",
+	Help: "Permission checks answered by the cache (hit) or by perms-srv (miss).",
+}, []string{"result"})
+
+var syncs = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "role_cmd_syncs_total",
+	Help: "Syncs to the chat service, by result.",
+}, []string{"result"})
+
+var lastSyncSuccess = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "role_cmd_last_sync_success",
+	Help: "Whether the last sync to the chat service worked (1) or not (0).",
+})
+
+var lastSyncTimestamp = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "role_cmd_last_sync_timestamp_seconds",
+	Help: "When the last sync to the chat service finished.",
+})
+
+func init() {
+	// The caches are only there once NewCommand has run
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "role_cmd_permission_cache_entries",
+		Help: "Permission checks currently cached.",
+	}, func() float64 {
+		if permCache == nil {
+			return 0
+		}
+		return float64(permCache.Len())
+	})
+
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "role_cmd_permission_cache_hit_ratio",
+		Help: "Ratio of permission checks answered by the cache since startup.",
+	}, func() float64 {
+		if permCache == nil {
+			return 0
+		}
+		return permCache.hitRatio()
+	})
+
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "role_cmd_user_directory_entries",
+		Help: "Users in the cached guild user directory.",
+	}, func() float64 {
+		if directory == nil {
+			return 0
+		}
+		return float64(directory.Len())
+	})
+
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "role_cmd_user_directory_age_seconds",
+		Help: "How long ago the guild user directory was fetched.",
+	}, func() float64 {
+		if directory == nil {
+			return 0
+		}
+		return directory.Age().Seconds()
+	})
+}
+
+// outcome buckets an error from a subcommand for the invocation counter. Every handler
+// returns what role-srv said as an error, so a failed change is never counted as a success.
+func outcome(err error) string {
+	if err == nil {
+		return "success"
+	}
+
+	switch classify(err).kind {
+	case errUsage:
+		return "usage"
+	case errPermission, errRateLimited:
+		return "denied"
+	default:
+		return "error"
+	}
+}
+
+// syncRecorder records the result of every sync to the chat service, whether we asked
+// for it directly or rclient did after changing something.
+type syncRecorder struct {
+	rolesrv.RolesService
+}
+
+func (s syncRecorder) SyncToChatService(ctx context.Context, in *rolesrv.SyncRequest, opts ...client.CallOption) (*rolesrv.NilMessage, error) {
+	rsp, err := s.RolesService.SyncToChatService(ctx, in, opts...)
+
+	lastSyncTimestamp.Set(float64(time.Now().Unix()))
+	if err != nil {
+		syncs.WithLabelValues("failure").Inc()
+		lastSyncSuccess.Set(0)
+	} else {
+		syncs.WithLabelValues("success").Inc()
+		lastSyncSuccess.Set(1)
+	}
+
+	return rsp, err
+}
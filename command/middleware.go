@@ -0,0 +1,116 @@
+package command
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	proto "github.com/chremoas/chremoas/proto"
+	"go.uber.org/zap"
+
+	"github.com/chremoas/role-cmd/tracing"
+)
+
+// middleware wraps a subcommand with behaviour every subcommand should share.
+type middleware func(next subcommandFunc) subcommandFunc
+
+// recovery turns a panic in a subcommand into an internal error so one bad handler
+// can't take the whole service down.
+func recovery(sub *subcommand) middleware {
+	return func(next subcommandFunc) subcommandFunc {
+		return func(ctx context.Context, sender *Sender, req *proto.ExecRequest) (result string, err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					loggerFrom(ctx).Error("Recovered from panic",
+						zap.Any("panic", r),
+						zap.ByteString("stack", debug.Stack()),
+					)
+					result, err = "", internalError(fmt.Errorf("panic in %s: %v", sub.name, r))
+				}
+			}()
+
+			return next(ctx, sender, req)
+		}
+	}
+}
+
+// traced runs the subcommand in its own span, under the span for the Exec call.
+func traced(sub *subcommand) middleware {
+	return func(next subcommandFunc) subcommandFunc {
+		return func(ctx context.Context, sender *Sender, req *proto.ExecRequest) (string, error) {
+			ctx, span := tracing.StartSpan(ctx, "role "+sub.name, tracing.KindInternal)
+			defer span.Finish()
+
+			span.SetAttribute("subcommand", sub.name)
+			span.SetAttribute("request_id", requestID(ctx))
+			span.SetAttribute("user", sender.UserID)
+			span.SetAttribute("channel", sender.ChannelID)
+
+			result, err := next(ctx, sender, req)
+			span.SetAttribute("outcome", outcome(err))
+			span.SetError(err)
+
+			return result, err
+		}
+	}
+}
+
+func logging(d *dispatcher, sub *subcommand) middleware {
+	return func(next subcommandFunc) subcommandFunc {
+		return func(ctx context.Context, sender *Sender, req *proto.ExecRequest) (string, error) {
+			log := loggerFrom(ctx)
+			log.Debug("Running subcommand", zap.Strings("args", d.redactArgs(req.Args)))
+
+			start := time.Now()
+			result, err := next(ctx, sender, req)
+
+			log.Info("Ran subcommand",
+				zap.Duration("duration", time.Since(start)),
+				zap.String("outcome", outcome(err)),
+			)
+
+			return result, err
+		}
+	}
+}
+
+func metrics(sub *subcommand) middleware {
+	return func(next subcommandFunc) subcommandFunc {
+		return func(ctx context.Context, sender *Sender, req *proto.ExecRequest) (string, error) {
+			start := time.Now()
+			result, err := next(ctx, sender, req)
+
+			subcommandInvocations.WithLabelValues(sub.name, outcome(err)).Inc()
+			subcommandDuration.WithLabelValues(sub.name).Observe(time.Since(start).Seconds())
+
+			return result, err
+		}
+	}
+}
+
+func validateArgs(cmdName string, sub *subcommand) middleware {
+	usage := strings.TrimSpace(fmt.Sprintf("Usage: !%s %s %s", cmdName, sub.name, sub.usage))
+
+	return func(next subcommandFunc) subcommandFunc {
+		return func(ctx context.Context, sender *Sender, req *proto.ExecRequest) (string, error) {
+			args := len(req.Args) - 2
+			if args < sub.minArgs || (sub.maxArgs != unlimited && args > sub.maxArgs) {
+				return "", usageError(usage)
+			}
+
+			return next(ctx, sender, req)
+		}
+	}
+}
+
+func requireAdmin(next subcommandFunc) subcommandFunc {
+	return func(ctx context.Context, sender *Sender, req *proto.ExecRequest) (string, error) {
+		if err := requireRoleAdmin(ctx, sender); err != nil {
+			return "", err
+		}
+
+		return next(ctx, sender, req)
+	}
+}
@@ -0,0 +1,98 @@
+package command
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+
+	rolesrv "github.com/chremoas/role-srv/proto"
+	"go.uber.org/zap"
+
+	"github.com/chremoas/role-cmd/settings"
+)
+
+const (
+	// Nick if there is one, otherwise username
+	nameFormatShort = "short"
+	// nick (username#discriminator)
+	nameFormatFull = "full"
+)
+
+// memberRenderer turns member IDs into display names. Every ID it's given shows up in
+// the output, whether or not the user is still in the guild.
+type memberRenderer struct {
+	format         string
+	flagBots       bool
+	flagUnverified bool
+}
+
+func newMemberRenderer(conf settings.Names) *memberRenderer {
+	return &memberRenderer{
+		format:         conf.Format,
+		flagBots:       conf.FlagBots,
+		flagUnverified: conf.FlagUnverified,
+	}
+}
+
+func (r *memberRenderer) name(user *rolesrv.GetDiscordUserResponse) string {
+	tag := user.Username
+	if len(user.Discriminator) != 0 {
+		tag = fmt.Sprintf("%s#%s", user.Username, user.Discriminator)
+	}
+
+	var name string
+	switch {
+	case r.format == nameFormatFull && len(user.Nick) != 0:
+		name = fmt.Sprintf("%s (%s)", user.Nick, tag)
+	case r.format == nameFormatFull:
+		name = tag
+	case len(user.Nick) != 0:
+		name = user.Nick
+	default:
+		name = user.Username
+	}
+
+	var flags []string
+	if r.flagBots && user.Bot {
+		flags = append(flags, "bot")
+	}
+	if r.flagUnverified && !user.Verified {
+		flags = append(flags, "unverified")
+	}
+	if len(flags) != 0 {
+		name = fmt.Sprintf("%s [%s]", name, strings.Join(flags, ", "))
+	}
+
+	return name
+}
+
+// Render writes one line per member ID using the user directory. IDs the directory
+// doesn't know about are users that have left the guild and are marked as such.
+func (r *memberRenderer) Render(ctx context.Context, members []string) (buffer bytes.Buffer, names []string, err error) {
+	users, err := directory.Users(ctx)
+	if err != nil {
+		if users == nil {
+			return buffer, nil, err
+		}
+		loggerFrom(ctx).Warn("Using stale user directory", zap.Error(err), zap.Duration("age", directory.Age()))
+	}
+
+	for m := range members {
+		if len(members[m]) == 0 {
+			continue
+		}
+
+		var name string
+		if user, ok := users[members[m]]; ok {
+			name = r.name(user)
+		} else {
+			name = fmt.Sprintf("%s (left guild)", members[m])
+		}
+
+		buffer.WriteString(fmt.Sprintf("\t%s\n", name))
+		names = append(names, name)
+	}
+
+	return buffer, names, nil
+}
@@ -0,0 +1,223 @@
+package command
+
+// openAPIDocument describes the admin API, served at /api/v1/openapi.json. Keep it in
+// step with the routes in NewAPI.
+const openAPIDocument = `{
+  "openapi": "3.0.3",
+  "info": {
+    "title": "Chremoas role administration API",
+    "description": "Roles, filters and memberships, with the same permission checks as !role. Every request needs the bearer secret and the configured user header holding the caller's Discord user ID.",
+    "version": "1"
+  },
+  "servers": [{"url": "/api/v1"}],
+  "security": [{"user": [], "secret": []}],
+  "paths": {
+    "/roles": {
+      "get": {
+        "summary": "List roles and SIGs",
+        "responses": {
+          "200": {"description": "The roles", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Role"}}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "post": {
+        "summary": "Create a role and sync",
+        "description": "Role admins only. SIGs are created through !sig, so sig and joinable must be false.",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Role"}}}},
+        "responses": {
+          "201": {"description": "The role as created", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Role"}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/roles/{role}": {
+      "parameters": [{"$ref": "#/components/parameters/Role"}],
+      "get": {
+        "summary": "Show a role",
+        "description": "Role admins only.",
+        "responses": {
+          "200": {"description": "The role", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Role"}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "patch": {
+        "summary": "Change a role's Discord settings and sync",
+        "description": "Role admins only. Colors may be given as \"#rrggbb\". Nothing is changed if any key is unknown or any color malformed.",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/RoleChanges"}}}},
+        "responses": {
+          "200": {"description": "The role after the changes", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Role"}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "delete": {
+        "summary": "Delete a role and sync",
+        "description": "Role admins only. SIGs are deleted through !sig and give 404 here, as with !role destroy.",
+        "responses": {
+          "204": {"description": "Deleted"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/roles/{role}/members": {
+      "parameters": [{"$ref": "#/components/parameters/Role"}],
+      "get": {
+        "summary": "List a role's members",
+        "description": "Uses the stricter rate limits.",
+        "responses": {
+          "200": {"description": "The members", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Member"}}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/filters": {
+      "get": {
+        "summary": "List filters",
+        "description": "Role admins only.",
+        "responses": {
+          "200": {"description": "The filters", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Filter"}}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "post": {
+        "summary": "Create a filter",
+        "description": "Role admins only.",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Filter"}}}},
+        "responses": {
+          "201": {"description": "The filter as created", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Filter"}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/filters/{filter}": {
+      "parameters": [{"$ref": "#/components/parameters/Filter"}],
+      "delete": {
+        "summary": "Delete a filter",
+        "description": "Role admins only.",
+        "responses": {
+          "204": {"description": "Deleted"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/filters/{filter}/members": {
+      "parameters": [{"$ref": "#/components/parameters/Filter"}],
+      "get": {
+        "summary": "List a filter's members",
+        "description": "Role admins only.",
+        "responses": {
+          "200": {"description": "The members", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Member"}}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "post": {
+        "summary": "Add members to a filter and sync",
+        "description": "Role admins only.",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Members"}}}},
+        "responses": {
+          "204": {"description": "Added"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "delete": {
+        "summary": "Remove members from a filter and sync",
+        "description": "Role admins only.",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Members"}}}},
+        "responses": {
+          "204": {"description": "Removed"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/sync": {
+      "post": {
+        "summary": "Sync roles and memberships to Discord",
+        "description": "Uses the stricter rate limits.",
+        "responses": {
+          "204": {"description": "Synced"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    }
+  },
+  "components": {
+    "securitySchemes": {
+      "user": {"type": "apiKey", "in": "header", "name": "X-Chremoas-User", "description": "The caller's Discord user ID. The header name is configurable."},
+      "secret": {"type": "http", "scheme": "bearer"}
+    },
+    "parameters": {
+      "Role": {"name": "role", "in": "path", "required": true, "schema": {"type": "string"}, "description": "The role's short name"},
+      "Filter": {"name": "filter", "in": "path", "required": true, "schema": {"type": "string"}}
+    },
+    "responses": {
+      "Error": {
+        "description": "400 usage, 401 no or bad credentials, 403 permission, 404 not found, 429 rate limited, 503 upstream unavailable, 500 internal",
+        "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}
+      }
+    },
+    "schemas": {
+      "Role": {
+        "type": "object",
+        "required": ["shortName", "filterA"],
+        "properties": {
+          "shortName": {"type": "string"},
+          "name": {"type": "string"},
+          "type": {"type": "string", "default": "discord"},
+          "filterA": {"type": "string"},
+          "filterB": {"type": "string", "default": "wildcard"},
+          "sig": {"type": "boolean"},
+          "joinable": {"type": "boolean"},
+          "sync": {"type": "boolean"},
+          "color": {"type": "integer"},
+          "hoist": {"type": "boolean"},
+          "position": {"type": "integer"},
+          "permissions": {"type": "integer"},
+          "managed": {"type": "boolean"},
+          "mentionable": {"type": "boolean"}
+        }
+      },
+      "RoleChanges": {
+        "type": "object",
+        "properties": {
+          "color": {"oneOf": [{"type": "integer"}, {"type": "string"}]},
+          "hoist": {"type": "boolean"},
+          "position": {"type": "integer"},
+          "permissions": {"type": "integer"},
+          "managed": {"type": "boolean"},
+          "mentionable": {"type": "boolean"},
+          "sync": {"type": "boolean"}
+        }
+      },
+      "Filter": {
+        "type": "object",
+        "required": ["name"],
+        "properties": {
+          "name": {"type": "string"},
+          "description": {"type": "string"}
+        }
+      },
+      "Member": {
+        "type": "object",
+        "properties": {
+          "userId": {"type": "string"},
+          "name": {"type": "string"}
+        }
+      },
+      "Members": {
+        "type": "object",
+        "required": ["members"],
+        "properties": {
+          "members": {"type": "array", "items": {"type": "string"}, "description": "Discord user IDs"}
+        }
+      },
+      "Error": {
+        "type": "object",
+        "properties": {
+          "error": {"type": "string", "enum": ["usage", "permission", "not_found", "rate_limited", "upstream_unavailable", "internal"]},
+          "message": {"type": "string"},
+          "requestId": {"type": "string"}
+        }
+      }
+    }
+  }
+}
+`
@@ -0,0 +1,168 @@
+package command
+
+import (
+	"container/list"
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	permsrv "github.com/chremoas/perms-srv/proto"
+	"github.com/micro/go-micro/client"
+
+	"github.com/chremoas/role-cmd/settings"
+)
+
+type permEntry struct {
+	key     string
+	allowed bool
+	expires time.Time
+}
+
+// permissionCache sits in front of perms-srv and remembers Perform results for a short
+// while. Everything other than Perform is passed straight through, and anything that
+// changes who holds a permission flushes the cache.
+type permissionCache struct {
+	permsrv.PermissionsService
+
+	ttl         time.Duration
+	negativeTTL time.Duration
+	maxEntries  int
+
+	mutex   sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	hits    uint64
+	misses  uint64
+}
+
+func newPermissionCache(client permsrv.PermissionsService, conf settings.PermissionCache) *permissionCache {
+	return &permissionCache{
+		PermissionsService: client,
+		ttl:                conf.TTL,
+		negativeTTL:        conf.NegativeTTL,
+		maxEntries:         conf.MaxEntries,
+		entries:            make(map[string]*list.Element),
+		lru:                list.New(),
+	}
+}
+
+func permKey(user string, permissions []string) string {
+	sorted := append([]string(nil), permissions...)
+	sort.Strings(sorted)
+	return user + "|" + strings.Join(sorted, ",")
+}
+
+func (c *permissionCache) Perform(ctx context.Context, in *permsrv.PermissionsRequest, opts ...client.CallOption) (*permsrv.PerformResponse, error) {
+	key := permKey(in.User, in.PermissionsList)
+
+	if allowed, ok := c.get(key); ok {
+		permCacheRequests.WithLabelValues("hit").Inc()
+		return &permsrv.PerformResponse{CanPerform: allowed}, nil
+	}
+	permCacheRequests.WithLabelValues("miss").Inc()
+
+	rsp, err := c.PermissionsService.Perform(ctx, in, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	c.put(key, rsp.CanPerform)
+	return rsp, nil
+}
+
+func (c *permissionCache) AddPermissionUser(ctx context.Context, in *permsrv.PermissionUser, opts ...client.CallOption) (*permsrv.PermissionUser, error) {
+	defer c.Flush()
+	return c.PermissionsService.AddPermissionUser(ctx, in, opts...)
+}
+
+func (c *permissionCache) RemovePermissionUser(ctx context.Context, in *permsrv.PermissionUser, opts ...client.CallOption) (*permsrv.PermissionUser, error) {
+	defer c.Flush()
+	return c.PermissionsService.RemovePermissionUser(ctx, in, opts...)
+}
+
+func (c *permissionCache) RemovePermission(ctx context.Context, in *permsrv.Permission, opts ...client.CallOption) (*permsrv.Permission, error) {
+	defer c.Flush()
+	return c.PermissionsService.RemovePermission(ctx, in, opts...)
+}
+
+func (c *permissionCache) get(key string) (bool, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		c.misses++
+		return false, false
+	}
+
+	entry := element.Value.(*permEntry)
+	if time.Now().After(entry.expires) {
+		c.lru.Remove(element)
+		delete(c.entries, key)
+		c.misses++
+		return false, false
+	}
+
+	c.lru.MoveToFront(element)
+	c.hits++
+	return entry.allowed, true
+}
+
+func (c *permissionCache) put(key string, allowed bool) {
+	ttl := c.ttl
+	if !allowed {
+		ttl = c.negativeTTL
+	}
+
+	if ttl <= 0 || c.maxEntries <= 0 {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		c.lru.Remove(element)
+		delete(c.entries, key)
+	}
+
+	for c.lru.Len() >= c.maxEntries {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*permEntry).key)
+	}
+
+	c.entries[key] = c.lru.PushFront(&permEntry{key: key, allowed: allowed, expires: time.Now().Add(ttl)})
+}
+
+// Flush forgets every cached permission check.
+func (c *permissionCache) Flush() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	flushed := c.lru.Len()
+	c.entries = make(map[string]*list.Element)
+	c.lru.Init()
+
+	return flushed
+}
+
+func (c *permissionCache) Len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.lru.Len()
+}
+
+func (c *permissionCache) hitRatio() float64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.hits+c.misses == 0 {
+		return 0
+	}
+
+	return float64(c.hits) / float64(c.hits+c.misses)
+}
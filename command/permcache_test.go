@@ -0,0 +1,124 @@
+package command
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	permsrv "github.com/chremoas/perms-srv/proto"
+	"github.com/micro/go-micro/client"
+
+	"github.com/chremoas/role-cmd/settings"
+)
+
+// fakePerms answers Perform from allowed and counts the calls that got this far.
+type fakePerms struct {
+	permsrv.PermissionsService
+	allowed map[string]bool
+	calls   int
+}
+
+func (f *fakePerms) Perform(ctx context.Context, in *permsrv.PermissionsRequest, opts ...client.CallOption) (*permsrv.PerformResponse, error) {
+	f.calls++
+	return &permsrv.PerformResponse{CanPerform: f.allowed[in.User]}, nil
+}
+
+func (f *fakePerms) AddPermissionUser(ctx context.Context, in *permsrv.PermissionUser, opts ...client.CallOption) (*permsrv.PermissionUser, error) {
+	f.allowed[in.User] = true
+	return in, nil
+}
+
+func perform(t *testing.T, c *permissionCache, user string, permissions ...string) bool {
+	rsp, err := c.Perform(context.Background(), &permsrv.PermissionsRequest{User: user, PermissionsList: permissions})
+	if err != nil {
+		t.Fatalf("Perform: %s", err)
+	}
+	return rsp.CanPerform
+}
+
+func TestPermissionCache(t *testing.T) {
+	perms := &fakePerms{allowed: map[string]bool{"admin": true}}
+	c := newPermissionCache(perms, settings.PermissionCache{TTL: time.Minute, NegativeTTL: time.Minute, MaxEntries: 10})
+
+	tests := []struct {
+		user        string
+		permissions []string
+		want        bool
+		calls       int
+	}{
+		{"admin", []string{"role_admins", "server_admins"}, true, 1},
+		// Same check, permissions in another order
+		{"admin", []string{"server_admins", "role_admins"}, true, 1},
+		{"pleb", []string{"role_admins"}, false, 2},
+		{"pleb", []string{"role_admins"}, false, 2},
+		{"admin", []string{"role_admins"}, true, 3},
+	}
+
+	for i, test := range tests {
+		if got := perform(t, c, test.user, test.permissions...); got != test.want {
+			t.Errorf("check %d: %s %v = %t, want %t", i+1, test.user, test.permissions, got, test.want)
+		}
+		if perms.calls != test.calls {
+			t.Errorf("check %d: perms-srv called %d times, want %d", i+1, perms.calls, test.calls)
+		}
+	}
+
+	if c.Len() != 3 {
+		t.Errorf("Len() = %d, want 3", c.Len())
+	}
+	if ratio := c.hitRatio(); ratio != 2.0/5.0 {
+		t.Errorf("hitRatio() = %f, want 0.4", ratio)
+	}
+
+	// Granting a permission has to be seen straight away
+	if _, err := c.AddPermissionUser(context.Background(), &permsrv.PermissionUser{User: "pleb", Permission: "role_admins"}); err != nil {
+		t.Fatal(err)
+	}
+	if c.Len() != 0 {
+		t.Errorf("Len() = %d after a change, want 0", c.Len())
+	}
+	if !perform(t, c, "pleb", "role_admins") {
+		t.Error("stale denial served after the user was given the permission")
+	}
+}
+
+func TestPermissionCacheLimits(t *testing.T) {
+	perms := &fakePerms{allowed: map[string]bool{"a": true, "b": true, "c": true}}
+	c := newPermissionCache(perms, settings.PermissionCache{TTL: time.Minute, NegativeTTL: 0, MaxEntries: 2})
+
+	perform(t, c, "a", "p")
+	perform(t, c, "b", "p")
+	perform(t, c, "a", "p") // a is now the most recently used
+	perform(t, c, "c", "p") // so b is the one evicted
+
+	calls := perms.calls
+	perform(t, c, "a", "p")
+	if perms.calls != calls {
+		t.Error("most recently used entry was evicted")
+	}
+	perform(t, c, "b", "p")
+	if perms.calls != calls+1 {
+		t.Error("least recently used entry wasn't evicted")
+	}
+
+	// No negative TTL, no negative caching
+	perform(t, c, "nobody", "p")
+	perform(t, c, "nobody", "p")
+	if perms.calls != calls+3 {
+		t.Errorf("denials were cached with a zero negative TTL")
+	}
+}
+
+func TestPermissionCacheExpiry(t *testing.T) {
+	perms := &fakePerms{allowed: map[string]bool{"a": true}}
+	c := newPermissionCache(perms, settings.PermissionCache{TTL: 20 * time.Millisecond, MaxEntries: 10})
+
+	perform(t, c, "a", "p")
+	perform(t, c, "a", "p")
+	time.Sleep(30 * time.Millisecond)
+	perform(t, c, "a", "p")
+
+	if perms.calls != 2 {
+		t.Errorf("perms-srv called %d times, want 2", perms.calls)
+	}
+}
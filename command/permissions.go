@@ -0,0 +1,85 @@
+package command
+
+import (
+	"context"
+	"fmt"
+
+	permsrv "github.com/chremoas/perms-srv/proto"
+	"github.com/chremoas/services-common/sets"
+	"go.uber.org/zap"
+)
+
+const roleAdmins = "role_admins"
+
+// Every permission the role command checks. perms-srv denies anything it doesn't know
+// about, so these have to exist before anyone can administrate roles.
+var requiredPermissions = []*permsrv.Permission{
+	{Name: roleAdmins, Description: "Role Admins"},
+}
+
+// BootstrapPermissions creates any required permissions that perms-srv doesn't have yet.
+// The admins are only seeded into permissions created here so that anyone removed
+// from a permission later doesn't get added back on the next restart.
+func BootstrapPermissions(ctx context.Context, client permsrv.PermissionsService, admins []string, log *zap.Logger) error {
+	perms, err := client.ListPermissions(ctx, &permsrv.NilRequest{})
+	if err != nil {
+		return fmt.Errorf("unable to list permissions: %v", err)
+	}
+
+	existing := sets.NewStringSet()
+	for p := range perms.PermissionsList {
+		existing.Add(perms.PermissionsList[p].Name)
+	}
+
+	for _, perm := range requiredPermissions {
+		if existing.Contains(perm.Name) {
+			continue
+		}
+
+		_, err = client.AddPermission(ctx, perm)
+		if err != nil {
+			return fmt.Errorf("unable to create permission %s: %v", perm.Name, err)
+		}
+		log.Info("Created missing permission",
+			zap.String("permission", perm.Name),
+			zap.String("description", perm.Description),
+		)
+
+		for _, admin := range admins {
+			_, err = client.AddPermissionUser(ctx, &permsrv.PermissionUser{User: admin, Permission: perm.Name})
+			if err != nil {
+				return fmt.Errorf("unable to add %s to %s: %v", admin, perm.Name, err)
+			}
+			log.Info("Seeded admin", zap.String("permission", perm.Name), zap.String("user", admin))
+		}
+	}
+
+	return nil
+}
+
+// isRoleAdmin checks whether the sender holds the role admin permission.
+func isRoleAdmin(ctx context.Context, sender *Sender) (bool, error) {
+	rsp, err := permCache.Perform(ctx, &permsrv.PermissionsRequest{
+		User:            sender.UserID,
+		PermissionsList: []string{roleAdmins},
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return rsp.CanPerform, nil
+}
+
+// requireRoleAdmin is isRoleAdmin for subcommands that are admin only.
+func requireRoleAdmin(ctx context.Context, sender *Sender) error {
+	canPerform, err := isRoleAdmin(ctx, sender)
+	if err != nil {
+		return upstreamError(err)
+	}
+
+	if !canPerform {
+		return permissionError()
+	}
+
+	return nil
+}
@@ -0,0 +1,483 @@
+package command
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	proto "github.com/chremoas/chremoas/proto"
+	rolesrv "github.com/chremoas/role-srv/proto"
+	common "github.com/chremoas/services-common/command"
+	"github.com/micro/go-micro/client"
+	"go.uber.org/zap"
+
+	"github.com/chremoas/role-cmd/settings"
+	"github.com/chremoas/role-cmd/store"
+)
+
+// prerequisites are the roles a user has to hold before they can be given another, e.g.
+// a base role for the capital pilots SIG. They're kept by role.
+type prerequisites struct {
+	requires   *store.Collection
+	maxRemoval float64
+}
+
+func newPrerequisites(file *store.File, conf settings.Prerequisites) (*prerequisites, error) {
+	requires, err := store.NewCollection(file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load prerequisites from %s: %s", file.Path(), err)
+	}
+
+	return &prerequisites{requires: requires, maxRemoval: conf.MaxRemoval}, nil
+}
+
+// removable reports whether a sweep may take that many of a role's members out at once.
+// Like dynamicFilters.checkRemoval it holds back when a new prerequisite, or role-srv
+// answering with less than it should have, would empty a role in one go.
+func (p *prerequisites) removable(remove, members int) bool {
+	return remove <= alwaysRemovable || float64(remove) <= p.maxRemoval*float64(members)
+}
+
+// requiresGraph is every role with prerequisites and the roles it requires directly.
+type requiresGraph map[string][]string
+
+// graphOf reads the graph out of the collection, or out of a change being made to it.
+func graphOf(requires interface {
+	Keys() []string
+	Get(key string, v interface{}) bool
+}) requiresGraph {
+	g := make(requiresGraph)
+	for _, role := range requires.Keys() {
+		var r []string
+		if requires.Get(role, &r) {
+			g[role] = r
+		}
+	}
+
+	return g
+}
+
+// reaches reports whether role requires target, directly or through other prerequisites.
+func (g requiresGraph) reaches(role, target string) bool {
+	seen := make(map[string]bool)
+	pending := []string{role}
+	for len(pending) != 0 {
+		r := pending[0]
+		pending = pending[1:]
+		if r == target {
+			return true
+		}
+		if seen[r] {
+			continue
+		}
+		seen[r] = true
+		pending = append(pending, g[r]...)
+	}
+
+	return false
+}
+
+func (p *prerequisites) add(role, prerequisite string) error {
+	err := p.requires.Update(func(tx *store.Tx) error {
+		g := graphOf(tx)
+		if containsString(g[role], prerequisite) {
+			return usageError(fmt.Sprintf("%s already requires %s", role, prerequisite))
+		}
+		if g.reaches(prerequisite, role) {
+			return usageError(fmt.Sprintf("%s can't require %s, %s already requires %s", role, prerequisite, prerequisite, role))
+		}
+
+		requires := append(g[role], prerequisite)
+		sort.Strings(requires)
+		return tx.Put(role, requires)
+	})
+
+	return storeError(err)
+}
+
+func (p *prerequisites) remove(role, prerequisite string) error {
+	err := p.requires.Update(func(tx *store.Tx) error {
+		var previous []string
+		tx.Get(role, &previous)
+		if !containsString(previous, prerequisite) {
+			return notFoundError("%s doesn't require %s", role, prerequisite)
+		}
+
+		var remaining []string
+		for _, r := range previous {
+			if r != prerequisite {
+				remaining = append(remaining, r)
+			}
+		}
+		if len(remaining) == 0 {
+			tx.Delete(role)
+			return nil
+		}
+		return tx.Put(role, remaining)
+	})
+
+	return storeError(err)
+}
+
+// of returns the roles the role requires directly.
+func (p *prerequisites) of(role string) []string {
+	var requires []string
+	p.requires.Get(role, &requires)
+
+	return requires
+}
+
+// dependents returns the roles that require the role directly.
+func (p *prerequisites) dependents(role string) []string {
+	var dependents []string
+	for r, requires := range graphOf(p.requires) {
+		if containsString(requires, role) {
+			dependents = append(dependents, r)
+		}
+	}
+	sort.Strings(dependents)
+
+	return dependents
+}
+
+func (p *prerequisites) empty() bool {
+	return p.requires.Len() == 0
+}
+
+// heldRoles returns the short names of the roles the user holds.
+func heldRoles(ctx context.Context, roles rolesrv.RolesService, userID string) (map[string]bool, error) {
+	rsp, err := roles.ListUserRoles(ctx, &rolesrv.ListUserRolesRequest{UserId: userID})
+	if err != nil {
+		return nil, err
+	}
+
+	held := make(map[string]bool)
+	for _, r := range rsp.Roles {
+		held[r.ShortName] = true
+	}
+
+	return held, nil
+}
+
+// missingPrerequisites returns the roles the user would need before being given the role.
+func missingPrerequisites(ctx context.Context, roles rolesrv.RolesService, userID, role string) ([]string, error) {
+	requires := requirements.of(role)
+	if len(requires) == 0 {
+		return nil, nil
+	}
+
+	held, err := heldRoles(ctx, roles, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var missing []string
+	for _, r := range requires {
+		if !held[r] {
+			missing = append(missing, r)
+		}
+	}
+
+	return missing, nil
+}
+
+// prerequisiteEnforcer refuses to add users to a role they don't hold the prerequisites
+// of, and takes users out of the roles that depend on one they've been removed from.
+// Like groupEnforcer it only sees changes made through role-cmd, prerequisites.sweep
+// catches up with the rest.
+type prerequisiteEnforcer struct {
+	rolesrv.RolesService
+}
+
+// rolesFor returns the roles whose members are kept in the filter.
+func (p prerequisiteEnforcer) rolesFor(ctx context.Context, filter string) ([]*rolesrv.Role, error) {
+	roles, err := p.RolesService.GetRoles(ctx, &rolesrv.NilMessage{})
+	if err != nil {
+		return nil, err
+	}
+
+	var matched []*rolesrv.Role
+	for _, r := range roles.Roles {
+		if memberFilter(r) == filter {
+			matched = append(matched, r)
+		}
+	}
+
+	return matched, nil
+}
+
+func (p prerequisiteEnforcer) AddMembers(ctx context.Context, in *rolesrv.Members, opts ...client.CallOption) (*rolesrv.NilMessage, error) {
+	if !requirements.empty() {
+		roles, err := p.rolesFor(ctx, in.Filter)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, r := range roles {
+			for _, userID := range in.Name {
+				missing, err := missingPrerequisites(ctx, p.RolesService, userID, r.ShortName)
+				if err != nil {
+					return nil, err
+				}
+				if len(missing) != 0 {
+					name := userID
+					if _, names, err := renderer.Render(ctx, []string{userID}); err == nil {
+						name = names[0]
+					}
+					return nil, usageError(fmt.Sprintf("%s needs %s before they can have %s",
+						name, strings.Join(missing, ", "), r.ShortName))
+				}
+			}
+		}
+	}
+
+	return p.RolesService.AddMembers(ctx, in, opts...)
+}
+
+func (p prerequisiteEnforcer) RemoveMembers(ctx context.Context, in *rolesrv.Members, opts ...client.CallOption) (*rolesrv.NilMessage, error) {
+	rsp, err := p.RolesService.RemoveMembers(ctx, in, opts...)
+	if err == nil && !requirements.empty() {
+		p.cascade(ctx, in)
+	}
+
+	return rsp, err
+}
+
+// cascade takes the users out of every role they no longer hold the prerequisites of.
+// Removing them goes back through RemoveMembers, so it carries on down the graph.
+func (p prerequisiteEnforcer) cascade(ctx context.Context, in *rolesrv.Members) {
+	log := loggerFrom(ctx)
+
+	roles, err := p.rolesFor(ctx, in.Filter)
+	if err != nil {
+		log.Warn("Unable to look roles up for prerequisites", zap.Error(err))
+		return
+	}
+
+	for _, r := range roles {
+		for _, dependent := range requirements.dependents(r.ShortName) {
+			d, err := p.RolesService.GetRole(ctx, &rolesrv.Role{ShortName: dependent})
+			if err != nil {
+				log.Warn("Unable to look up dependent role", zap.String("role", dependent), zap.Error(err))
+				continue
+			}
+
+			for _, userID := range in.Name {
+				held, err := heldRoles(ctx, p.RolesService, userID)
+				if err != nil {
+					log.Warn("Unable to look up user roles", zap.String("user", userID), zap.Error(err))
+					continue
+				}
+				if !held[dependent] || held[r.ShortName] {
+					continue
+				}
+
+				_, err = p.RemoveMembers(ctx, &rolesrv.Members{Name: []string{userID}, Filter: memberFilter(d)})
+				if err != nil {
+					log.Warn("Unable to remove user from dependent role",
+						zap.String("user", userID), zap.String("role", dependent), zap.Error(err))
+					continue
+				}
+
+				log.Info("Removed user from dependent role",
+					zap.String("user", userID), zap.String("role", dependent), zap.String("prerequisite", r.ShortName))
+			}
+		}
+	}
+}
+
+// lacking returns the members of the role who don't hold all of its prerequisites, with
+// what each of them is missing, and how many members the role has.
+func (p *prerequisites) lacking(ctx context.Context, r *rolesrv.Role) (map[string][]string, int, error) {
+	members, err := memberSet(ctx, role.RoleClient, memberFilter(r))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	lacking := make(map[string][]string)
+	for userID := range members {
+		missing, err := missingPrerequisites(ctx, role.RoleClient, userID, r.ShortName)
+		if err != nil {
+			return nil, 0, err
+		}
+		if len(missing) != 0 {
+			lacking[userID] = missing
+		}
+	}
+
+	return lacking, len(members), nil
+}
+
+// sweep takes members out of every role they don't hold the prerequisites of. It catches
+// up with changes role-cmd doesn't see, since sig-cmd goes straight to role-srv: joining
+// a SIG without its prerequisites, or leaving one another role depends on. A role that
+// would lose more than maxRemoval of its members is left alone and logged.
+func (p *prerequisites) sweep(ctx context.Context) {
+	log := loggerFrom(ctx)
+
+	removed := false
+	for _, name := range p.requires.Keys() {
+		r, err := role.RoleClient.GetRole(ctx, &rolesrv.Role{ShortName: name})
+		if err != nil {
+			log.Warn("Unable to look up role with prerequisites", zap.String("role", name), zap.Error(err))
+			continue
+		}
+
+		lacking, members, err := p.lacking(ctx, r)
+		if err != nil {
+			log.Warn("Unable to look up role members missing prerequisites", zap.String("role", name), zap.Error(err))
+			continue
+		}
+		if len(lacking) == 0 {
+			continue
+		}
+		if !p.removable(len(lacking), members) {
+			log.Warn("Not removing members missing prerequisites, too many at once",
+				zap.String("role", name), zap.Int("missing", len(lacking)), zap.Int("members", members))
+			continue
+		}
+
+		var userIDs []string
+		for userID := range lacking {
+			userIDs = append(userIDs, userID)
+		}
+		sort.Strings(userIDs)
+
+		for _, userID := range userIDs {
+			// Through the whole role client, so it cascades to whatever depends on this role
+			_, err = role.RoleClient.RemoveMembers(ctx, &rolesrv.Members{Name: []string{userID}, Filter: memberFilter(r)})
+			if err != nil {
+				log.Warn("Unable to remove user missing prerequisites",
+					zap.String("user", userID), zap.String("role", name), zap.Error(err))
+				continue
+			}
+
+			removed = true
+			log.Info("Removed user missing prerequisites",
+				zap.String("user", userID), zap.String("role", name), zap.Strings("missing", lacking[userID]))
+		}
+	}
+
+	if removed {
+		if err := syncAfterChange(ctx, senderFrom(ctx)); err != nil {
+			log.Warn("Unable to sync after sweeping prerequisites", zap.Error(err))
+		}
+	}
+}
+
+const depsUsage = "Usage: !role deps <role_name> [add|remove <role_name>]"
+
+func roleDeps(ctx context.Context, sender *Sender, req *proto.ExecRequest) (string, error) {
+	if len(req.Args) == 3 {
+		return showDeps(ctx, sender, req)
+	}
+	if len(req.Args) != 5 {
+		return "", usageError(depsUsage)
+	}
+
+	if err := requireRoleAdmin(ctx, sender); err != nil {
+		return "", err
+	}
+
+	roleName, prerequisite := req.Args[2], req.Args[4]
+	switch req.Args[3] {
+	case "add":
+		r, err := role.RoleClient.GetRole(ctx, &rolesrv.Role{ShortName: roleName})
+		if err != nil {
+			return "", upstreamError(err)
+		}
+		if _, err = role.RoleClient.GetRole(ctx, &rolesrv.Role{ShortName: prerequisite}); err != nil {
+			return "", upstreamError(err)
+		}
+		if err = requirements.add(roleName, prerequisite); err != nil {
+			return "", err
+		}
+		return common.SendSuccess(prerequisiteAdded(ctx, r, prerequisite)), nil
+	case "remove":
+		if err := requirements.remove(roleName, prerequisite); err != nil {
+			return "", err
+		}
+		return common.SendSuccess(fmt.Sprintf("%s no longer requires %s", roleName, prerequisite)), nil
+	default:
+		return "", usageError(depsUsage)
+	}
+}
+
+// prerequisiteAdded says what the next sweep will do to the role's current members now
+// that it requires prerequisite.
+func prerequisiteAdded(ctx context.Context, r *rolesrv.Role, prerequisite string) string {
+	added := fmt.Sprintf("%s now requires %s", r.ShortName, prerequisite)
+
+	lacking, members, err := requirements.lacking(ctx, r)
+	switch {
+	case err != nil:
+		loggerFrom(ctx).Warn("Unable to look up role members missing prerequisites", zap.String("role", r.ShortName), zap.Error(err))
+		return added + ", but its members couldn't be checked. Any of them missing it are removed at the next sweep"
+	case len(lacking) == 0:
+		return added
+	case requirements.removable(len(lacking), members):
+		return added + fmt.Sprintf(". %d of its %d members don't meet its prerequisites and will be removed within %s",
+			len(lacking), members, formatDuration(prerequisiteInterval))
+	default:
+		return added + fmt.Sprintf(". %d of its %d members don't meet its prerequisites, more than the %.0f%% the sweep removes at once, "+
+			"so nobody is removed until they're sorted out by hand or !role deps %s remove %s",
+			len(lacking), members, requirements.maxRemoval*100, r.ShortName, prerequisite)
+	}
+}
+
+func showDeps(ctx context.Context, sender *Sender, req *proto.ExecRequest) (string, error) {
+	table, err := roleDepsTable(ctx, sender, req)
+	if err != nil {
+		return "", err
+	}
+
+	if len(table.Rows) == 0 {
+		return fmt.Sprintf("```%s has no prerequisites or dependent roles```\n", req.Args[2]), nil
+	}
+
+	titles := map[string]string{
+		"requires":    fmt.Sprintf("%s requires:\n", req.Args[2]),
+		"required_by": fmt.Sprintf("%s is required by:\n", req.Args[2]),
+	}
+
+	var buffer bytes.Buffer
+	relation := ""
+	for _, row := range table.Rows {
+		if row[0] != relation {
+			relation = row[0]
+			buffer.WriteString(titles[relation])
+		}
+		depth, _ := strconv.Atoi(row[2])
+		buffer.WriteString(fmt.Sprintf("\t%s%s\n", strings.Repeat("  ", depth-1), row[1]))
+	}
+
+	return fmt.Sprintf("```%s```\n", buffer.String()), nil
+}
+
+// roleDepsTable walks the graph both ways from the role. Depth 1 is a direct
+// prerequisite or dependent, and rows are in depth first order so they read as a tree.
+func roleDepsTable(ctx context.Context, sender *Sender, req *proto.ExecRequest) (*Table, error) {
+	table := &Table{Columns: []string{"relation", "role", "depth"}}
+
+	var walk func(relation, name string, depth int, next func(string) []string, path map[string]bool)
+	walk = func(relation, name string, depth int, next func(string) []string, path map[string]bool) {
+		for _, r := range next(name) {
+			if path[r] {
+				continue
+			}
+			table.Rows = append(table.Rows, []string{relation, r, strconv.Itoa(depth)})
+			path[r] = true
+			walk(relation, r, depth+1, next, path)
+			delete(path, r)
+		}
+	}
+
+	roleName := req.Args[2]
+	walk("requires", roleName, 1, requirements.of, map[string]bool{roleName: true})
+	walk("required_by", roleName, 1, requirements.dependents, map[string]bool{roleName: true})
+
+	return table, nil
+}
@@ -0,0 +1,128 @@
+package command
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	rolesrv "github.com/chremoas/role-srv/proto"
+)
+
+func TestRequiresGraphReaches(t *testing.T) {
+	g := requiresGraph{
+		"capitals":  {"pilots"},
+		"titans":    {"capitals", "veterans"},
+		"pilots":    {"members"},
+		"veterans":  {"members"},
+		"loop-a":    {"loop-b"},
+		"loop-b":    {"loop-a"},
+		"unrelated": {"other"},
+	}
+
+	tests := []struct {
+		role, target string
+		want         bool
+	}{
+		{"capitals", "pilots", true},
+		{"titans", "members", true},
+		{"titans", "veterans", true},
+		{"members", "titans", false},
+		{"pilots", "capitals", false},
+		{"capitals", "capitals", true},
+		{"unrelated", "members", false},
+		{"nothing", "members", false},
+		// A cycle that got in somehow mustn't hang it
+		{"loop-a", "members", false},
+		{"loop-a", "loop-b", true},
+	}
+
+	for _, test := range tests {
+		if got := g.reaches(test.role, test.target); got != test.want {
+			t.Errorf("reaches(%s, %s) = %t, want %t", test.role, test.target, got, test.want)
+		}
+	}
+}
+
+func TestPrerequisites(t *testing.T) {
+	tc, cleanup := newTestCommand(t)
+	defer cleanup()
+
+	tc.roles.role(&rolesrv.Role{ShortName: "pilots", FilterA: "pilots"}, "2001")
+	tc.roles.role(&rolesrv.Role{ShortName: "capitals", FilterA: "capitals"})
+	tc.roles.role(&rolesrv.Role{ShortName: "titans", FilterA: "titans"})
+	tc.mustRun(t, testAdmin, "deps", "capitals", "add", "pilots")
+	tc.mustRun(t, testAdmin, "deps", "titans", "add", "capitals")
+
+	if _, reported := tc.run(testAdmin, "deps", "pilots", "add", "titans"); !strings.HasPrefix(reported, string(errUsage)) {
+		t.Errorf("a cycle was %q, want refused", reported)
+	}
+
+	ctx := context.Background()
+	if _, err := role.RoleClient.AddMembers(ctx, &rolesrv.Members{Name: []string{"2002"}, Filter: "capitals"}); err == nil {
+		t.Error("2002 was given capitals without pilots")
+	}
+	for _, filter := range []string{"capitals", "titans"} {
+		if _, err := role.RoleClient.AddMembers(ctx, &rolesrv.Members{Name: []string{"2001"}, Filter: filter}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Losing pilots takes them out of capitals, and so out of titans
+	if _, err := role.RoleClient.RemoveMembers(ctx, &rolesrv.Members{Name: []string{"2001"}, Filter: "pilots"}); err != nil {
+		t.Fatal(err)
+	}
+	if tc.roles.filters["capitals"]["2001"] || tc.roles.filters["titans"]["2001"] {
+		t.Errorf("2001 kept roles depending on pilots: capitals %v, titans %v", tc.roles.members("capitals"), tc.roles.members("titans"))
+	}
+}
+
+func TestPrerequisiteSweep(t *testing.T) {
+	tc, cleanup := newTestCommand(t)
+	defer cleanup()
+
+	tc.roles.role(&rolesrv.Role{ShortName: "pilots", FilterA: "pilots"}, "2001")
+	tc.roles.role(&rolesrv.Role{ShortName: "capitals", FilterA: "capitals"}, "2001", "2002", "2003")
+
+	// The reply says who the next sweep takes out
+	result := tc.mustRun(t, testAdmin, "deps", "capitals", "add", "pilots")
+	if !strings.Contains(result, "2 of its 3 members") || !strings.Contains(result, "will be removed") {
+		t.Errorf("deps add = %q, want it to say 2 of 3 members will be removed", result)
+	}
+	if len(tc.roles.members("capitals")) != 3 {
+		t.Fatal("adding a prerequisite removed members straight away")
+	}
+
+	syncs := tc.roles.syncs
+	requirements.sweep(backgroundContext(context.Background(), "prerequisite_sweeper"))
+
+	if got := tc.roles.members("capitals"); len(got) != 1 || got[0] != "2001" {
+		t.Errorf("capitals after the sweep = %v, want only 2001", got)
+	}
+	if tc.roles.syncs != syncs+1 {
+		t.Errorf("sweep synced %d times, want once", tc.roles.syncs-syncs)
+	}
+}
+
+func TestPrerequisiteSweepLimit(t *testing.T) {
+	tc, cleanup := newTestCommand(t)
+	defer cleanup()
+
+	var members []string
+	for i := 0; i < 10; i++ {
+		members = append(members, fmt.Sprintf("20%02d", i))
+	}
+	tc.roles.role(&rolesrv.Role{ShortName: "pilots", FilterA: "pilots"}, members[:2]...)
+	tc.roles.role(&rolesrv.Role{ShortName: "capitals", FilterA: "capitals"}, members...)
+
+	// 8 of 10 is more than the quarter allowed, and more than a handful
+	result := tc.mustRun(t, testAdmin, "deps", "capitals", "add", "pilots")
+	if !strings.Contains(result, "8 of its 10 members") || !strings.Contains(result, "nobody is removed") {
+		t.Errorf("deps add = %q, want it to say the 8 members aren't removed", result)
+	}
+
+	requirements.sweep(backgroundContext(context.Background(), "prerequisite_sweeper"))
+	if got := tc.roles.members("capitals"); len(got) != 10 {
+		t.Errorf("capitals after the sweep = %v, want all 10 members kept", got)
+	}
+}
@@ -0,0 +1,163 @@
+package command
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	proto "github.com/chremoas/chremoas/proto"
+
+	"github.com/chremoas/role-cmd/settings"
+)
+
+// bucket is a token bucket that refills continuously at rate tokens per second.
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// limiter keeps one token bucket per key. Buckets that have refilled completely are
+// the same as no bucket at all, so they're dropped to keep the map from growing forever.
+type limiter struct {
+	rate  float64
+	burst float64
+
+	mutex     sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+func newLimiter(limit settings.Limit) *limiter {
+	if limit.Burst <= 0 || limit.Per <= 0 {
+		return nil
+	}
+
+	return &limiter{
+		rate:    float64(limit.Burst) / limit.Per.Seconds(),
+		burst:   float64(limit.Burst),
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// refill must be called with the mutex held. It returns the key's bucket as it is now.
+func (l *limiter) refill(key string, now time.Time) *bucket {
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, updated: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.updated).Seconds()*l.rate)
+	b.updated = now
+
+	return b
+}
+
+// A claim is a token wanted from a limiter.
+type claim struct {
+	limiter *limiter
+	key     string
+}
+
+// takeEach uses up a token for every claim, or for none of them if any would be refused,
+// in which case it says how long until they can all be met. Limiters are locked in the
+// order given, so callers must always give them in the same order.
+func takeEach(now time.Time, claims ...claim) (bool, time.Duration) {
+	buckets := make([]*bucket, len(claims))
+	var wait time.Duration
+	for i, c := range claims {
+		c.limiter.mutex.Lock()
+		defer c.limiter.mutex.Unlock()
+
+		buckets[i] = c.limiter.refill(c.key, now)
+		if buckets[i].tokens < 1 {
+			if w := time.Duration((1 - buckets[i].tokens) / c.limiter.rate * float64(time.Second)); w > wait {
+				wait = w
+			}
+		}
+	}
+	if wait > 0 {
+		return false, wait
+	}
+
+	for i, c := range claims {
+		buckets[i].tokens--
+		c.limiter.sweep(now)
+	}
+	return true, 0
+}
+
+func (l *limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.updated).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// rateLimits holds the limiters for one class of subcommand.
+type rateLimits struct {
+	user    *limiter
+	channel *limiter
+}
+
+var (
+	defaultLimits   rateLimits
+	expensiveLimits rateLimits
+)
+
+func configureRateLimits(conf settings.RateLimits) {
+	defaultLimits = rateLimits{user: newLimiter(conf.User), channel: newLimiter(conf.Channel)}
+	expensiveLimits = rateLimits{user: newLimiter(conf.ExpensiveUser), channel: newLimiter(conf.ExpensiveChannel)}
+}
+
+func rateLimitError(wait time.Duration) error {
+	seconds := int(math.Ceil(wait.Seconds()))
+	return &commandError{kind: errRateLimited, message: fmt.Sprintf("Slow down, try again in %ds", seconds)}
+}
+
+// rateLimit limits how often each user, and each channel, can run the subcommand.
+// Expensive subcommands (the ones that hit Discord through a sync) share a stricter
+// set of limits. Role admins aren't limited at all.
+func rateLimit(sub *subcommand) middleware {
+	return func(next subcommandFunc) subcommandFunc {
+		return func(ctx context.Context, sender *Sender, req *proto.ExecRequest) (string, error) {
+			limits := defaultLimits
+			if sub.expensive {
+				limits = expensiveLimits
+			}
+
+			if limits.user == nil && limits.channel == nil {
+				return next(ctx, sender, req)
+			}
+
+			// A perms-srv failure shouldn't stop anyone, they just don't get the bypass
+			if admin, err := isRoleAdmin(ctx, sender); err == nil && admin {
+				return next(ctx, sender, req)
+			}
+
+			// Both are checked before either is used up, so being refused by the channel
+			// limit doesn't cost the user a token as well
+			var claims []claim
+			if limits.user != nil {
+				claims = append(claims, claim{limits.user, sender.UserID})
+			}
+			// API requests don't come from a channel anyone could flood
+			if limits.channel != nil && sender.Platform != apiPlatform {
+				claims = append(claims, claim{limits.channel, sender.ChannelID})
+			}
+			if ok, wait := takeEach(time.Now(), claims...); !ok {
+				return "", rateLimitError(wait)
+			}
+
+			return next(ctx, sender, req)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package command
+
+import (
+	"testing"
+	"time"
+
+	"github.com/chremoas/role-cmd/settings"
+)
+
+func TestLimiterRefills(t *testing.T) {
+	l := newLimiter(settings.Limit{Burst: 2, Per: 2 * time.Second})
+	now := time.Now()
+
+	for i, want := range []bool{true, true, false} {
+		if ok, _ := takeEach(now, claim{l, "user"}); ok != want {
+			t.Fatalf("take %d = %t, want %t", i+1, ok, want)
+		}
+	}
+
+	// Someone else has their own bucket
+	if ok, _ := takeEach(now, claim{l, "other"}); !ok {
+		t.Fatal("a different key was limited")
+	}
+
+	ok, wait := takeEach(now, claim{l, "user"})
+	if ok || wait <= 0 || wait > time.Second {
+		t.Fatalf("empty bucket = %t, wait %s; want refused with a wait of up to 1s", ok, wait)
+	}
+
+	if ok, _ = takeEach(now.Add(wait), claim{l, "user"}); !ok {
+		t.Fatal("still refused after waiting as told")
+	}
+}
+
+func TestLimiterDisabled(t *testing.T) {
+	for _, limit := range []settings.Limit{{Burst: 0, Per: time.Second}, {Burst: 1, Per: 0}} {
+		if l := newLimiter(limit); l != nil {
+			t.Errorf("newLimiter(%+v) = %+v, want nil", limit, l)
+		}
+	}
+}
+
+func TestTakeEachIsAllOrNothing(t *testing.T) {
+	user := newLimiter(settings.Limit{Burst: 2, Per: time.Minute})
+	channel := newLimiter(settings.Limit{Burst: 1, Per: time.Minute})
+	now := time.Now()
+
+	if ok, _ := takeEach(now, claim{user, "u"}, claim{channel, "c"}); !ok {
+		t.Fatal("first command refused")
+	}
+
+	// The channel is out, so the user mustn't be charged for being refused
+	if ok, _ := takeEach(now, claim{user, "u"}, claim{channel, "c"}); ok {
+		t.Fatal("second command in the channel allowed")
+	}
+	if ok, _ := takeEach(now, claim{user, "u"}, claim{channel, "elsewhere"}); !ok {
+		t.Fatal("user was charged a token for a command the channel limit refused")
+	}
+	if ok, _ := takeEach(now, claim{user, "u"}, claim{channel, "another"}); ok {
+		t.Fatal("user allowed more than their burst")
+	}
+}
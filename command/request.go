@@ -0,0 +1,53 @@
+package command
+
+import (
+	"context"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+type requestIDKey struct{}
+
+// Every Exec gets a request ID so its log lines can be tied to what the user was told.
+func newRequestID() string {
+	return uuid.New().String()
+}
+
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+func requestID(ctx context.Context) string {
+	if id, ok := ctx.Value(requestIDKey{}).(string); ok {
+		return id
+	}
+	return ""
+}
+
+type loggerKey struct{}
+
+func withLogger(ctx context.Context, log *zap.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, log)
+}
+
+// loggerFrom returns the logger for the request ctx belongs to, which already carries
+// the request ID, sender and subcommand. Outside of a request it's the service logger.
+func loggerFrom(ctx context.Context) *zap.Logger {
+	if log, ok := ctx.Value(loggerKey{}).(*zap.Logger); ok {
+		return log
+	}
+	return logger
+}
+
+type senderKey struct{}
+
+func withSender(ctx context.Context, sender *Sender) context.Context {
+	return context.WithValue(ctx, senderKey{}, sender)
+}
+
+// senderFrom returns whoever the request ctx belongs to was sent by, if anyone.
+func senderFrom(ctx context.Context) *Sender {
+	sender, _ := ctx.Value(senderKey{}).(*Sender)
+	return sender
+}
@@ -0,0 +1,294 @@
+package command
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	proto "github.com/chremoas/chremoas/proto"
+	rolesrv "github.com/chremoas/role-srv/proto"
+	common "github.com/chremoas/services-common/command"
+	"go.uber.org/zap"
+
+	"github.com/chremoas/role-cmd/events"
+	"github.com/chremoas/role-cmd/settings"
+	"github.com/chremoas/role-cmd/store"
+)
+
+// A joinRequest is someone asking to join a SIG that isn't joinable, waiting for a role
+// admin to approve or deny it.
+type joinRequest struct {
+	ID        string    `json:"id"`
+	UserID    string    `json:"userId"`
+	Role      string    `json:"role"`
+	Reason    string    `json:"reason,omitempty"`
+	Requested time.Time `json:"requested"`
+	Expires   time.Time `json:"expires"`
+}
+
+func (r *joinRequest) event(ctx context.Context, eventType, note string) *events.JoinRequest {
+	return &events.JoinRequest{
+		Header:  eventHeader(ctx, eventType),
+		Request: r.ID,
+		Role:    r.Role,
+		UserID:  r.UserID,
+		Reason:  r.Reason,
+		Expires: r.Expires,
+		Note:    note,
+	}
+}
+
+// joinQueue holds the open join requests, saving them on every change like the grants.
+type joinQueue struct {
+	requests *store.Collection
+	expiry   time.Duration
+}
+
+func newJoinQueue(file *store.File, conf settings.JoinRequests) (*joinQueue, error) {
+	requests, err := store.NewCollection(file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load join requests from %s: %s", file.Path(), err)
+	}
+
+	return &joinQueue{requests: requests, expiry: conf.Expiry}, nil
+}
+
+func (q *joinQueue) add(r *joinRequest) error {
+	return q.requests.Update(func(tx *store.Tx) error { return tx.Put(r.ID, r) })
+}
+
+func (q *joinQueue) remove(id string) error {
+	return q.requests.Update(func(tx *store.Tx) error {
+		tx.Delete(id)
+		return nil
+	})
+}
+
+// get returns a copy of the request, or nil.
+func (q *joinQueue) get(id string) *joinRequest {
+	var r joinRequest
+	if !q.requests.Get(id, &r) {
+		return nil
+	}
+	return &r
+}
+
+// find returns the user's open request for the role, or nil.
+func (q *joinQueue) find(userID, role string) *joinRequest {
+	for _, r := range q.list(role) {
+		if r.UserID == userID {
+			return &r
+		}
+	}
+	return nil
+}
+
+// list returns the open requests for a role, or all of them, oldest first.
+func (q *joinQueue) list(role string) []joinRequest {
+	var all, list []joinRequest
+	q.requests.List(&all)
+	for _, r := range all {
+		if len(role) == 0 || r.Role == role {
+			list = append(list, r)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Requested.Before(list[j].Requested) })
+
+	return list
+}
+
+// sweep drops the requests nobody answered in time.
+func (q *joinQueue) sweep(ctx context.Context) {
+	log := loggerFrom(ctx)
+
+	now := time.Now()
+	for _, r := range q.list("") {
+		if r.Expires.After(now) {
+			continue
+		}
+
+		if err := q.remove(r.ID); err != nil {
+			log.Error("Unable to save join requests", zap.Error(err))
+			continue
+		}
+
+		log.Info("Join request expired", zap.String("join_request", r.ID), zap.String("user", r.UserID), zap.String("role", r.Role))
+		notify(ctx, r.event(ctx, events.JoinExpired, ""))
+	}
+}
+
+func requestJoin(ctx context.Context, sender *Sender, req *proto.ExecRequest) (string, error) {
+	sig := req.Args[2]
+	reason := strings.Join(req.Args[3:], " ")
+
+	r, err := role.RoleClient.GetRole(ctx, &rolesrv.Role{ShortName: sig})
+	if err != nil {
+		return "", upstreamError(err)
+	}
+	if !r.Sig {
+		return "", usageError(fmt.Sprintf("%s is not a SIG", sig))
+	}
+	if r.Joinable {
+		return "", usageError(fmt.Sprintf("Anyone can join %s, there's no need to ask", sig))
+	}
+
+	if existing := joinRequests.find(sender.UserID, sig); existing != nil {
+		return "", usageError(fmt.Sprintf("You already asked to join %s (request %s)", sig, existing.ID))
+	}
+
+	members, err := role.RoleClient.GetMembers(ctx, &rolesrv.Filter{Name: memberFilter(r)})
+	if err != nil {
+		return "", upstreamError(err)
+	}
+	for _, member := range members.Members {
+		if member == sender.UserID {
+			return "", usageError(fmt.Sprintf("You're already in %s", sig))
+		}
+	}
+
+	// No point asking an admin for something that would be refused anyway
+	missing, err := missingPrerequisites(ctx, role.RoleClient, sender.UserID, sig)
+	if err != nil {
+		return "", upstreamError(err)
+	}
+	if len(missing) != 0 {
+		return "", usageError(fmt.Sprintf("You need %s before you can join %s", strings.Join(missing, ", "), sig))
+	}
+
+	now := time.Now().UTC()
+	jr := &joinRequest{
+		ID:        newShortID(),
+		UserID:    sender.UserID,
+		Role:      sig,
+		Reason:    reason,
+		Requested: now,
+		Expires:   now.Add(joinRequests.expiry),
+	}
+	if err = joinRequests.add(jr); err != nil {
+		return "", internalError(err)
+	}
+
+	notify(ctx, jr.event(ctx, events.JoinRequested, ""))
+
+	return common.SendSuccess(fmt.Sprintf("Asked to join %s, a role admin will look at it (request %s)", sig, jr.ID)), nil
+}
+
+func approveJoin(ctx context.Context, sender *Sender, req *proto.ExecRequest) (string, error) {
+	jr := joinRequests.get(req.Args[2])
+	if jr == nil {
+		return "", notFoundError("No join request %s", req.Args[2])
+	}
+	// Nobody answered in time, even if the sweep hasn't dropped it yet
+	if !jr.Expires.After(time.Now()) {
+		return "", notFoundError("Join request %s has expired", jr.ID)
+	}
+
+	// The SIG may have changed since the request was made, so look its filter up now
+	r, err := role.RoleClient.GetRole(ctx, &rolesrv.Role{ShortName: jr.Role})
+	if err != nil {
+		return "", upstreamError(err)
+	}
+
+	_, err = role.RoleClient.AddMembers(ctx, &rolesrv.Members{Name: []string{jr.UserID}, Filter: memberFilter(r)})
+	// A full SIG puts them on its waitlist, which answers the request as well
+	if err != nil && waitlist.position(jr.Role, jr.UserID) == 0 {
+		return "", upstreamError(err)
+	}
+	waitlisted := err != nil
+
+	if err = joinRequests.remove(jr.ID); err != nil {
+		return "", internalError(err)
+	}
+
+	notify(ctx, jr.event(ctx, events.JoinApproved, ""))
+
+	_, names, err := renderer.Render(ctx, []string{jr.UserID})
+	if err != nil {
+		return "", upstreamError(err)
+	}
+
+	if waitlisted {
+		return common.SendSuccess(fmt.Sprintf("Approved request %s, %s is full so %s is number %d on its waitlist",
+			jr.ID, jr.Role, names[0], waitlist.position(jr.Role, jr.UserID))), nil
+	}
+
+	if err = syncAfterChange(ctx, sender); err != nil {
+		return "", err
+	}
+
+	return common.SendSuccess(fmt.Sprintf("Approved request %s, added %s to %s", jr.ID, names[0], jr.Role)), nil
+}
+
+func denyJoin(ctx context.Context, sender *Sender, req *proto.ExecRequest) (string, error) {
+	jr := joinRequests.get(req.Args[2])
+	if jr == nil {
+		return "", notFoundError("No join request %s", req.Args[2])
+	}
+
+	if err := joinRequests.remove(jr.ID); err != nil {
+		return "", internalError(err)
+	}
+
+	notify(ctx, jr.event(ctx, events.JoinDenied, strings.Join(req.Args[3:], " ")))
+
+	return common.SendSuccess(fmt.Sprintf("Denied request %s to join %s", jr.ID, jr.Role)), nil
+}
+
+func listJoinRequests(ctx context.Context, sender *Sender, req *proto.ExecRequest) (string, error) {
+	table, err := listJoinRequestsTable(ctx, sender, req)
+	if err != nil {
+		return "", err
+	}
+
+	if len(table.Rows) == 0 {
+		return "```No open join requests```\n", nil
+	}
+
+	var buffer bytes.Buffer
+	buffer.WriteString("Open join requests:\n")
+	for _, row := range table.Rows {
+		buffer.WriteString(fmt.Sprintf("\t%s: %s wants %s, expires in %s\n", row[0], row[2], row[3], row[7]))
+		if len(row[4]) != 0 {
+			buffer.WriteString(fmt.Sprintf("\t\t%s\n", row[4]))
+		}
+	}
+
+	return fmt.Sprintf("```%s```\n", buffer.String()), nil
+}
+
+func listJoinRequestsTable(ctx context.Context, sender *Sender, req *proto.ExecRequest) (*Table, error) {
+	var sig string
+	if len(req.Args) == 3 {
+		sig = req.Args[2]
+	}
+
+	open := joinRequests.list(sig)
+
+	ids := make([]string, 0, len(open))
+	for _, jr := range open {
+		ids = append(ids, jr.UserID)
+	}
+	_, names, err := renderer.Render(ctx, ids)
+	if err != nil {
+		return nil, upstreamError(err)
+	}
+
+	table := &Table{Columns: []string{"id", "user_id", "name", "sig", "reason", "requested", "expires", "remaining"}}
+	for i, jr := range open {
+		table.Rows = append(table.Rows, []string{
+			jr.ID,
+			jr.UserID,
+			names[i],
+			jr.Role,
+			jr.Reason,
+			jr.Requested.Format(time.RFC3339),
+			jr.Expires.Format(time.RFC3339),
+			formatDuration(time.Until(jr.Expires)),
+		})
+	}
+
+	return table, nil
+}
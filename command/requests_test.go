@@ -0,0 +1,87 @@
+package command
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	rolesrv "github.com/chremoas/role-srv/proto"
+
+	"github.com/chremoas/role-cmd/events"
+	"github.com/chremoas/role-cmd/store"
+)
+
+func TestJoinRequest(t *testing.T) {
+	tc, cleanup := newTestCommand(t)
+	defer cleanup()
+
+	tc.roles.role(&rolesrv.Role{ShortName: "caps", FilterA: "caps-a", FilterB: "caps", Sig: true})
+
+	tc.mustRun(t, "2001", "request", "caps", "I", "have", "a", "carrier")
+	if _, reported := tc.run("2001", "request", "caps"); !strings.HasPrefix(reported, "usage:") {
+		t.Errorf("asking twice reported %q, want a usage error", reported)
+	}
+
+	open := joinRequests.list("caps")
+	if len(open) != 1 || open[0].UserID != "2001" || open[0].Reason != "I have a carrier" {
+		t.Fatalf("open requests = %+v", open)
+	}
+	id := open[0].ID
+
+	if _, reported := tc.run("2001", "approve", id); !strings.HasPrefix(reported, "permission:") {
+		t.Errorf("approving your own request reported %q, want a permission error", reported)
+	}
+
+	tc.mustRun(t, testAdmin, "approve", id)
+	if !tc.roles.filters["caps"]["2001"] {
+		t.Error("approving didn't add them to the SIG")
+	}
+	if joinRequests.get(id) != nil {
+		t.Error("approved request is still open")
+	}
+	if tc.roles.syncs != 1 {
+		t.Errorf("synced %d times, want once", tc.roles.syncs)
+	}
+
+	var joins []string
+	for _, eventType := range tc.events.types() {
+		if strings.HasPrefix(eventType, "join.") {
+			joins = append(joins, eventType)
+		}
+	}
+	if !reflect.DeepEqual(joins, []string{events.JoinRequested, events.JoinApproved}) {
+		t.Errorf("join events = %v", joins)
+	}
+
+	if _, reported := tc.run(testAdmin, "approve", id); !strings.HasPrefix(reported, "not_found:") {
+		t.Errorf("approving twice reported %q, want not found", reported)
+	}
+}
+
+func TestExpiredJoinRequest(t *testing.T) {
+	tc, cleanup := newTestCommand(t)
+	defer cleanup()
+
+	tc.roles.role(&rolesrv.Role{ShortName: "caps", FilterA: "caps-a", FilterB: "caps", Sig: true})
+	tc.mustRun(t, "2001", "request", "caps")
+	id := joinRequests.list("caps")[0].ID
+
+	// Run out, but not swept yet
+	err := joinRequests.requests.Update(func(tx *store.Tx) error {
+		var jr joinRequest
+		tx.Get(id, &jr)
+		jr.Expires = time.Now().Add(-time.Second)
+		return tx.Put(id, &jr)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, reported := tc.run(testAdmin, "approve", id); !strings.HasPrefix(reported, "not_found:") {
+		t.Errorf("approving an expired request reported %q, want not found", reported)
+	}
+	if tc.roles.filters["caps"]["2001"] {
+		t.Error("an expired request was approved")
+	}
+}
@@ -0,0 +1,144 @@
+package command
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	rolesrv "github.com/chremoas/role-srv/proto"
+)
+
+const ruleHelp = "Rules are terms joined by and/or, with and binding tighter than or and no parentheses. " +
+	"A term is role:<role_name>, nick:<regexp> (matched against the nick, or the username if there isn't one) " +
+	"or bot, and may be preceded by not. e.g. role:pilots and not role:alts or nick:^\\[ABC\\]"
+
+// A rule decides who belongs in a dynamic filter. It's kept as the or of some ands.
+type rule struct {
+	source  string
+	clauses [][]ruleTerm
+}
+
+type ruleTerm struct {
+	negated bool
+	role    string
+	nick    *regexp.Regexp
+	bot     bool
+}
+
+// ruleSubject is what a rule gets to know about a user.
+type ruleSubject struct {
+	user  *rolesrv.GetDiscordUserResponse
+	roles map[string]bool
+}
+
+func parseRule(tokens []string) (*rule, error) {
+	r := &rule{source: strings.Join(tokens, " ")}
+	if len(tokens) == 0 {
+		return nil, usageError("Empty rule. " + ruleHelp)
+	}
+
+	clause := []ruleTerm{}
+	expectTerm := true
+	negated := false
+	for _, token := range tokens {
+		lower := strings.ToLower(token)
+
+		if !expectTerm {
+			switch lower {
+			case "and":
+			case "or":
+				r.clauses = append(r.clauses, clause)
+				clause = []ruleTerm{}
+			default:
+				return nil, usageError(fmt.Sprintf("Expected and/or before %s. %s", token, ruleHelp))
+			}
+			expectTerm = true
+			continue
+		}
+
+		if lower == "not" {
+			negated = !negated
+			continue
+		}
+
+		t := ruleTerm{negated: negated}
+		switch {
+		case strings.HasPrefix(lower, "role:") && len(token) > len("role:"):
+			t.role = token[len("role:"):]
+		case strings.HasPrefix(lower, "nick:") && len(token) > len("nick:"):
+			pattern, err := regexp.Compile(token[len("nick:"):])
+			if err != nil {
+				return nil, usageError(fmt.Sprintf("Bad nick pattern %s: %s", token, err))
+			}
+			t.nick = pattern
+		case lower == "bot":
+			t.bot = true
+		default:
+			return nil, usageError(fmt.Sprintf("Unknown term %s. %s", token, ruleHelp))
+		}
+
+		clause = append(clause, t)
+		expectTerm = false
+		negated = false
+	}
+
+	if expectTerm {
+		return nil, usageError(fmt.Sprintf("Rule ends without a term. %s", ruleHelp))
+	}
+	r.clauses = append(r.clauses, clause)
+
+	return r, nil
+}
+
+// roles returns the roles the rule looks at.
+func (r *rule) roles() []string {
+	seen := make(map[string]bool)
+	var roles []string
+	for _, clause := range r.clauses {
+		for _, t := range clause {
+			if len(t.role) != 0 && !seen[t.role] {
+				seen[t.role] = true
+				roles = append(roles, t.role)
+			}
+		}
+	}
+	sort.Strings(roles)
+
+	return roles
+}
+
+func (r *rule) matches(s ruleSubject) bool {
+	for _, clause := range r.clauses {
+		matched := true
+		for _, t := range clause {
+			if !t.matches(s) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (t ruleTerm) matches(s ruleSubject) bool {
+	var matched bool
+	switch {
+	case len(t.role) != 0:
+		matched = s.roles[t.role]
+	case t.nick != nil:
+		name := s.user.Nick
+		if len(name) == 0 {
+			name = s.user.Username
+		}
+		matched = t.nick.MatchString(name)
+	case t.bot:
+		matched = s.user.Bot
+	}
+
+	return matched != t.negated
+}
@@ -0,0 +1,87 @@
+package command
+
+import (
+	"strings"
+	"testing"
+
+	rolesrv "github.com/chremoas/role-srv/proto"
+)
+
+func TestParseRuleErrors(t *testing.T) {
+	for _, rule := range []string{
+		"",
+		"role:",
+		"nick:",
+		"pilots",
+		"role:a role:b",
+		"role:a and",
+		"role:a or or role:b",
+		"and role:a",
+		"not",
+		"nick:[",
+		"role:a xor role:b",
+	} {
+		if _, err := parseRule(strings.Fields(rule)); err == nil {
+			t.Errorf("parseRule(%q) accepted a bad rule", rule)
+		} else if classify(err).kind != errUsage {
+			t.Errorf("parseRule(%q) = %s, want a usage error", rule, err)
+		}
+	}
+}
+
+func TestRuleMatches(t *testing.T) {
+	pilot := ruleSubject{
+		user:  &rolesrv.GetDiscordUserResponse{Username: "maverick", Nick: "[ABC] Maverick"},
+		roles: map[string]bool{"pilots": true},
+	}
+	alt := ruleSubject{
+		user:  &rolesrv.GetDiscordUserResponse{Username: "goose"},
+		roles: map[string]bool{"pilots": true, "alts": true},
+	}
+	bot := ruleSubject{
+		user:  &rolesrv.GetDiscordUserResponse{Username: "robot", Bot: true},
+		roles: map[string]bool{},
+	}
+
+	tests := []struct {
+		rule  string
+		match []bool // pilot, alt, bot
+	}{
+		{"role:pilots", []bool{true, true, false}},
+		{"not role:pilots", []bool{false, false, true}},
+		{"not not role:pilots", []bool{true, true, false}},
+		{"role:pilots and not role:alts", []bool{true, false, false}},
+		{"ROLE:alts OR bot", []bool{false, true, true}},
+		// and binds tighter than or
+		{"bot or role:pilots and role:alts", []bool{false, true, true}},
+		{"nick:^\\[ABC\\]", []bool{true, false, false}},
+		// The username stands in for a missing nick
+		{"nick:^goose$", []bool{false, true, false}},
+		{"role:pilots and not bot and not nick:^\\[ABC\\]", []bool{false, true, false}},
+	}
+
+	for _, test := range tests {
+		r, err := parseRule(strings.Fields(test.rule))
+		if err != nil {
+			t.Errorf("parseRule(%q): %s", test.rule, err)
+			continue
+		}
+
+		for i, subject := range []ruleSubject{pilot, alt, bot} {
+			if got := r.matches(subject); got != test.match[i] {
+				t.Errorf("%q matches %s = %t, want %t", test.rule, subject.user.Username, got, test.match[i])
+			}
+		}
+	}
+}
+
+func TestRuleRoles(t *testing.T) {
+	r, err := parseRule(strings.Fields("role:b and not role:a or role:b and bot"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := strings.Join(r.roles(), ","); got != "a,b" {
+		t.Errorf("roles() = %s, want a,b", got)
+	}
+}
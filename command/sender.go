@@ -0,0 +1,53 @@
+package command
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Discord is the only chat service role-srv syncs to, so it's what a sender without
+// an explicit platform is assumed to be on.
+const defaultPlatform = "discord"
+
+// Sender is who sent a command and where from. The bot hands it to us as
+// "<channel>:<user>", optionally prefixed with "<platform>:".
+type Sender struct {
+	Platform  string
+	ChannelID string
+	UserID    string
+}
+
+// ParseSender turns an ExecRequest.Sender into a Sender, or explains why it can't.
+func ParseSender(sender string) (*Sender, error) {
+	if len(sender) == 0 {
+		return nil, errors.New("no sender given")
+	}
+
+	s := &Sender{Platform: defaultPlatform}
+	parts := strings.Split(sender, ":")
+
+	switch len(parts) {
+	case 2:
+		s.ChannelID, s.UserID = parts[0], parts[1]
+	case 3:
+		s.Platform, s.ChannelID, s.UserID = parts[0], parts[1], parts[2]
+	default:
+		return nil, fmt.Errorf("malformed sender '%s', expected [platform:]channel:user", sender)
+	}
+
+	if len(s.Platform) == 0 || len(s.ChannelID) == 0 || len(s.UserID) == 0 {
+		return nil, fmt.Errorf("malformed sender '%s', platform, channel and user can't be empty", sender)
+	}
+
+	if strings.ContainsAny(sender, " \t\n") {
+		return nil, fmt.Errorf("malformed sender '%s', whitespace isn't allowed", sender)
+	}
+
+	return s, nil
+}
+
+// String is the "<channel>:<user>" form role-srv and the rclient helpers expect.
+func (s *Sender) String() string {
+	return fmt.Sprintf("%s:%s", s.ChannelID, s.UserID)
+}
@@ -0,0 +1,41 @@
+package command
+
+import "testing"
+
+func TestParseSender(t *testing.T) {
+	tests := []struct {
+		sender string
+		want   *Sender
+	}{
+		{"123:456", &Sender{Platform: "discord", ChannelID: "123", UserID: "456"}},
+		{"cli:rolectl:456", &Sender{Platform: "cli", ChannelID: "rolectl", UserID: "456"}},
+		{"", nil},
+		{"456", nil},
+		{"a:b:c:d", nil},
+		{":456", nil},
+		{"123:", nil},
+		{":123:456", nil},
+		{"123:45 6", nil},
+	}
+
+	for _, test := range tests {
+		got, err := ParseSender(test.sender)
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("ParseSender(%q) = %+v, want an error", test.sender, got)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("ParseSender(%q): %s", test.sender, err)
+			continue
+		}
+		if *got != *test.want {
+			t.Errorf("ParseSender(%q) = %+v, want %+v", test.sender, got, test.want)
+		}
+		if got.String() != test.want.ChannelID+":"+test.want.UserID {
+			t.Errorf("String() = %s", got.String())
+		}
+	}
+}
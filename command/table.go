@@ -0,0 +1,199 @@
+package command
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+
+	proto "github.com/chremoas/chremoas/proto"
+	rolesrv "github.com/chremoas/role-srv/proto"
+)
+
+// Table is a subcommand's result as data, for callers that aren't a chat client.
+type Table struct {
+	Columns []string
+	Rows    [][]string
+}
+
+// Records turns the rows into column name to value maps, for JSON and YAML.
+func (t *Table) Records() []map[string]string {
+	records := make([]map[string]string, len(t.Rows))
+	for i, row := range t.Rows {
+		records[i] = make(map[string]string, len(t.Columns))
+		for j, column := range t.Columns {
+			if j < len(row) {
+				records[i][column] = row[j]
+			}
+		}
+	}
+
+	return records
+}
+
+// tableFunc is the data equivalent of a subcommandFunc.
+type tableFunc func(ctx context.Context, sender *Sender, req *proto.ExecRequest) (*Table, error)
+
+type tableSinkKey struct{}
+
+func withTableSink(ctx context.Context, table **Table) context.Context {
+	return context.WithValue(ctx, tableSinkKey{}, table)
+}
+
+// tableHandler adapts a tableFunc so it can run through the same middleware chain as
+// the handler, handing the table back through the sink in ctx.
+func tableHandler(fn tableFunc) subcommandFunc {
+	return func(ctx context.Context, sender *Sender, req *proto.ExecRequest) (string, error) {
+		table, err := fn(ctx, sender, req)
+		if sink, ok := ctx.Value(tableSinkKey{}).(**Table); ok {
+			*sink = table
+		}
+
+		return "", err
+	}
+}
+
+// tableWhen is for subcommands that both show and change things. The table is used when
+// shows says the arguments ask for something to be shown, otherwise the handler's chat
+// response is wrapped with textTable.
+func tableWhen(shows func(req *proto.ExecRequest) bool, table tableFunc, handler subcommandFunc) tableFunc {
+	return func(ctx context.Context, sender *Sender, req *proto.ExecRequest) (*Table, error) {
+		if shows(req) {
+			return table(ctx, sender, req)
+		}
+
+		result, err := handler(ctx, sender, req)
+		if err != nil {
+			return nil, err
+		}
+		return textTable(result), nil
+	}
+}
+
+// argCount is a tableWhen test for subcommands that only show something when given
+// exactly n arguments, counting the command and subcommand.
+func argCount(n int) func(req *proto.ExecRequest) bool {
+	return func(req *proto.ExecRequest) bool { return len(req.Args) == n }
+}
+
+// textTable wraps a plain chat response, minus the code block markers.
+func textTable(result string) *Table {
+	result = strings.TrimSpace(strings.Replace(result, "```", "", -1))
+	return &Table{Columns: []string{"result"}, Rows: [][]string{{result}}}
+}
+
+func listRolesTable(ctx context.Context, sender *Sender, req *proto.ExecRequest) (*Table, error) {
+	roles, err := role.RoleClient.GetRoles(ctx, &rolesrv.NilMessage{})
+	if err != nil {
+		return nil, upstreamError(err)
+	}
+
+	table := &Table{Columns: []string{"short_name", "name"}}
+	for _, r := range roles.Roles {
+		if !r.Sig {
+			table.Rows = append(table.Rows, []string{r.ShortName, r.Name})
+		}
+	}
+	sort.Slice(table.Rows, func(i, j int) bool { return table.Rows[i][0] < table.Rows[j][0] })
+
+	return table, nil
+}
+
+func roleKeysTable(ctx context.Context, sender *Sender, req *proto.ExecRequest) (*Table, error) {
+	keys, err := role.RoleClient.GetRoleKeys(ctx, &rolesrv.NilMessage{})
+	if err != nil {
+		return nil, upstreamError(err)
+	}
+
+	table := &Table{Columns: []string{"key"}}
+	for _, key := range keys.Value {
+		table.Rows = append(table.Rows, []string{key})
+	}
+
+	return table, nil
+}
+
+func roleInfoTable(ctx context.Context, sender *Sender, req *proto.ExecRequest) (*Table, error) {
+	info, err := role.RoleClient.GetRole(ctx, &rolesrv.Role{ShortName: req.Args[2]})
+	if err != nil {
+		return nil, upstreamError(err)
+	}
+
+	return &Table{
+		Columns: []string{"field", "value"},
+		Rows: [][]string{
+			{"short_name", info.ShortName},
+			{"type", info.Type},
+			{"filter_a", info.FilterA},
+			{"filter_b", info.FilterB},
+			{"name", info.Name},
+			{"color", strconv.Itoa(int(info.Color))},
+			{"hoist", strconv.FormatBool(info.Hoist)},
+			{"position", strconv.Itoa(int(info.Position))},
+			{"permissions", strconv.Itoa(int(info.Permissions))},
+			{"managed", strconv.FormatBool(info.Managed)},
+			{"mentionable", strconv.FormatBool(info.Mentionable)},
+			{"sig", strconv.FormatBool(info.Sig)},
+			{"joinable", strconv.FormatBool(info.Joinable)},
+			{"sync", strconv.FormatBool(info.Sync)},
+		},
+	}, nil
+}
+
+func getMembersTable(ctx context.Context, sender *Sender, req *proto.ExecRequest) (*Table, error) {
+	members, err := role.RoleClient.GetRoleMembership(ctx, &rolesrv.RoleMembershipRequest{Name: req.Args[2]})
+	if err != nil {
+		return nil, upstreamError(err)
+	}
+
+	ids, names, err := renderMembers(ctx, members.Members)
+	if err != nil {
+		return nil, err
+	}
+
+	table := &Table{Columns: []string{"user_id", "name"}}
+	for i := range ids {
+		table.Rows = append(table.Rows, []string{ids[i], names[i]})
+	}
+
+	return table, nil
+}
+
+func listUserRolesTable(ctx context.Context, sender *Sender, req *proto.ExecRequest) (*Table, error) {
+	_, roles, err := userRoles(ctx, sender, req)
+	if err != nil {
+		return nil, err
+	}
+
+	table := &Table{Columns: []string{"short_name", "type", "filter_a", "filter_b"}}
+	for _, r := range roles {
+		table.Rows = append(table.Rows, []string{r.ShortName, clientType[r.Sig], r.FilterA, r.FilterB})
+	}
+
+	return table, nil
+}
+
+func versionTable(ctx context.Context, sender *Sender, req *proto.ExecRequest) (*Table, error) {
+	build := checker.Build()
+	return &Table{
+		Columns: []string{"version", "commit", "branch"},
+		Rows:    [][]string{{build.Version, build.Commit, build.Branch}},
+	}, nil
+}
+
+// renderMembers returns the non-empty member IDs with their names, in the same order.
+func renderMembers(ctx context.Context, members []string) (ids, names []string, err error) {
+	// Render skips empty IDs, drop them first so the names line up
+	for _, id := range members {
+		if len(id) != 0 {
+			ids = append(ids, id)
+		}
+	}
+
+	_, names, err = renderer.Render(ctx, ids)
+	if err != nil {
+		return nil, nil, upstreamError(err)
+	}
+
+	return ids, names, nil
+}
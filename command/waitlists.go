@@ -0,0 +1,510 @@
+package command
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	proto "github.com/chremoas/chremoas/proto"
+	rolesrv "github.com/chremoas/role-srv/proto"
+	common "github.com/chremoas/services-common/command"
+	"github.com/micro/go-micro/client"
+	"go.uber.org/zap"
+
+	"github.com/chremoas/role-cmd/store"
+)
+
+type waitlistEntry struct {
+	UserID string    `json:"userId"`
+	Added  time.Time `json:"added"`
+}
+
+// A limitedRole is a role's seats and the users queued for one, first come first served.
+type limitedRole struct {
+	Capacity int             `json:"capacity"`
+	Queue    []waitlistEntry `json:"queue,omitempty"`
+	// Who had a seat at the last sweep or was given one by role-cmd since, anyone else
+	// got in some other way
+	Seated []string `json:"seated,omitempty"`
+}
+
+// waitlists holds the roles with a limited number of seats, by role.
+type waitlists struct {
+	lists *store.Collection
+}
+
+func newWaitlists(file *store.File) (*waitlists, error) {
+	lists, err := store.NewCollection(file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load waitlists from %s: %s", file.Path(), err)
+	}
+
+	return &waitlists{lists: lists}, nil
+}
+
+// change applies fn to a copy of the role's waitlist and saves it, dropping the role if
+// it's left without a capacity.
+func (w *waitlists) change(role string, fn func(l *limitedRole)) error {
+	err := w.lists.Update(func(tx *store.Tx) error {
+		var l limitedRole
+		tx.Get(role, &l)
+
+		fn(&l)
+
+		if l.Capacity == 0 {
+			tx.Delete(role)
+			return nil
+		}
+		return tx.Put(role, &l)
+	})
+
+	return storeError(err)
+}
+
+func (w *waitlists) get(role string) limitedRole {
+	var l limitedRole
+	w.lists.Get(role, &l)
+
+	return l
+}
+
+// capacity returns the role's seats, 0 if it has no limit.
+func (w *waitlists) capacity(role string) int {
+	return w.get(role).Capacity
+}
+
+func (w *waitlists) limited() bool {
+	return w.lists.Len() != 0
+}
+
+// roles returns the roles with a capacity.
+func (w *waitlists) roles() []string {
+	return w.lists.Keys()
+}
+
+func (w *waitlists) setCapacity(role string, seats int) error {
+	return w.change(role, func(l *limitedRole) {
+		l.Capacity = seats
+	})
+}
+
+func (w *waitlists) queue(role string) []waitlistEntry {
+	return w.get(role).Queue
+}
+
+// position returns where the user is on the role's waitlist, counting from 1, or 0 if
+// they aren't on it.
+func (w *waitlists) position(role, userID string) int {
+	for i, entry := range w.queue(role) {
+		if entry.UserID == userID {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// enqueue puts the users at the back of the role's waitlist, unless they're on it already.
+func (w *waitlists) enqueue(role string, userIDs []string) error {
+	return w.change(role, func(l *limitedRole) {
+		now := time.Now().UTC()
+		for _, userID := range userIDs {
+			queued := false
+			for _, entry := range l.Queue {
+				queued = queued || entry.UserID == userID
+			}
+			if !queued {
+				l.Queue = append(l.Queue, waitlistEntry{UserID: userID, Added: now})
+			}
+		}
+	})
+}
+
+func (w *waitlists) dequeue(role, userID string) error {
+	return w.change(role, func(l *limitedRole) {
+		var remaining []waitlistEntry
+		for _, entry := range l.Queue {
+			if entry.UserID != userID {
+				remaining = append(remaining, entry)
+			}
+		}
+		l.Queue = remaining
+	})
+}
+
+// seat records that role-cmd gave the users a seat.
+func (w *waitlists) seat(role string, userIDs []string) error {
+	return w.change(role, func(l *limitedRole) {
+		for _, userID := range userIDs {
+			if !containsString(l.Seated, userID) {
+				l.Seated = append(l.Seated, userID)
+			}
+		}
+	})
+}
+
+// memberSet returns the users in the filter.
+func memberSet(ctx context.Context, roles rolesrv.RolesService, filter string) (map[string]bool, error) {
+	members, err := roles.GetMembers(ctx, &rolesrv.Filter{Name: filter})
+	if err != nil {
+		return nil, err
+	}
+
+	current := make(map[string]bool)
+	for _, member := range members.Members {
+		if len(member) != 0 {
+			current[member] = true
+		}
+	}
+
+	return current, nil
+}
+
+// promote fills the role's free seats from the front of its waitlist. The additions go
+// through the whole role client, so users who no longer have the prerequisites are
+// dropped from the waitlist rather than added. It reports whether anyone was added.
+func (w *waitlists) promote(ctx context.Context, r *rolesrv.Role) bool {
+	log := loggerFrom(ctx)
+
+	seats := w.capacity(r.ShortName)
+	if seats == 0 {
+		return false
+	}
+
+	promoted := false
+	for _, entry := range w.queue(r.ShortName) {
+		current, err := memberSet(ctx, role.RoleClient, memberFilter(r))
+		if err != nil {
+			log.Warn("Unable to count members for the waitlist", zap.String("role", r.ShortName), zap.Error(err))
+			return promoted
+		}
+		if len(current) >= seats {
+			return promoted
+		}
+
+		if !current[entry.UserID] {
+			_, err = role.RoleClient.AddMembers(ctx, &rolesrv.Members{Name: []string{entry.UserID}, Filter: memberFilter(r)})
+			if err != nil {
+				if _, refused := err.(*commandError); !refused {
+					log.Warn("Unable to promote from the waitlist, will try again",
+						zap.String("role", r.ShortName), zap.String("user", entry.UserID), zap.Error(err))
+					return promoted
+				}
+				log.Info("Dropped from the waitlist", zap.String("role", r.ShortName), zap.String("user", entry.UserID), zap.Error(err))
+			} else {
+				promoted = true
+				log.Info("Promoted from the waitlist", zap.String("role", r.ShortName), zap.String("user", entry.UserID))
+			}
+		}
+
+		if err = w.dequeue(r.ShortName, entry.UserID); err != nil {
+			log.Error("Unable to save waitlists", zap.Error(err))
+			return promoted
+		}
+	}
+
+	return promoted
+}
+
+// evict takes the members who got into the role some other way, e.g. with !sig join
+// straight to role-srv, back out once it's over its limit. Nobody knows in what order
+// they got in, so all of them go to the back of the waitlist, in ID order, and the seats
+// left are filled from the front of it like any other. Members seated at the last sweep
+// or by role-cmd keep their seats. It reports whether anyone was taken out.
+func (w *waitlists) evict(ctx context.Context, r *rolesrv.Role) bool {
+	log := loggerFrom(ctx)
+
+	l := w.get(r.ShortName)
+	if l.Capacity == 0 {
+		return false
+	}
+
+	current, err := memberSet(ctx, role.RoleClient, memberFilter(r))
+	if err != nil {
+		log.Warn("Unable to count members for the waitlist", zap.String("role", r.ShortName), zap.Error(err))
+		return false
+	}
+
+	var newcomers []string
+	// The first sweep after a limit is set has nothing to go on, so it just takes note
+	if l.Seated != nil {
+		for userID := range current {
+			if !containsString(l.Seated, userID) {
+				newcomers = append(newcomers, userID)
+			}
+		}
+		sort.Strings(newcomers)
+	}
+
+	evicted := false
+	if len(current) > l.Capacity && len(newcomers) != 0 {
+		if err = w.enqueue(r.ShortName, newcomers); err != nil {
+			log.Error("Unable to save waitlists", zap.Error(err))
+			return false
+		}
+
+		// All at once, so the promotions that follow go through the queue in order
+		_, err = role.RoleClient.RemoveMembers(ctx, &rolesrv.Members{Name: newcomers, Filter: memberFilter(r)})
+		if err != nil {
+			log.Warn("Unable to take unseated members out of a full role",
+				zap.String("role", r.ShortName), zap.Strings("users", newcomers), zap.Error(err))
+			return false
+		}
+		evicted = true
+		log.Info("Moved from a full role to its waitlist", zap.String("role", r.ShortName), zap.Strings("users", newcomers))
+
+		if current, err = memberSet(ctx, role.RoleClient, memberFilter(r)); err != nil {
+			log.Warn("Unable to count members for the waitlist", zap.String("role", r.ShortName), zap.Error(err))
+			return evicted
+		}
+	}
+
+	seated := make([]string, 0, len(current))
+	for userID := range current {
+		seated = append(seated, userID)
+	}
+	sort.Strings(seated)
+	if err = w.change(r.ShortName, func(l *limitedRole) { l.Seated = seated }); err != nil {
+		log.Error("Unable to save waitlists", zap.Error(err))
+	}
+
+	return evicted
+}
+
+// sweep takes out whoever got into a full role past role-cmd, then promotes into every
+// role with free seats, for when members left through something other than role-cmd or a
+// capacity was raised.
+func (w *waitlists) sweep(ctx context.Context) {
+	changed := false
+	for _, name := range w.roles() {
+		r, err := role.RoleClient.GetRole(ctx, &rolesrv.Role{ShortName: name})
+		if err != nil {
+			loggerFrom(ctx).Warn("Unable to look up role with a waitlist", zap.String("role", name), zap.Error(err))
+			continue
+		}
+
+		changed = w.evict(ctx, r) || changed
+		if len(w.queue(name)) != 0 {
+			changed = w.promote(ctx, r) || changed
+		}
+	}
+
+	if changed {
+		if err := syncAfterChange(ctx, senderFrom(ctx)); err != nil {
+			loggerFrom(ctx).Warn("Unable to sync after sweeping waitlists", zap.Error(err))
+		}
+	}
+}
+
+// capacityEnforcer puts users on the waitlist instead of adding them to a role that's
+// full, and promotes from the waitlist when someone is removed from one. It only sees
+// changes made through role-cmd, sig-cmd goes straight to role-srv, so the sweep evicts
+// whoever got in past it.
+type capacityEnforcer struct {
+	rolesrv.RolesService
+}
+
+// limitedRoles returns the roles with a capacity whose members are kept in the filter.
+func (c capacityEnforcer) limitedRoles(ctx context.Context, filter string) ([]*rolesrv.Role, error) {
+	roles, err := c.RolesService.GetRoles(ctx, &rolesrv.NilMessage{})
+	if err != nil {
+		return nil, err
+	}
+
+	var limited []*rolesrv.Role
+	for _, r := range roles.Roles {
+		if memberFilter(r) == filter && waitlist.capacity(r.ShortName) != 0 {
+			limited = append(limited, r)
+		}
+	}
+
+	return limited, nil
+}
+
+func (c capacityEnforcer) AddMembers(ctx context.Context, in *rolesrv.Members, opts ...client.CallOption) (*rolesrv.NilMessage, error) {
+	if !waitlist.limited() {
+		return c.RolesService.AddMembers(ctx, in, opts...)
+	}
+
+	roles, err := c.limitedRoles(ctx, in.Filter)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, r := range roles {
+		current, err := memberSet(ctx, c.RolesService, in.Filter)
+		if err != nil {
+			return nil, err
+		}
+
+		var joining []string
+		for _, userID := range in.Name {
+			if !current[userID] {
+				joining = append(joining, userID)
+			}
+		}
+
+		if len(current)+len(joining) <= waitlist.capacity(r.ShortName) {
+			continue
+		}
+
+		if err = waitlist.enqueue(r.ShortName, joining); err != nil {
+			return nil, err
+		}
+
+		if len(joining) == 1 {
+			return nil, usageError(fmt.Sprintf("%s is full, queued on the waitlist at number %d",
+				r.ShortName, waitlist.position(r.ShortName, joining[0])))
+		}
+		return nil, usageError(fmt.Sprintf("%s doesn't have room for %d more, queued them on the waitlist",
+			r.ShortName, len(joining)))
+	}
+
+	rsp, err := c.RolesService.AddMembers(ctx, in, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	// So the sweep knows they were let in
+	for _, r := range roles {
+		if err = waitlist.seat(r.ShortName, in.Name); err != nil {
+			loggerFrom(ctx).Error("Unable to save waitlists", zap.Error(err))
+		}
+	}
+
+	return rsp, nil
+}
+
+func (c capacityEnforcer) RemoveMembers(ctx context.Context, in *rolesrv.Members, opts ...client.CallOption) (*rolesrv.NilMessage, error) {
+	rsp, err := c.RolesService.RemoveMembers(ctx, in, opts...)
+	if err == nil && waitlist.limited() {
+		roles, err := c.limitedRoles(ctx, in.Filter)
+		if err != nil {
+			loggerFrom(ctx).Warn("Unable to look roles up for waitlists", zap.Error(err))
+			return rsp, nil
+		}
+
+		// The caller's sync picks the promotions up
+		for _, r := range roles {
+			waitlist.promote(ctx, r)
+		}
+	}
+
+	return rsp, err
+}
+
+const capacityUsage = "Usage: !role capacity <role_name> [seats|none]"
+
+func roleCapacity(ctx context.Context, sender *Sender, req *proto.ExecRequest) (string, error) {
+	roleName := req.Args[2]
+
+	r, err := role.RoleClient.GetRole(ctx, &rolesrv.Role{ShortName: roleName})
+	if err != nil {
+		return "", upstreamError(err)
+	}
+
+	if len(req.Args) == 3 {
+		seats := waitlist.capacity(roleName)
+		if seats == 0 {
+			return fmt.Sprintf("```%s has no member limit```\n", roleName), nil
+		}
+
+		current, err := memberSet(ctx, role.RoleClient, memberFilter(r))
+		if err != nil {
+			return "", upstreamError(err)
+		}
+
+		return fmt.Sprintf("```%s: %d of %d seats taken, %d waiting```\n",
+			roleName, len(current), seats, len(waitlist.queue(roleName))), nil
+	}
+
+	if err = requireRoleAdmin(ctx, sender); err != nil {
+		return "", err
+	}
+
+	seats := 0
+	if req.Args[3] != "none" {
+		if seats, err = strconv.Atoi(req.Args[3]); err != nil || seats < 1 {
+			return "", usageError(capacityUsage)
+		}
+	}
+
+	if err = waitlist.setCapacity(roleName, seats); err != nil {
+		return "", err
+	}
+
+	if seats == 0 {
+		return common.SendSuccess(fmt.Sprintf("%s no longer has a member limit", roleName)), nil
+	}
+
+	// Raising the limit may have freed seats
+	if waitlist.promote(ctx, r) {
+		if err = syncAfterChange(ctx, sender); err != nil {
+			return "", err
+		}
+	}
+
+	return common.SendSuccess(fmt.Sprintf("%s is now limited to %d members. Anyone joining past the limit with !sig join "+
+		"is moved to the waitlist within %s", roleName, seats, formatDuration(sweepInterval))), nil
+}
+
+func roleWaitlist(ctx context.Context, sender *Sender, req *proto.ExecRequest) (string, error) {
+	roleName := req.Args[2]
+
+	if len(req.Args) == 4 {
+		if req.Args[3] != "leave" {
+			return "", usageError("Usage: !role waitlist <role_name> [leave]")
+		}
+		if waitlist.position(roleName, sender.UserID) == 0 {
+			return "", notFoundError("You're not on the waitlist for %s", roleName)
+		}
+		if err := waitlist.dequeue(roleName, sender.UserID); err != nil {
+			return "", err
+		}
+		return common.SendSuccess(fmt.Sprintf("Left the waitlist for %s", roleName)), nil
+	}
+
+	table, err := roleWaitlistTable(ctx, sender, req)
+	if err != nil {
+		return "", err
+	}
+
+	if len(table.Rows) == 0 {
+		return fmt.Sprintf("```Nobody is waiting for %s```\n", roleName), nil
+	}
+
+	var buffer bytes.Buffer
+	buffer.WriteString(fmt.Sprintf("Waiting for %s:\n", roleName))
+	for _, row := range table.Rows {
+		buffer.WriteString(fmt.Sprintf("\t%s. %s (since %s)\n", row[0], row[2], row[3]))
+	}
+
+	return fmt.Sprintf("```%s```\n", buffer.String()), nil
+}
+
+func roleWaitlistTable(ctx context.Context, sender *Sender, req *proto.ExecRequest) (*Table, error) {
+	roleName := req.Args[2]
+	if waitlist.capacity(roleName) == 0 {
+		return nil, notFoundError("%s has no member limit, so no waitlist", roleName)
+	}
+
+	queue := waitlist.queue(roleName)
+
+	ids := make([]string, 0, len(queue))
+	for _, entry := range queue {
+		ids = append(ids, entry.UserID)
+	}
+	_, names, err := renderer.Render(ctx, ids)
+	if err != nil {
+		return nil, upstreamError(err)
+	}
+
+	table := &Table{Columns: []string{"position", "user_id", "name", "added"}}
+	for i, entry := range queue {
+		table.Rows = append(table.Rows, []string{strconv.Itoa(i + 1), entry.UserID, names[i], entry.Added.Format(time.RFC3339)})
+	}
+
+	return table, nil
+}
@@ -0,0 +1,88 @@
+package command
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	rolesrv "github.com/chremoas/role-srv/proto"
+)
+
+func queued(role string) []string {
+	var ids []string
+	for _, entry := range waitlist.queue(role) {
+		ids = append(ids, entry.UserID)
+	}
+	return ids
+}
+
+func TestCapacity(t *testing.T) {
+	tc, cleanup := newTestCommand(t)
+	defer cleanup()
+
+	tc.roles.role(&rolesrv.Role{ShortName: "pilots", FilterA: "pilots"}, "2001", "2002")
+	tc.mustRun(t, testAdmin, "capacity", "pilots", "2")
+
+	ctx := context.Background()
+	for i, userID := range []string{"2003", "2004"} {
+		_, err := role.RoleClient.AddMembers(ctx, &rolesrv.Members{Name: []string{userID}, Filter: "pilots"})
+		if err == nil || !strings.Contains(err.Error(), "waitlist") {
+			t.Fatalf("adding %s to a full role: %v, want them queued", userID, err)
+		}
+		if position := waitlist.position("pilots", userID); position != i+1 {
+			t.Errorf("%s is number %d on the waitlist, want %d", userID, position, i+1)
+		}
+	}
+
+	// A seat freed through role-cmd goes to the front of the queue
+	if _, err := role.RoleClient.RemoveMembers(ctx, &rolesrv.Members{Name: []string{"2001"}, Filter: "pilots"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := tc.roles.members("pilots"); !reflect.DeepEqual(got, []string{"2002", "2003"}) {
+		t.Errorf("pilots = %v, want 2002 and 2003", got)
+	}
+	if got := queued("pilots"); !reflect.DeepEqual(got, []string{"2004"}) {
+		t.Errorf("waitlist = %v, want 2004", got)
+	}
+}
+
+func TestWaitlistSweep(t *testing.T) {
+	tc, cleanup := newTestCommand(t)
+	defer cleanup()
+
+	sweep := func() { waitlist.sweep(backgroundContext(context.Background(), "waitlist_sweeper")) }
+
+	tc.roles.role(&rolesrv.Role{ShortName: "pilots", FilterA: "pilots"}, "2001", "2002")
+	tc.mustRun(t, testAdmin, "capacity", "pilots", "2")
+	// The first sweep only takes note of who holds a seat
+	sweep()
+
+	if _, err := role.RoleClient.AddMembers(context.Background(), &rolesrv.Members{Name: []string{"2009"}, Filter: "pilots"}); err == nil {
+		t.Fatal("2009 was added to a full role")
+	}
+
+	// Past role-cmd, e.g. with !sig leave and !sig join
+	delete(tc.roles.filters["pilots"], "2002")
+	tc.roles.filters["pilots"]["2003"] = true
+	tc.roles.filters["pilots"]["2004"] = true
+	sweep()
+
+	// 2009 was waiting first, so takes the free seat ahead of both newcomers
+	if got := tc.roles.members("pilots"); !reflect.DeepEqual(got, []string{"2001", "2009"}) {
+		t.Errorf("pilots after the sweep = %v, want 2001 and 2009", got)
+	}
+	if got := queued("pilots"); !reflect.DeepEqual(got, []string{"2003", "2004"}) {
+		t.Errorf("waitlist after the sweep = %v, want 2003 then 2004", got)
+	}
+
+	// Joining while there's room is fine, then the queue fills the rest
+	delete(tc.roles.filters["pilots"], "2001")
+	sweep()
+	if got := tc.roles.members("pilots"); !reflect.DeepEqual(got, []string{"2003", "2009"}) {
+		t.Errorf("pilots after a seat freed up = %v, want 2003 and 2009", got)
+	}
+	if got := queued("pilots"); !reflect.DeepEqual(got, []string{"2004"}) {
+		t.Errorf("waitlist after a seat freed up = %v, want 2004", got)
+	}
+}
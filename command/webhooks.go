@@ -0,0 +1,59 @@
+package command
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+
+	proto "github.com/chremoas/chremoas/proto"
+	common "github.com/chremoas/services-common/command"
+)
+
+func webhookAdmin(ctx context.Context, sender *Sender, req *proto.ExecRequest) (string, error) {
+	switch {
+	case req.Args[2] == "list" && len(req.Args) == 3:
+		return listWebhooks()
+	case req.Args[2] == "test" && len(req.Args) == 4:
+		return testWebhook(ctx, sender, req.Args[3])
+	default:
+		return "", usageError("Usage: !role webhooks list|test <webhook>")
+	}
+}
+
+func listWebhooks() (string, error) {
+	if webhookDispatcher == nil || len(webhookDispatcher.Hooks()) == 0 {
+		return "```No webhooks configured```\n", nil
+	}
+
+	var buffer bytes.Buffer
+	buffer.WriteString("Webhooks:\n")
+	for _, h := range webhookDispatcher.Hooks() {
+		filter := "all events"
+		if len(h.Events()) != 0 {
+			filter = strings.Join(h.Events(), ", ")
+		}
+
+		delivered, failed, lastError := h.Stats()
+		buffer.WriteString(fmt.Sprintf("\t%s: %s (%s) delivered: %d, dead letters: %d\n",
+			h.Name(), h.Target(), filter, delivered, failed))
+		if len(lastError) != 0 {
+			buffer.WriteString(fmt.Sprintf("\t\tlast error: %s\n", lastError))
+		}
+	}
+
+	return fmt.Sprintf("```%s```\n", buffer.String()), nil
+}
+
+func testWebhook(ctx context.Context, sender *Sender, name string) (string, error) {
+	if webhookDispatcher == nil || webhookDispatcher.Hook(name) == nil {
+		return "", notFoundError("No webhook called %s", name)
+	}
+
+	message := fmt.Sprintf("Test from %s", sender.UserID)
+	if err := webhookDispatcher.Test(ctx, webhookDispatcher.Hook(name), message); err != nil {
+		return "", &commandError{kind: errUnavailable, message: fmt.Sprintf("Test of %s failed: %s", name, err)}
+	}
+
+	return common.SendSuccess(fmt.Sprintf("Test event delivered to %s", name)), nil
+}
@@ -0,0 +1,192 @@
+// Package events describes the role-change events role-cmd publishes on the micro
+// broker. Every event is JSON and carries a Header, the topic is the configured prefix
+// followed by the event type, e.g. chremoas.role-cmd.role.created.
+package events
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+
+	rolesrv "github.com/chremoas/role-srv/proto"
+)
+
+// Event types
+const (
+	RoleCreated     = "role.created"
+	RoleDestroyed   = "role.destroyed"
+	RoleUpdated     = "role.updated"
+	FilterCreated   = "filter.created"
+	FilterDestroyed = "filter.destroyed"
+	MembersAdded    = "members.added"
+	MembersRemoved  = "members.removed"
+	Synced          = "synced"
+	JoinRequested   = "join.requested"
+	JoinApproved    = "join.approved"
+	JoinDenied      = "join.denied"
+	JoinExpired     = "join.expired"
+	// Only ever sent to a webhook by !role webhooks test
+	WebhookTest = "webhook.test"
+)
+
+// Actor is whoever made the change, as the chat service (or API) reported them.
+type Actor struct {
+	Platform  string `json:"platform"`
+	ChannelID string `json:"channelId"`
+	UserID    string `json:"userId"`
+}
+
+// Header is common to every event.
+type Header struct {
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"requestId,omitempty"`
+	Actor     Actor     `json:"actor"`
+}
+
+func (h *Header) header() *Header {
+	return h
+}
+
+// Event is any of the events below.
+type Event interface {
+	header() *Header
+}
+
+// Stamp gives the event an ID and time if it doesn't have them yet, and returns its header.
+func Stamp(event Event) Header {
+	h := event.header()
+	if len(h.ID) == 0 {
+		h.ID = uuid.New().String()
+	}
+	if h.Time.IsZero() {
+		h.Time = time.Now().UTC()
+	}
+
+	return *h
+}
+
+// Sink is anything events can be sent to.
+type Sink interface {
+	Publish(event Event) error
+}
+
+type fanout []Sink
+
+// Fanout sends every event to all of the sinks, nil if there are none.
+func Fanout(sinks ...Sink) Sink {
+	if len(sinks) == 0 {
+		return nil
+	}
+	return fanout(sinks)
+}
+
+func (f fanout) Publish(event Event) error {
+	Stamp(event)
+
+	var failed error
+	for _, sink := range f {
+		if err := sink.Publish(event); err != nil {
+			failed = err
+		}
+	}
+
+	return failed
+}
+
+type Role struct {
+	ShortName   string `json:"shortName"`
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	FilterA     string `json:"filterA"`
+	FilterB     string `json:"filterB"`
+	Sig         bool   `json:"sig"`
+	Joinable    bool   `json:"joinable"`
+	Sync        bool   `json:"sync"`
+	Color       int32  `json:"color"`
+	Hoist       bool   `json:"hoist"`
+	Position    int32  `json:"position"`
+	Permissions int32  `json:"permissions"`
+	Managed     bool   `json:"managed"`
+	Mentionable bool   `json:"mentionable"`
+}
+
+// NewRole copies what role-srv knows about a role, nil stays nil.
+func NewRole(r *rolesrv.Role) *Role {
+	if r == nil {
+		return nil
+	}
+
+	return &Role{
+		ShortName:   r.ShortName,
+		Name:        r.Name,
+		Type:        r.Type,
+		FilterA:     r.FilterA,
+		FilterB:     r.FilterB,
+		Sig:         r.Sig,
+		Joinable:    r.Joinable,
+		Sync:        r.Sync,
+		Color:       r.Color,
+		Hoist:       r.Hoist,
+		Position:    r.Position,
+		Permissions: r.Permissions,
+		Managed:     r.Managed,
+		Mentionable: r.Mentionable,
+	}
+}
+
+type Filter struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// RoleChanged is a role being created (no Before), destroyed (no After) or updated.
+type RoleChanged struct {
+	Header
+	Target string `json:"target"`
+	Before *Role  `json:"before,omitempty"`
+	After  *Role  `json:"after,omitempty"`
+}
+
+// FilterChanged is a filter being created (no Before) or destroyed (no After).
+type FilterChanged struct {
+	Header
+	Target string  `json:"target"`
+	Before *Filter `json:"before,omitempty"`
+	After  *Filter `json:"after,omitempty"`
+}
+
+// MembershipChanged is users being added to or removed from a filter. Before and After
+// are the filter's whole membership.
+type MembershipChanged struct {
+	Header
+	Filter  string   `json:"filter"`
+	Members []string `json:"members"`
+	Before  []string `json:"before"`
+	After   []string `json:"after"`
+}
+
+// SyncRequested is a sync of roles and memberships to the chat service.
+type SyncRequested struct {
+	Header
+}
+
+// JoinRequest is a request to join a SIG that isn't joinable being made, approved,
+// denied or dropped when nobody answered it. Role admins learn about requests from these.
+type JoinRequest struct {
+	Header
+	Request string    `json:"request"`
+	Role    string    `json:"role"`
+	UserID  string    `json:"userId"`
+	Reason  string    `json:"reason,omitempty"`
+	Expires time.Time `json:"expires"`
+	// Why it was denied, if the admin said
+	Note string `json:"note,omitempty"`
+}
+
+// Test checks a webhook is set up right, nothing changed.
+type Test struct {
+	Header
+	Message string `json:"message"`
+}
@@ -0,0 +1,81 @@
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/micro/go-micro/broker"
+	"github.com/micro/go-micro/broker/memory"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/chremoas/role-cmd/settings"
+)
+
+var published = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "role_cmd_events_published_total",
+	Help: "Role change events published on the broker, by type and result.",
+}, []string{"type", "result"})
+
+// Publisher sends events to the broker.
+type Publisher struct {
+	broker broker.Broker
+	prefix string
+}
+
+// NewPublisher connects to the broker the settings ask for. "micro" is the service's
+// own broker, "memory" keeps events inside the process, for local testing.
+func NewPublisher(conf settings.Events, micro broker.Broker) (*Publisher, error) {
+	var b broker.Broker
+	switch conf.Broker {
+	case "micro":
+		b = micro
+	case "memory":
+		b = memory.NewBroker()
+	default:
+		return nil, fmt.Errorf("unknown event broker: %s", conf.Broker)
+	}
+
+	if err := b.Connect(); err != nil {
+		return nil, err
+	}
+
+	return &Publisher{broker: b, prefix: conf.TopicPrefix}, nil
+}
+
+// Broker is where the events go, mostly so they can be subscribed to when it's memory.
+func (p *Publisher) Broker() broker.Broker {
+	return p.broker
+}
+
+// Topic is the topic events of the type are published on.
+func (p *Publisher) Topic(eventType string) string {
+	return p.prefix + "." + eventType
+}
+
+// Publish sends the event to the broker.
+func (p *Publisher) Publish(event Event) error {
+	h := Stamp(event)
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		published.WithLabelValues(h.Type, "failure").Inc()
+		return err
+	}
+
+	err = p.broker.Publish(p.Topic(h.Type), &broker.Message{
+		Header: map[string]string{
+			"Content-Type": "application/json",
+			"X-Event-Id":   h.ID,
+			"X-Event-Type": h.Type,
+		},
+		Body: body,
+	})
+	if err != nil {
+		published.WithLabelValues(h.Type, "failure").Inc()
+		return err
+	}
+
+	published.WithLabelValues(h.Type, "success").Inc()
+	return nil
+}
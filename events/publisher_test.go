@@ -0,0 +1,76 @@
+package events
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/micro/go-micro/broker"
+
+	"github.com/chremoas/role-cmd/settings"
+)
+
+func TestPublisherMemoryBroker(t *testing.T) {
+	p, err := NewPublisher(settings.Events{Broker: "memory", TopicPrefix: "chremoas.role-cmd"}, nil)
+	if err != nil {
+		t.Fatalf("NewPublisher: %s", err)
+	}
+
+	var received []broker.Event
+	_, err = p.Broker().Subscribe("chremoas.role-cmd.role.updated", func(e broker.Event) error {
+		received = append(received, e)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Subscribe: %s", err)
+	}
+
+	event := &RoleChanged{
+		Header: Header{Type: RoleUpdated, Actor: Actor{Platform: "discord", ChannelID: "1", UserID: "2"}},
+		Target: "pilots",
+		Before: &Role{ShortName: "pilots", Color: 1},
+		After:  &Role{ShortName: "pilots", Color: 2},
+	}
+	if err = p.Publish(event); err != nil {
+		t.Fatalf("Publish: %s", err)
+	}
+
+	if len(received) != 1 {
+		t.Fatalf("received %d events, want 1", len(received))
+	}
+	e := received[0]
+
+	if e.Topic() != "chremoas.role-cmd.role.updated" {
+		t.Errorf("topic = %q", e.Topic())
+	}
+
+	header := e.Message().Header
+	for name, want := range map[string]string{
+		"Content-Type": "application/json",
+		"X-Event-Id":   event.ID,
+		"X-Event-Type": RoleUpdated,
+	} {
+		if header[name] != want {
+			t.Errorf("header %s = %q, want %q", name, header[name], want)
+		}
+	}
+	if len(event.ID) == 0 || event.Time.IsZero() {
+		t.Errorf("event wasn't stamped: %+v", event.Header)
+	}
+
+	var got RoleChanged
+	if err = json.Unmarshal(e.Message().Body, &got); err != nil {
+		t.Fatalf("body isn't a RoleChanged: %s", err)
+	}
+	if got.Target != "pilots" || got.Actor.UserID != "2" {
+		t.Errorf("got %+v", got)
+	}
+	if got.Before == nil || got.Before.Color != 1 || got.After == nil || got.After.Color != 2 {
+		t.Errorf("before/after = %+v/%+v, want colors 1/2", got.Before, got.After)
+	}
+}
+
+func TestPublisherUnknownBroker(t *testing.T) {
+	if _, err := NewPublisher(settings.Events{Broker: "carrier-pigeon"}, nil); err == nil {
+		t.Error("NewPublisher accepted an unknown broker")
+	}
+}
@@ -7,10 +7,15 @@ require (
 	github.com/chremoas/perms-srv v1.3.0
 	github.com/chremoas/role-srv v1.3.0
 	github.com/chremoas/services-common v1.3.2
+	github.com/google/uuid v1.1.1
 	github.com/micro/go-micro v1.9.1
+	github.com/prometheus/client_golang v1.1.0
+	github.com/spf13/viper v1.4.0
 	go.uber.org/zap v1.10.0
 	golang.org/x/net v0.0.0-20190724013045-ca1201d0de80
+	gopkg.in/yaml.v2 v2.2.2
 )
 
 replace github.com/chremoas/role-cmd => ../role-cmd
+
 replace github.com/hashicorp/consul => github.com/hashicorp/consul v1.5.1
@@ -0,0 +1,29 @@
+package health
+
+import (
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Build identifies the binary, as injected by the Makefile and Dockerfile.
+type Build struct {
+	Version string `json:"version"`
+	Commit  string `json:"commit"`
+	Branch  string `json:"branch"`
+}
+
+func (b Build) String() string {
+	return fmt.Sprintf("%s (%s@%s)", b.Version, b.Branch, b.Commit)
+}
+
+var buildInfo = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "role_cmd_build_info",
+	Help: "Always 1, labelled with the version, commit and branch that's running.",
+}, []string{"version", "commit", "branch"})
+
+// Record publishes the build as the build_info metric.
+func (b Build) Record() {
+	buildInfo.WithLabelValues(b.Version, b.Commit, b.Branch).Set(1)
+}
@@ -0,0 +1,110 @@
+package health
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Check returns an error if whatever it checks isn't usable.
+type Check func(ctx context.Context) error
+
+// Result is the outcome of one check.
+type Result struct {
+	Name    string        `json:"name"`
+	Healthy bool          `json:"healthy"`
+	Error   string        `json:"error,omitempty"`
+	Latency time.Duration `json:"latency"`
+}
+
+// Checker runs the checks that decide whether the service is ready to take requests.
+type Checker struct {
+	build   Build
+	timeout time.Duration
+	started time.Time
+
+	mutex  sync.RWMutex
+	checks map[string]Check
+}
+
+func NewChecker(build Build, timeout time.Duration) *Checker {
+	return &Checker{
+		build:   build,
+		timeout: timeout,
+		started: time.Now(),
+		checks:  make(map[string]Check),
+	}
+}
+
+// Add registers a check, replacing any check that already has that name.
+func (c *Checker) Add(name string, check Check) {
+	c.mutex.Lock()
+	c.checks[name] = check
+	c.mutex.Unlock()
+}
+
+func (c *Checker) SetTimeout(timeout time.Duration) {
+	c.mutex.Lock()
+	c.timeout = timeout
+	c.mutex.Unlock()
+}
+
+func (c *Checker) Build() Build {
+	return c.build
+}
+
+func (c *Checker) Uptime() time.Duration {
+	return time.Since(c.started)
+}
+
+// Run runs every check at once and returns the results sorted by name. Nothing is
+// ready until at least one check has been added.
+func (c *Checker) Run(ctx context.Context) (results []Result, ready bool) {
+	c.mutex.RLock()
+	timeout := c.timeout
+	checks := make(map[string]Check, len(c.checks))
+	for name, check := range c.checks {
+		checks[name] = check
+	}
+	c.mutex.RUnlock()
+
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	var (
+		wg    sync.WaitGroup
+		mutex sync.Mutex
+	)
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check Check) {
+			defer wg.Done()
+
+			start := time.Now()
+			err := check(ctx)
+
+			result := Result{Name: name, Healthy: err == nil, Latency: time.Since(start)}
+			if err != nil {
+				result.Error = err.Error()
+			}
+
+			mutex.Lock()
+			results = append(results, result)
+			mutex.Unlock()
+		}(name, check)
+	}
+	wg.Wait()
+
+	sort.Slice(results, func(i, j int) bool { return results[i].Name < results[j].Name })
+
+	ready = len(results) > 0
+	for _, result := range results {
+		ready = ready && result.Healthy
+	}
+
+	return results, ready
+}
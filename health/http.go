@@ -0,0 +1,61 @@
+package health
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.uber.org/zap"
+)
+
+type response struct {
+	Status string   `json:"status"`
+	Build  Build    `json:"build"`
+	Uptime string   `json:"uptime"`
+	Checks []Result `json:"checks,omitempty"`
+}
+
+// Serve serves Prometheus metrics on /metrics, liveness on /healthz and readiness on
+// /readyz. Liveness only says the process is up, readiness runs the checks.
+func Serve(addr string, checker *Checker, log *zap.Logger) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		write(w, http.StatusOK, response{
+			Status: "ok",
+			Build:  checker.Build(),
+			Uptime: checker.Uptime().String(),
+		}, log)
+	})
+
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		results, ready := checker.Run(r.Context())
+
+		rsp := response{
+			Status: "ready",
+			Build:  checker.Build(),
+			Uptime: checker.Uptime().String(),
+			Checks: results,
+		}
+		status := http.StatusOK
+		if !ready {
+			rsp.Status = "unavailable"
+			status = http.StatusServiceUnavailable
+		}
+
+		write(w, status, rsp, log)
+	})
+
+	log.Info("Starting metrics and health endpoints", zap.String("address", addr))
+	return http.ListenAndServe(addr, mux)
+}
+
+func write(w http.ResponseWriter, status int, rsp response, log *zap.Logger) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(rsp); err != nil {
+		log.Debug("Unable to write health response", zap.Error(err))
+	}
+}
@@ -0,0 +1,44 @@
+package logging
+
+import (
+	"fmt"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/chremoas/role-cmd/settings"
+)
+
+// New builds a logger the way chremoas.yaml asks for. It starts from zap's production
+// config so anything not set there behaves like zap.NewProduction.
+func New(conf settings.Logging) (*zap.Logger, error) {
+	zapConf := zap.NewProductionConfig()
+
+	var level zapcore.Level
+	if err := level.UnmarshalText([]byte(conf.Level)); err != nil {
+		return nil, fmt.Errorf("unknown log level %s: %v", conf.Level, err)
+	}
+	zapConf.Level = zap.NewAtomicLevelAt(level)
+
+	switch conf.Format {
+	case "json":
+		zapConf.Encoding = "json"
+	case "console":
+		zapConf.Encoding = "console"
+		zapConf.EncoderConfig.EncodeLevel = zapcore.CapitalLevelEncoder
+		zapConf.EncoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+	default:
+		return nil, fmt.Errorf("unknown log format %s, expected json or console", conf.Format)
+	}
+
+	if conf.Sampling.Initial > 0 {
+		zapConf.Sampling = &zap.SamplingConfig{
+			Initial:    conf.Sampling.Initial,
+			Thereafter: conf.Sampling.Thereafter,
+		}
+	} else {
+		zapConf.Sampling = nil
+	}
+
+	return zapConf.Build()
+}
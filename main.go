@@ -1,75 +1,202 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"net/http"
+	"time"
 
 	proto "github.com/chremoas/chremoas/proto"
-	permsrv "github.com/chremoas/perms-srv/proto"
-	rolesrv "github.com/chremoas/role-srv/proto"
 	"github.com/chremoas/services-common/config"
-	chremoasPrometheus "github.com/chremoas/services-common/prometheus"
 	"github.com/micro/go-micro"
-	"github.com/micro/go-micro/client"
 	"go.uber.org/zap"
 
 	"github.com/chremoas/role-cmd/command"
+	"github.com/chremoas/role-cmd/events"
+	"github.com/chremoas/role-cmd/health"
+	"github.com/chremoas/role-cmd/logging"
+	"github.com/chremoas/role-cmd/settings"
+	"github.com/chremoas/role-cmd/tracing"
+	"github.com/chremoas/role-cmd/upstream"
+	"github.com/chremoas/role-cmd/webhooks"
 )
 
 var (
 	Version = "SET ME YOU KNOB"
+	Commit  = "unknown"
+	Branch  = "unknown"
 	service micro.Service
 	logger  *zap.Logger
+	checker *health.Checker
+	hooks   *webhooks.Dispatcher
 	name    = "role"
+
+	// Everything still running alongside the service, stopped before the webhooks are closed
+	stopBackground context.CancelFunc
+	backgroundDone = make(chan struct{})
+	apiServer      *http.Server
+)
+
+const (
+	// Where Prometheus and the health checks find us
+	metricsAddress = ":9001"
+	// How long shutting down waits for background work, API requests and webhook deliveries
+	shutdownTimeout = 10 * time.Second
 )
 
 func main() {
 	var err error
 
-	// TODO pick stuff up from the config
+	// This gets replaced by one built from the config once it's loaded
 	logger, err = zap.NewProduction()
 	if err != nil {
 		panic(err)
 	}
-	defer logger.Sync()
+	defer func() { logger.Sync() }()
 	logger.Info("Initialized logger")
 
-	go chremoasPrometheus.PrometheusExporter(logger)
+	build := health.Build{Version: Version, Commit: Commit, Branch: Branch}
+	build.Record()
+	logger.Info("Starting", zap.String("version", Version), zap.String("commit", Commit), zap.String("branch", Branch))
+
+	// Not ready until initialize has added the upstream checks
+	checker = health.NewChecker(build, settings.Defaults().Health.Timeout)
+	go func() {
+		if err := health.Serve(metricsAddress, checker, logger); err != nil {
+			logger.Fatal("Failed to start metrics and health endpoints", zap.Error(err))
+		}
+	}()
 
 	service = config.NewService(Version, "cmd", name, initialize)
 
 	if err := service.Run(); err != nil {
 		fmt.Println(err)
 	}
+
+	shutdown()
+	tracing.Shutdown()
+}
+
+// shutdown stops everything that could still publish events before closing the webhooks,
+// giving the lot shutdownTimeout.
+func shutdown() {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if stopBackground != nil {
+		stopBackground()
+		select {
+		case <-backgroundDone:
+		case <-ctx.Done():
+			logger.Warn("Gave up waiting for background work to stop")
+		}
+	}
+
+	if apiServer != nil {
+		if err := apiServer.Shutdown(ctx); err != nil {
+			logger.Warn("Unable to shut the admin API down cleanly", zap.Error(err))
+		}
+	}
+
+	if hooks != nil {
+		hooks.Close(ctx)
+	}
 }
 
 // This function is a callback from the config.NewService function.  Read those docs
 func initialize(config *config.Configuration) error {
-	clientFactory := clientFactory{
-		roleSrv:  config.LookupService("srv", "role"),
-		permsSrv: config.LookupService("srv", "perms"),
-		client:   service.Client(),
+	conf, err := settings.Load()
+	if err != nil {
+		return err
+	}
+
+	configured, err := logging.New(conf.Logging)
+	if err != nil {
+		return err
+	}
+	logger.Sync()
+	logger = configured
+	logger.Info("Configured logger", zap.String("level", conf.Logging.Level), zap.String("format", conf.Logging.Format))
+
+	if err = tracing.Configure(conf.Tracing, logger); err != nil {
+		return err
 	}
+	service.Init(micro.WrapHandler(tracing.NewHandlerWrapper()))
 
-	proto.RegisterCommandHandler(service.Server(),
-		command.NewCommand(name,
-			&clientFactory,
+	clientFactory := upstream.NewFactory(config, upstream.Wrap(service.Client(), conf.Upstream, logger))
+
+	checker.SetTimeout(conf.Health.Timeout)
+	clientFactory.AddHealthChecks(checker)
+
+	if conf.Permissions.Bootstrap {
+		// Don't refuse to start over this, perms-srv may just not be up yet, but don't
+		// hang on it either
+		ctx, cancel := context.WithTimeout(context.Background(), conf.Upstream.Timeout)
+		err = command.BootstrapPermissions(ctx,
+			clientFactory.NewPermsClient(),
+			conf.Permissions.Admins,
 			logger,
-		),
-	)
+		)
+		cancel()
+		if err != nil {
+			logger.Error("Unable to bootstrap permissions", zap.Error(err))
+		}
+	}
 
-	return nil
-}
+	var sinks []events.Sink
+	if conf.Events.Enabled {
+		publisher, err := events.NewPublisher(conf.Events, service.Options().Broker)
+		if err != nil {
+			return err
+		}
+		sinks = append(sinks, publisher)
+		logger.Info("Publishing role change events",
+			zap.String("broker", conf.Events.Broker),
+			zap.String("topic_prefix", conf.Events.TopicPrefix),
+		)
+	}
 
-type clientFactory struct {
-	roleSrv  string
-	permsSrv string
-	client   client.Client
-}
+	if hooks, err = webhooks.NewDispatcher(conf.Webhooks, logger); err != nil {
+		return err
+	}
+	if len(hooks.Hooks()) != 0 {
+		sinks = append(sinks, hooks)
+		logger.Info("Sending role change events to webhooks", zap.Int("webhooks", len(hooks.Hooks())))
+	}
 
-func (c clientFactory) NewPermsClient() permsrv.PermissionsService {
-	return permsrv.NewPermissionsService(c.permsSrv, c.client)
-}
+	cmd, err := command.NewCommand(name,
+		clientFactory,
+		conf,
+		checker,
+		events.Fanout(sinks...),
+		hooks,
+		logger,
+	)
+	if err != nil {
+		return err
+	}
+	proto.RegisterCommandHandler(service.Server(), cmd)
 
-func (c clientFactory) NewRoleClient() rolesrv.RolesService {
-	return rolesrv.NewRolesService(c.roleSrv, c.client)
+	var background context.Context
+	background, stopBackground = context.WithCancel(context.Background())
+	go func() {
+		defer close(backgroundDone)
+		cmd.RunBackground(background)
+	}()
+
+	if conf.API.Enabled {
+		api, err := command.NewAPI(conf.API)
+		if err != nil {
+			return err
+		}
+		apiServer = &http.Server{Addr: conf.API.Address, Handler: api}
+		go func() {
+			logger.Info("Starting admin API", zap.String("address", conf.API.Address))
+			if err := apiServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logger.Error("Admin API stopped", zap.Error(err))
+			}
+		}()
+	}
+
+	return nil
 }
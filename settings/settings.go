@@ -0,0 +1,271 @@
+package settings
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// The role command keeps its own settings under extensions.roleCmd in chremoas.yaml
+const extensionKey = "extensions.roleCmd"
+
+type Settings struct {
+	Permissions struct {
+		// Create any permissions the role command needs but perms-srv doesn't know about yet
+		Bootstrap bool `yaml:"bootstrap"`
+		// Users seeded into permissions created by the bootstrap
+		Admins []string `yaml:"admins"`
+	} `yaml:"permissions"`
+	PermissionCache PermissionCache `yaml:"permissionCache"`
+	UserDirectory   UserDirectory   `yaml:"userDirectory"`
+	Names           Names           `yaml:"names"`
+	Upstream        Upstream        `yaml:"upstream"`
+	RateLimits      RateLimits      `yaml:"rateLimits"`
+	Tracing         Tracing         `yaml:"tracing"`
+	Logging         Logging         `yaml:"logging"`
+	Health          Health          `yaml:"health"`
+	CLI             CLI             `yaml:"cli"`
+	API             API             `yaml:"api"`
+	Events          Events          `yaml:"events"`
+	Webhooks        Webhooks        `yaml:"webhooks"`
+	Storage         Storage         `yaml:"storage"`
+	Grants          Grants          `yaml:"grants"`
+	JoinRequests    JoinRequests    `yaml:"joinRequests"`
+	Prerequisites   Prerequisites   `yaml:"prerequisites"`
+	DynamicFilters  DynamicFilters  `yaml:"dynamicFilters"`
+}
+
+type PermissionCache struct {
+	// How long an allowed permission check is remembered
+	TTL time.Duration `yaml:"ttl"`
+	// How long a denied permission check is remembered, 0 disables negative caching
+	NegativeTTL time.Duration `yaml:"negativeTtl"`
+	MaxEntries  int           `yaml:"maxEntries"`
+}
+
+type UserDirectory struct {
+	// How long the cached guild user list is used before it's fetched again
+	RefreshInterval time.Duration `yaml:"refreshInterval"`
+}
+
+type Names struct {
+	// "short" shows the nick or username, "full" shows nick (username#discriminator)
+	Format         string `yaml:"format"`
+	FlagBots       bool   `yaml:"flagBots"`
+	FlagUnverified bool   `yaml:"flagUnverified"`
+}
+
+// Upstream controls how role-srv and perms-srv are called.
+type Upstream struct {
+	// Deadline for a single call, unless the endpoint has its own in Timeouts
+	Timeout  time.Duration     `yaml:"timeout"`
+	Timeouts []EndpointTimeout `yaml:"timeouts"`
+	// How many times a call to one of RetryEndpoints is retried when the service can't be reached
+	Retries        int           `yaml:"retries"`
+	RetryBackoff   time.Duration `yaml:"retryBackoff"`
+	RetryEndpoints []string      `yaml:"retryEndpoints"`
+	// Consecutive failures before calls to a service are refused, 0 disables the breaker
+	BreakerThreshold int           `yaml:"breakerThreshold"`
+	BreakerCooldown  time.Duration `yaml:"breakerCooldown"`
+}
+
+type EndpointTimeout struct {
+	// e.g. Roles.SyncToChatService
+	Endpoint string        `yaml:"endpoint"`
+	Timeout  time.Duration `yaml:"timeout"`
+}
+
+// RateLimits are token buckets per user and per channel. Expensive subcommands (sync,
+// list_members) have their own, stricter, buckets. Role admins aren't limited.
+type RateLimits struct {
+	User             Limit `yaml:"user"`
+	Channel          Limit `yaml:"channel"`
+	ExpensiveUser    Limit `yaml:"expensiveUser"`
+	ExpensiveChannel Limit `yaml:"expensiveChannel"`
+}
+
+// Limit allows Burst commands per Per, a Burst of 0 turns the limit off.
+type Limit struct {
+	Burst int           `yaml:"burst"`
+	Per   time.Duration `yaml:"per"`
+}
+
+type Tracing struct {
+	Enabled bool `yaml:"enabled"`
+	// "otlp" sends spans to Endpoint (e.g. http://collector:4318/v1/traces), "stdout" prints them
+	Exporter      string        `yaml:"exporter"`
+	Endpoint      string        `yaml:"endpoint"`
+	ServiceName   string        `yaml:"serviceName"`
+	SampleRatio   float64       `yaml:"sampleRatio"`
+	FlushInterval time.Duration `yaml:"flushInterval"`
+}
+
+type Logging struct {
+	// debug, info, warn, error
+	Level string `yaml:"level"`
+	// json or console
+	Format string `yaml:"format"`
+	// Per second, log the first Initial entries with the same message and then every
+	// Thereafter-th one. An Initial of 0 turns sampling off.
+	Sampling struct {
+		Initial    int `yaml:"initial"`
+		Thereafter int `yaml:"thereafter"`
+	} `yaml:"sampling"`
+}
+
+type Health struct {
+	// How long the readiness checks get to reach role-srv and perms-srv
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// CLI is for rolectl, which talks to role-srv and perms-srv directly.
+type CLI struct {
+	// The user ID rolectl runs commands as, it needs to be a role admin for most of them
+	Admin string `yaml:"admin"`
+	// table, json or yaml
+	Output string `yaml:"output"`
+}
+
+// API is the optional HTTP/JSON admin API. It trusts UserHeader to say who's calling, so
+// it must only be reachable through something that sets it, e.g. the portal's proxy.
+type API struct {
+	Enabled bool   `yaml:"enabled"`
+	Address string `yaml:"address"`
+	// Holds the Discord user ID of whoever is making the request
+	UserHeader string `yaml:"userHeader"`
+	// Requests also need "Authorization: Bearer <Secret>". The API won't start without one,
+	// anyone who can reach it could claim to be an admin otherwise.
+	Secret string `yaml:"secret"`
+}
+
+// Events are published on the micro broker whenever roles, filters or memberships change.
+type Events struct {
+	Enabled bool `yaml:"enabled"`
+	// "micro" for the service's broker, "memory" to keep them in the process
+	Broker      string `yaml:"broker"`
+	TopicPrefix string `yaml:"topicPrefix"`
+}
+
+type Webhook struct {
+	Name string `yaml:"name"`
+	URL  string `yaml:"url"`
+	// Key for the HMAC-SHA256 of the timestamp and body sent in X-Chremoas-Signature, required
+	Secret string `yaml:"secret"`
+	// Event types to send, e.g. role.created or role.*, all of them if empty
+	Events []string `yaml:"events"`
+}
+
+// Webhooks POST the same events that go on the broker to URLs outside of go-micro.
+type Webhooks struct {
+	Hooks        []Webhook     `yaml:"hooks"`
+	Timeout      time.Duration `yaml:"timeout"`
+	Retries      int           `yaml:"retries"`
+	RetryBackoff time.Duration `yaml:"retryBackoff"`
+	// Deliveries waiting per webhook, past that they go straight to the dead letters
+	QueueSize int `yaml:"queueSize"`
+	// Deliveries that failed every retry are appended here as JSON lines, as well as logged
+	DeadLetterFile string `yaml:"deadLetterFile"`
+}
+
+// Storage is where role-cmd keeps its own state. rolectl needs to see the same directory
+// for its changes to be picked up by the service. Every change re-reads the document it
+// makes under a lock file, so neither overwrites what the other has just saved.
+type Storage struct {
+	Directory string `yaml:"directory"`
+}
+
+type Grants struct {
+	// How often expired grants are looked for
+	SweepInterval time.Duration `yaml:"sweepInterval"`
+	// The longest anyone can be granted a role for
+	MaxDuration time.Duration `yaml:"maxDuration"`
+}
+
+// JoinRequests are requests to join SIGs that aren't joinable, waiting on a role admin.
+type JoinRequests struct {
+	// How long a request waits for an answer before it's dropped
+	Expiry time.Duration `yaml:"expiry"`
+}
+
+// Prerequisites are roles a user has to hold before they can be given another.
+type Prerequisites struct {
+	// How often members missing a role's prerequisites are looked for. Every member of
+	// every role with prerequisites is looked up, so it's much longer than the grant sweep
+	SweepInterval time.Duration `yaml:"sweepInterval"`
+	// The most of a role's members one sweep may remove, like DynamicFilters.MaxRemoval
+	MaxRemoval float64 `yaml:"maxRemoval"`
+}
+
+type DynamicFilters struct {
+	// How often enabled dynamic filters are brought in line with their rules
+	ReconcileInterval time.Duration `yaml:"reconcileInterval"`
+	// The most of a filter's members one reconcile may remove, e.g. 0.25 for a quarter. A
+	// reconcile that would remove more, and more than a handful, is skipped instead
+	MaxRemoval float64 `yaml:"maxRemoval"`
+}
+
+// Defaults returns the settings used when chremoas.yaml doesn't say otherwise.
+func Defaults() *Settings {
+	s := &Settings{}
+	s.Permissions.Bootstrap = true
+	s.PermissionCache.TTL = 30 * time.Second
+	s.PermissionCache.NegativeTTL = 10 * time.Second
+	s.PermissionCache.MaxEntries = 1024
+	s.UserDirectory.RefreshInterval = 5 * time.Minute
+	s.Names.Format = "short"
+	s.Upstream.Timeout = 5 * time.Second
+	s.Upstream.Retries = 2
+	s.Upstream.RetryBackoff = 100 * time.Millisecond
+	s.Upstream.BreakerThreshold = 5
+	s.Upstream.BreakerCooldown = 30 * time.Second
+	s.RateLimits.User = Limit{Burst: 10, Per: time.Minute}
+	s.RateLimits.Channel = Limit{Burst: 30, Per: time.Minute}
+	s.RateLimits.ExpensiveUser = Limit{Burst: 2, Per: 5 * time.Minute}
+	s.RateLimits.ExpensiveChannel = Limit{Burst: 5, Per: 5 * time.Minute}
+	s.Tracing.Exporter = "stdout"
+	s.Tracing.ServiceName = "role-cmd"
+	s.Tracing.SampleRatio = 1
+	s.Tracing.FlushInterval = 5 * time.Second
+	s.Logging.Level = "info"
+	s.Logging.Format = "json"
+	s.Logging.Sampling.Initial = 100
+	s.Logging.Sampling.Thereafter = 100
+	s.Health.Timeout = 2 * time.Second
+	s.CLI.Output = "table"
+	s.API.Address = "127.0.0.1:8080"
+	s.API.UserHeader = "X-Chremoas-User"
+	s.Events.Broker = "micro"
+	s.Events.TopicPrefix = "chremoas.role-cmd"
+	s.Webhooks.Timeout = 10 * time.Second
+	s.Webhooks.Retries = 5
+	s.Webhooks.RetryBackoff = time.Second
+	s.Webhooks.QueueSize = 256
+	s.Storage.Directory = "/var/lib/role-cmd"
+	s.Grants.SweepInterval = time.Minute
+	s.Grants.MaxDuration = 90 * 24 * time.Hour
+	s.JoinRequests.Expiry = 7 * 24 * time.Hour
+	s.Prerequisites.SweepInterval = time.Hour
+	s.Prerequisites.MaxRemoval = 0.25
+	s.DynamicFilters.ReconcileInterval = 5 * time.Minute
+	s.DynamicFilters.MaxRemoval = 0.25
+
+	return s
+}
+
+// Load reads the role command settings out of the configuration already loaded by
+// config.Configuration.Load, so it must be called after that (i.e. from the init callback).
+func Load() (*Settings, error) {
+	s := Defaults()
+
+	if err := viper.UnmarshalKey(extensionKey, s); err != nil {
+		return nil, fmt.Errorf("unable to decode %s: %v", extensionKey, err)
+	}
+
+	// Lists are filled in afterwards, decoding over a default list merges into it
+	if s.Upstream.RetryEndpoints == nil {
+		s.Upstream.RetryEndpoints = []string{"Roles.GetRoles", "Roles.GetRole", "Roles.GetRoleKeys", "Roles.GetMembers"}
+	}
+
+	return s, nil
+}
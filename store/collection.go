@@ -0,0 +1,185 @@
+package store
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Collection is a document of records by key, e.g. grants by ID. The service and rolectl
+// both change the same documents, so reads notice when the document has been replaced
+// and changes are made to a fresh copy under the document's lock, never to what was read
+// earlier.
+type Collection struct {
+	file *File
+
+	mutex    sync.Mutex
+	records  records
+	modified time.Time
+	size     int64
+}
+
+// NewCollection loads the collection kept in file.
+func NewCollection(file *File) (*Collection, error) {
+	c := &Collection{file: file}
+	if err := c.refresh(true); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *Collection) Path() string {
+	return c.file.Path()
+}
+
+// refresh must be called with the mutex held. It re-reads the document if it has changed
+// on disk since it was last read, or whatever the case if forced.
+func (c *Collection) refresh(force bool) error {
+	info, err := os.Stat(c.file.Path())
+	if os.IsNotExist(err) {
+		c.records, c.modified, c.size = make(records), time.Time{}, 0
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if !force && c.records != nil && info.ModTime().Equal(c.modified) && info.Size() == c.size {
+		return nil
+	}
+
+	loaded := make(records)
+	if err = c.file.Load(&loaded); err != nil {
+		return err
+	}
+	c.records, c.modified, c.size = loaded, info.ModTime(), info.Size()
+
+	return nil
+}
+
+// read calls fn with the current records. If the document can't be re-read, fn gets
+// what was read last; changes will still fail.
+func (c *Collection) read(fn func(r records)) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.refresh(false)
+	fn(c.records)
+}
+
+// Get decodes the record into v, reporting whether there was one. A record that doesn't
+// decode into v counts as missing.
+func (c *Collection) Get(key string, v interface{}) (found bool) {
+	c.read(func(r records) { found = r.Get(key, v) })
+	return found
+}
+
+// List decodes every record into the slice v points to, in key order.
+func (c *Collection) List(v interface{}) {
+	c.read(func(r records) { r.List(v) })
+}
+
+// Keys returns the keys in order.
+func (c *Collection) Keys() (keys []string) {
+	c.read(func(r records) { keys = r.Keys() })
+	return keys
+}
+
+func (c *Collection) Len() (n int) {
+	c.read(func(r records) { n = len(r) })
+	return n
+}
+
+// Update re-reads the document under its lock and lets change edit it through tx, then
+// saves. Nothing is kept if change returns an error or saving fails, and change's error
+// is returned as is.
+func (c *Collection) Update(change func(tx *Tx) error) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(c.file.Path()), 0700); err != nil {
+		return err
+	}
+	unlock, err := c.file.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// The modification time may be too coarse to tell that rolectl just saved
+	if err = c.refresh(true); err != nil {
+		return err
+	}
+
+	tx := &Tx{records: make(records, len(c.records))}
+	for k, v := range c.records {
+		tx.records[k] = v
+	}
+
+	if err = change(tx); err != nil {
+		return err
+	}
+
+	if err = c.file.Save(tx.records); err != nil {
+		return err
+	}
+	c.records = tx.records
+	if info, err := os.Stat(c.file.Path()); err == nil {
+		c.modified, c.size = info.ModTime(), info.Size()
+	}
+
+	return nil
+}
+
+// Tx is the collection as change sees it inside Update.
+type Tx struct {
+	records
+}
+
+// Put replaces the record.
+func (tx *Tx) Put(key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	tx.records[key] = data
+	return nil
+}
+
+func (tx *Tx) Delete(key string) {
+	delete(tx.records, key)
+}
+
+type records map[string]json.RawMessage
+
+func (r records) Get(key string, v interface{}) bool {
+	data, ok := r[key]
+	return ok && json.Unmarshal(data, v) == nil
+}
+
+func (r records) List(v interface{}) {
+	list := reflect.ValueOf(v).Elem()
+	for _, key := range r.Keys() {
+		item := reflect.New(list.Type().Elem())
+		if json.Unmarshal(r[key], item.Interface()) == nil {
+			list = reflect.Append(list, item.Elem())
+		}
+	}
+	reflect.ValueOf(v).Elem().Set(list)
+}
+
+func (r records) Keys() []string {
+	keys := make([]string, 0, len(r))
+	for k := range r {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
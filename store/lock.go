@@ -0,0 +1,43 @@
+package store
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+const (
+	// How long to wait for someone else's lock
+	lockWait = 10 * time.Second
+	// A lock older than this was left behind by something that crashed while holding it
+	lockStale = time.Minute
+	lockRetry = 10 * time.Millisecond
+)
+
+// lock takes the document's lock, a file next to it created exclusively, so it works
+// across processes on every platform we build for. The lock is held until unlock is called.
+func (f *File) lock() (unlock func(), err error) {
+	path := f.path + ".lock"
+	deadline := time.Now().Add(lockWait)
+	for {
+		l, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			fmt.Fprintf(l, "%d\n", os.Getpid())
+			l.Close()
+			return func() { os.Remove(path) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+
+		if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) > lockStale {
+			os.Remove(path)
+			continue
+		}
+
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timed out waiting for %s", path)
+		}
+		time.Sleep(lockRetry)
+	}
+}
@@ -0,0 +1,79 @@
+// Package store keeps role-cmd's own state (grants, requests and the like) on disk. Each
+// collection is one JSON document, rewritten whole on every change; none of them are
+// big enough for that to matter.
+package store
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// File is one JSON document on disk.
+type File struct {
+	path  string
+	mutex sync.Mutex
+}
+
+// Open returns the document called name in dir. Neither dir nor the document are created
+// until it's first saved, so something that only reads (e.g. rolectl list) doesn't need to
+// be able to write there.
+func Open(dir, name string) (*File, error) {
+	return &File{path: filepath.Join(dir, name+".json")}, nil
+}
+
+func (f *File) Path() string {
+	return f.path
+}
+
+// Load decodes the document into v. A document that hasn't been saved yet leaves v as it is.
+func (f *File) Load(v interface{}) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	data, err := ioutil.ReadFile(f.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
+
+// Save replaces the document with v. It writes a temporary file and renames it over the
+// old one, so a crash leaves either the old document or the new one.
+func (f *File) Save(v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if err = os.MkdirAll(filepath.Dir(f.path), 0700); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(f.path), filepath.Base(f.path)+".*")
+	if err != nil {
+		return err
+	}
+
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), f.path)
+}
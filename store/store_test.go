@@ -0,0 +1,198 @@
+package store
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// tempDir returns a directory that doesn't exist yet inside a fresh temporary one, and
+// a function removing it all.
+func tempDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return filepath.Join(dir, "state"), func() { os.RemoveAll(dir) }
+}
+
+func TestFile(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	f, err := Open(dir, "things")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = os.Stat(dir); !os.IsNotExist(err) {
+		t.Error("Open created the directory before anything was saved")
+	}
+
+	things := map[string]int{"untouched": 1}
+	if err = f.Load(&things); err != nil {
+		t.Fatalf("Load before the first save: %s", err)
+	}
+	if !reflect.DeepEqual(things, map[string]int{"untouched": 1}) {
+		t.Errorf("Load before the first save changed the value: %v", things)
+	}
+
+	saved := map[string]int{"a": 1, "b": 2}
+	if err = f.Save(saved); err != nil {
+		t.Fatalf("Save: %s", err)
+	}
+
+	var loaded map[string]int
+	if err = f.Load(&loaded); err != nil {
+		t.Fatalf("Load: %s", err)
+	}
+	if !reflect.DeepEqual(loaded, saved) {
+		t.Errorf("Load = %v, want %v", loaded, saved)
+	}
+
+	// The temporary file is renamed over the document, nothing is left behind
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "things.json" {
+		t.Errorf("directory holds %d files, want just things.json", len(entries))
+	}
+}
+
+func TestFileCorrupt(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	f, _ := Open(dir, "things")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(f.Path(), []byte("{not json"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var v map[string]int
+	if err := f.Load(&v); err == nil {
+		t.Error("Load accepted a corrupt document")
+	}
+}
+
+type record struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+func TestCollection(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	f, _ := Open(dir, "records")
+	c, err := NewCollection(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.Update(func(tx *Tx) error {
+		if err := tx.Put("b", &record{Name: "b", Count: 2}); err != nil {
+			return err
+		}
+		return tx.Put("a", &record{Name: "a", Count: 1})
+	})
+	if err != nil {
+		t.Fatalf("Update: %s", err)
+	}
+
+	var r record
+	if !c.Get("a", &r) || r.Count != 1 {
+		t.Errorf("Get(a) = %+v", r)
+	}
+	if c.Get("missing", &r) {
+		t.Error("Get found a record that was never put")
+	}
+
+	var list []record
+	c.List(&list)
+	if !reflect.DeepEqual(list, []record{{"a", 1}, {"b", 2}}) {
+		t.Errorf("List = %+v, want a then b", list)
+	}
+	if keys := c.Keys(); !reflect.DeepEqual(keys, []string{"a", "b"}) {
+		t.Errorf("Keys = %v", keys)
+	}
+
+	// A failed change leaves everything as it was
+	refused := errors.New("refused")
+	err = c.Update(func(tx *Tx) error {
+		tx.Delete("a")
+		return refused
+	})
+	if err != refused {
+		t.Errorf("Update = %v, want the change's own error", err)
+	}
+	if c.Len() != 2 {
+		t.Errorf("Len = %d after a failed change, want 2", c.Len())
+	}
+}
+
+// Two collections on the same document stand in for the service and rolectl.
+func TestCollectionSharedDocument(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	f1, _ := Open(dir, "records")
+	f2, _ := Open(dir, "records")
+	service, err := NewCollection(f1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli, err := NewCollection(f2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	put := func(c *Collection, key string) {
+		err := c.Update(func(tx *Tx) error { return tx.Put(key, &record{Name: key}) })
+		if err != nil {
+			t.Fatalf("Update: %s", err)
+		}
+	}
+
+	put(service, "from-service")
+	put(cli, "from-cli")
+	put(service, "from-service-again")
+
+	want := []string{"from-cli", "from-service", "from-service-again"}
+	for name, c := range map[string]*Collection{"service": service, "cli": cli} {
+		if keys := c.Keys(); !reflect.DeepEqual(keys, want) {
+			t.Errorf("%s sees %v, want %v", name, keys, want)
+		}
+	}
+
+	if _, err = os.Stat(f1.Path() + ".lock"); !os.IsNotExist(err) {
+		t.Error("lock left behind after the changes")
+	}
+}
+
+func TestCollectionStaleLock(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	f, _ := Open(dir, "records")
+	c, _ := NewCollection(f)
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	lock := f.Path() + ".lock"
+	if err := ioutil.WriteFile(lock, []byte("1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * lockStale)
+	if err := os.Chtimes(lock, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Update(func(tx *Tx) error { return tx.Put("a", 1) }); err != nil {
+		t.Errorf("Update with a stale lock: %s", err)
+	}
+}
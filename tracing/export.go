@@ -0,0 +1,217 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Exporter gets every finished, sampled span.
+type Exporter interface {
+	Export(span *Span)
+	Shutdown()
+}
+
+// stdoutExporter writes one JSON document per span, for local debugging.
+type stdoutExporter struct {
+	mutex   sync.Mutex
+	encoder *json.Encoder
+}
+
+func newStdoutExporter() *stdoutExporter {
+	return &stdoutExporter{encoder: json.NewEncoder(os.Stdout)}
+}
+
+func (e *stdoutExporter) Export(span *Span) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.encoder.Encode(struct {
+		TraceID    string            `json:"trace_id"`
+		SpanID     string            `json:"span_id"`
+		ParentID   string            `json:"parent_id,omitempty"`
+		Name       string            `json:"name"`
+		Kind       Kind              `json:"kind"`
+		Start      time.Time         `json:"start"`
+		Duration   string            `json:"duration"`
+		Error      string            `json:"error,omitempty"`
+		Attributes map[string]string `json:"attributes,omitempty"`
+	}{span.TraceID, span.SpanID, span.ParentID, span.Name, span.Kind, span.Start,
+		span.End.Sub(span.Start).String(), span.Err, span.Attributes()})
+}
+
+func (e *stdoutExporter) Shutdown() {}
+
+// otlpExporter batches spans and POSTs them to an OpenTelemetry collector using
+// OTLP/HTTP with JSON encoding, e.g. http://collector:4318/v1/traces.
+type otlpExporter struct {
+	endpoint string
+	service  string
+	log      *zap.Logger
+	client   *http.Client
+
+	spans chan *Span
+	flush chan chan struct{}
+}
+
+const (
+	otlpQueueSize = 2048
+	otlpBatchSize = 256
+)
+
+func newOTLPExporter(endpoint, service string, interval time.Duration, log *zap.Logger) *otlpExporter {
+	e := &otlpExporter{
+		endpoint: endpoint,
+		service:  service,
+		log:      log,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		spans:    make(chan *Span, otlpQueueSize),
+		flush:    make(chan chan struct{}),
+	}
+
+	go e.run(interval)
+
+	return e
+}
+
+// Export never blocks the caller, if the queue is full the span is dropped.
+func (e *otlpExporter) Export(span *Span) {
+	select {
+	case e.spans <- span:
+	default:
+		e.log.Debug("Dropped span, export queue is full", zap.String("span", span.Name))
+	}
+}
+
+func (e *otlpExporter) Shutdown() {
+	done := make(chan struct{})
+	e.flush <- done
+	<-done
+}
+
+func (e *otlpExporter) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var batch []*Span
+	for {
+		select {
+		case span := <-e.spans:
+			batch = append(batch, span)
+			if len(batch) >= otlpBatchSize {
+				e.send(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			e.send(batch)
+			batch = nil
+		case done := <-e.flush:
+			for len(e.spans) > 0 {
+				batch = append(batch, <-e.spans)
+			}
+			e.send(batch)
+			batch = nil
+			close(done)
+		}
+	}
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              Kind            `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+func attributes(values map[string]string) []otlpAttribute {
+	var attrs []otlpAttribute
+	for k, v := range values {
+		attrs = append(attrs, otlpAttribute{Key: k, Value: otlpValue{StringValue: v}})
+	}
+	sort.Slice(attrs, func(i, j int) bool { return attrs[i].Key < attrs[j].Key })
+
+	return attrs
+}
+
+func (e *otlpExporter) send(batch []*Span) {
+	if len(batch) == 0 {
+		return
+	}
+
+	spans := make([]otlpSpan, len(batch))
+	for i, span := range batch {
+		status := otlpStatus{Code: 1}
+		if len(span.Err) != 0 {
+			status = otlpStatus{Code: 2, Message: span.Err}
+		}
+
+		spans[i] = otlpSpan{
+			TraceID:           span.TraceID,
+			SpanID:            span.SpanID,
+			ParentSpanID:      span.ParentID,
+			Name:              span.Name,
+			Kind:              span.Kind,
+			StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+			Attributes:        attributes(span.Attributes()),
+			Status:            status,
+		}
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": attributes(map[string]string{"service.name": e.service}),
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]string{"name": "github.com/chremoas/role-cmd/tracing"},
+						"spans": spans,
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		e.log.Error("Unable to encode spans", zap.Error(err))
+		return
+	}
+
+	rsp, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		e.log.Warn("Unable to export spans", zap.Error(err), zap.Int("spans", len(batch)))
+		return
+	}
+	rsp.Body.Close()
+
+	if rsp.StatusCode >= 300 {
+		e.log.Warn("Span collector refused spans", zap.Int("status", rsp.StatusCode), zap.Int("spans", len(batch)))
+	}
+}
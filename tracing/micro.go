@@ -0,0 +1,117 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/micro/go-micro/client"
+	"github.com/micro/go-micro/metadata"
+	"github.com/micro/go-micro/server"
+)
+
+// Trace context is passed between services in the W3C traceparent format so anything
+// else that speaks it can join the trace.
+const traceparentHeader = "traceparent"
+
+type remoteKey struct{}
+
+type remoteParent struct {
+	traceID string
+	spanID  string
+	sampled bool
+}
+
+func inject(ctx context.Context, span *Span) context.Context {
+	md, ok := metadata.FromContext(ctx)
+	if ok {
+		md = metadata.Copy(md)
+	} else {
+		md = metadata.Metadata{}
+	}
+
+	flags := "00"
+	if span.sampled {
+		flags = "01"
+	}
+	md[traceparentHeader] = fmt.Sprintf("00-%s-%s-%s", span.TraceID, span.SpanID, flags)
+
+	return metadata.NewContext(ctx, md)
+}
+
+func extract(ctx context.Context) context.Context {
+	md, ok := metadata.FromContext(ctx)
+	if !ok {
+		return ctx
+	}
+
+	// Transports don't agree on header case
+	for key, value := range md {
+		if !strings.EqualFold(key, traceparentHeader) {
+			continue
+		}
+
+		parts := strings.Split(value, "-")
+		if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+			return ctx
+		}
+
+		return context.WithValue(ctx, remoteKey{}, remoteParent{
+			traceID: parts[1],
+			spanID:  parts[2],
+			sampled: parts[3] == "01",
+		})
+	}
+
+	return ctx
+}
+
+type tracingClient struct {
+	client.Client
+}
+
+// NewClientWrapper starts a client span for every call and passes the trace on to the
+// service being called.
+func NewClientWrapper() client.Wrapper {
+	return func(c client.Client) client.Client {
+		return &tracingClient{Client: c}
+	}
+}
+
+func (t *tracingClient) Call(ctx context.Context, req client.Request, rsp interface{}, opts ...client.CallOption) error {
+	ctx, span := StartSpan(ctx, req.Endpoint(), KindClient)
+	if span == nil {
+		return t.Client.Call(ctx, req, rsp, opts...)
+	}
+	defer span.Finish()
+
+	span.SetAttribute("rpc.service", req.Service())
+	span.SetAttribute("rpc.method", req.Endpoint())
+
+	err := t.Client.Call(inject(ctx, span), req, rsp, opts...)
+	span.SetError(err)
+
+	return err
+}
+
+// NewHandlerWrapper starts a server span for every request we handle, continuing the
+// caller's trace if it sent one.
+func NewHandlerWrapper() server.HandlerWrapper {
+	return func(h server.HandlerFunc) server.HandlerFunc {
+		return func(ctx context.Context, req server.Request, rsp interface{}) error {
+			ctx, span := StartSpan(extract(ctx), req.Endpoint(), KindServer)
+			if span == nil {
+				return h(ctx, req, rsp)
+			}
+			defer span.Finish()
+
+			span.SetAttribute("rpc.service", req.Service())
+			span.SetAttribute("rpc.method", req.Endpoint())
+
+			err := h(ctx, req, rsp)
+			span.SetError(err)
+
+			return err
+		}
+	}
+}
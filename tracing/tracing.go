@@ -0,0 +1,208 @@
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/chremoas/role-cmd/settings"
+)
+
+type Kind int
+
+// Same values OTLP uses
+const (
+	KindInternal Kind = 1
+	KindServer   Kind = 2
+	KindClient   Kind = 3
+)
+
+// Span is one timed operation in a trace. All of its methods are safe to call on a nil
+// span, which is what StartSpan hands out when tracing is turned off.
+type Span struct {
+	TraceID  string
+	SpanID   string
+	ParentID string
+	Name     string
+	Kind     Kind
+	Start    time.Time
+	End      time.Time
+	Err      string
+
+	sampled bool
+	tracer  *Tracer
+
+	mutex      sync.Mutex
+	attributes map[string]string
+}
+
+func (s *Span) SetAttribute(key, value string) {
+	if s == nil {
+		return
+	}
+
+	s.mutex.Lock()
+	s.attributes[key] = value
+	s.mutex.Unlock()
+}
+
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+
+	s.mutex.Lock()
+	s.Err = err.Error()
+	s.mutex.Unlock()
+}
+
+// Attributes returns a copy of the span's attributes.
+func (s *Span) Attributes() map[string]string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	attributes := make(map[string]string, len(s.attributes))
+	for k, v := range s.attributes {
+		attributes[k] = v
+	}
+
+	return attributes
+}
+
+// Finish ends the span and hands it to the exporter if it was sampled.
+func (s *Span) Finish() {
+	if s == nil {
+		return
+	}
+
+	s.End = time.Now()
+	if s.sampled {
+		s.tracer.exporter.Export(s)
+	}
+}
+
+// Tracer starts spans and sends the sampled ones to an exporter.
+type Tracer struct {
+	service     string
+	sampleRatio float64
+	exporter    Exporter
+}
+
+var (
+	tracerMutex sync.RWMutex
+	tracer      *Tracer
+)
+
+// Configure sets up the process wide tracer. With tracing disabled StartSpan does nothing.
+func Configure(conf settings.Tracing, log *zap.Logger) error {
+	if !conf.Enabled {
+		return nil
+	}
+
+	var exporter Exporter
+	switch conf.Exporter {
+	case "stdout":
+		exporter = newStdoutExporter()
+	case "otlp":
+		if len(conf.Endpoint) == 0 {
+			return fmt.Errorf("tracing exporter otlp needs an endpoint")
+		}
+		if conf.FlushInterval <= 0 {
+			return fmt.Errorf("tracing flushInterval must be more than 0, got %s", conf.FlushInterval)
+		}
+		exporter = newOTLPExporter(conf.Endpoint, conf.ServiceName, conf.FlushInterval, log)
+	default:
+		return fmt.Errorf("unknown tracing exporter: %s", conf.Exporter)
+	}
+
+	tracerMutex.Lock()
+	tracer = &Tracer{service: conf.ServiceName, sampleRatio: conf.SampleRatio, exporter: exporter}
+	tracerMutex.Unlock()
+
+	log.Info("Tracing enabled",
+		zap.String("exporter", conf.Exporter),
+		zap.String("endpoint", conf.Endpoint),
+		zap.Float64("sample_ratio", conf.SampleRatio),
+	)
+
+	return nil
+}
+
+// Shutdown sends anything the exporter is still holding on to.
+func Shutdown() {
+	tracerMutex.RLock()
+	defer tracerMutex.RUnlock()
+
+	if tracer != nil {
+		tracer.exporter.Shutdown()
+	}
+}
+
+type spanKey struct{}
+
+// FromContext returns the span the context is in, if any.
+func FromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// StartSpan starts a span as a child of whatever span ctx is already in, or of the
+// remote parent in ctx if there is one, or as the root of a new trace.
+func StartSpan(ctx context.Context, name string, kind Kind) (context.Context, *Span) {
+	tracerMutex.RLock()
+	t := tracer
+	tracerMutex.RUnlock()
+
+	if t == nil {
+		return ctx, nil
+	}
+
+	span := &Span{
+		SpanID:     newID(8),
+		Name:       name,
+		Kind:       kind,
+		Start:      time.Now(),
+		tracer:     t,
+		attributes: make(map[string]string),
+	}
+
+	if parent := FromContext(ctx); parent != nil {
+		span.TraceID, span.ParentID, span.sampled = parent.TraceID, parent.SpanID, parent.sampled
+	} else if remote, ok := ctx.Value(remoteKey{}).(remoteParent); ok {
+		span.TraceID, span.ParentID, span.sampled = remote.traceID, remote.spanID, remote.sampled
+	} else {
+		span.TraceID = newID(16)
+		span.sampled = sample(t.sampleRatio)
+	}
+
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+func newID(bytes int) string {
+	id := make([]byte, bytes)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(id)
+}
+
+func sample(ratio float64) bool {
+	if ratio >= 1 {
+		return true
+	}
+	if ratio <= 0 {
+		return false
+	}
+
+	n, err := rand.Int(rand.Reader, big.NewInt(1<<53))
+	if err != nil {
+		return false
+	}
+	return float64(n.Int64())/float64(1<<53) < ratio
+}
@@ -0,0 +1,32 @@
+package tracing
+
+import (
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/chremoas/role-cmd/settings"
+)
+
+func TestConfigure(t *testing.T) {
+	tests := []struct {
+		name  string
+		conf  settings.Tracing
+		valid bool
+	}{
+		{"disabled", settings.Tracing{Exporter: "otlp"}, true},
+		{"stdout", settings.Tracing{Enabled: true, Exporter: "stdout"}, true},
+		{"unknown exporter", settings.Tracing{Enabled: true, Exporter: "carrier-pigeon"}, false},
+		{"otlp without an endpoint", settings.Tracing{Enabled: true, Exporter: "otlp", FlushInterval: time.Second}, false},
+		{"otlp without a flush interval", settings.Tracing{Enabled: true, Exporter: "otlp", Endpoint: "http://collector:4318/v1/traces"}, false},
+		{"otlp with a negative flush interval", settings.Tracing{Enabled: true, Exporter: "otlp", Endpoint: "http://collector:4318/v1/traces", FlushInterval: -time.Second}, false},
+	}
+
+	for _, test := range tests {
+		err := Configure(test.conf, zap.NewNop())
+		if valid := err == nil; valid != test.valid {
+			t.Errorf("%s: Configure() = %v, want valid %t", test.name, err, test.valid)
+		}
+	}
+}
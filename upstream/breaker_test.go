@@ -0,0 +1,71 @@
+package upstream
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBreaker(t *testing.T) {
+	b := &breaker{threshold: 3, cooldown: 50 * time.Millisecond}
+
+	for i := 1; i <= 2; i++ {
+		if !b.allow() {
+			t.Fatalf("refused after %d failures, threshold is 3", i-1)
+		}
+		if b.failure() {
+			t.Fatalf("failure %d opened the breaker", i)
+		}
+	}
+
+	if !b.allow() {
+		t.Fatal("refused before reaching the threshold")
+	}
+	if !b.failure() {
+		t.Fatal("reaching the threshold didn't report the breaker opening")
+	}
+	if b.allow() {
+		t.Fatal("open breaker let a call through")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+
+	if !b.allow() {
+		t.Fatal("no probe let through after the cooldown")
+	}
+	if b.allow() {
+		t.Fatal("second call let through while probing")
+	}
+
+	// A failed probe opens it again without reporting it as newly opened
+	if b.failure() {
+		t.Fatal("failed probe reported as the breaker opening")
+	}
+	if b.allow() {
+		t.Fatal("breaker let a call through after a failed probe")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+
+	if !b.allow() {
+		t.Fatal("no probe let through after the second cooldown")
+	}
+	b.success()
+	for i := 0; i < 3; i++ {
+		if !b.allow() {
+			t.Fatal("breaker still open after a successful probe")
+		}
+	}
+}
+
+func TestBreakerDisabled(t *testing.T) {
+	b := &breaker{threshold: 0, cooldown: time.Hour}
+
+	for i := 0; i < 10; i++ {
+		if b.failure() {
+			t.Fatal("disabled breaker opened")
+		}
+		if !b.allow() {
+			t.Fatal("disabled breaker refused a call")
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package upstream
+
+import (
+	"context"
+
+	permsrv "github.com/chremoas/perms-srv/proto"
+	rolesrv "github.com/chremoas/role-srv/proto"
+	"github.com/chremoas/services-common/config"
+	"github.com/micro/go-micro/client"
+
+	"github.com/chremoas/role-cmd/health"
+)
+
+// Factory builds clients for role-srv and perms-srv, as command.ClientFactory wants.
+type Factory struct {
+	RoleSrv  string
+	PermsSrv string
+	Client   client.Client
+}
+
+// NewFactory looks the services up in the configured namespace. The client should
+// already be wrapped with Wrap.
+func NewFactory(conf *config.Configuration, c client.Client) Factory {
+	return Factory{
+		RoleSrv:  conf.LookupService("srv", "role"),
+		PermsSrv: conf.LookupService("srv", "perms"),
+		Client:   c,
+	}
+}
+
+func (f Factory) NewPermsClient() permsrv.PermissionsService {
+	return permsrv.NewPermissionsService(f.PermsSrv, f.Client)
+}
+
+func (f Factory) NewRoleClient() rolesrv.RolesService {
+	return rolesrv.NewRolesService(f.RoleSrv, f.Client)
+}
+
+// AddHealthChecks checks both services with the cheapest calls they have.
+func (f Factory) AddHealthChecks(checker *health.Checker) {
+	checker.Add("role-srv", func(ctx context.Context) error {
+		_, err := f.NewRoleClient().GetRoleTypes(ctx, &rolesrv.NilMessage{})
+		return err
+	})
+	checker.Add("perms-srv", func(ctx context.Context) error {
+		_, err := f.NewPermsClient().ListPermissions(ctx, &permsrv.NilRequest{})
+		return err
+	})
+}
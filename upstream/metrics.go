@@ -0,0 +1,51 @@
+package upstream
+
+import (
+	"context"
+	"time"
+
+	"github.com/micro/go-micro/client"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var rpcDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "role_cmd_rpc_duration_seconds",
+	Help:    "How long calls to role-srv and perms-srv took, per attempt.",
+	Buckets: prometheus.DefBuckets,
+}, []string{"service", "endpoint"})
+
+var rpcErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "role_cmd_rpc_errors_total",
+	Help: "Calls to role-srv and perms-srv that failed, by whether the service was reachable.",
+}, []string{"service", "endpoint", "kind"})
+
+type metricsClient struct {
+	client.Client
+}
+
+// NewMetricsWrapper returns a go-micro client wrapper that records latency and errors
+// for every call made through it.
+func NewMetricsWrapper() client.Wrapper {
+	return func(c client.Client) client.Client {
+		return &metricsClient{Client: c}
+	}
+}
+
+func (m *metricsClient) Call(ctx context.Context, req client.Request, rsp interface{}, opts ...client.CallOption) error {
+	service := shortName(req.Service())
+
+	start := time.Now()
+	err := m.Client.Call(ctx, req, rsp, opts...)
+	rpcDuration.WithLabelValues(service, req.Endpoint()).Observe(time.Since(start).Seconds())
+
+	if err != nil {
+		kind := "error"
+		if IsUnavailable(err) {
+			kind = "unavailable"
+		}
+		rpcErrors.WithLabelValues(service, req.Endpoint(), kind).Inc()
+	}
+
+	return err
+}
@@ -0,0 +1,220 @@
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/micro/go-micro/client"
+	"github.com/micro/go-micro/errors"
+	"go.uber.org/zap"
+
+	"github.com/chremoas/role-cmd/settings"
+	"github.com/chremoas/role-cmd/tracing"
+)
+
+// UnavailableError is returned instead of calling a service whose circuit breaker is open.
+type UnavailableError struct {
+	Service string
+}
+
+func (e *UnavailableError) Error() string {
+	return fmt.Sprintf("%s service unavailable, try again later", shortName(e.Service))
+}
+
+// com.aba-eve.srv.role -> role
+func shortName(service string) string {
+	return service[strings.LastIndex(service, ".")+1:]
+}
+
+// IsUnavailable reports whether err means we never got an answer out of the service,
+// as opposed to the service answering with an error.
+func IsUnavailable(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	if _, ok := err.(*UnavailableError); ok {
+		return true
+	}
+
+	e := errors.Parse(err.Error())
+	switch {
+	case e.Id == "go.micro.client", e.Code == 408, e.Code == 502, e.Code == 503, e.Code == 504:
+		return true
+	default:
+		return false
+	}
+}
+
+// Wrap puts everything in this package around a go-micro client, inside a tracing span
+// for the whole call. Metrics are recorded per attempt, so retries show up as separate calls.
+func Wrap(c client.Client, conf settings.Upstream, log *zap.Logger) client.Client {
+	return tracing.NewClientWrapper()(NewClientWrapper(conf, log)(NewMetricsWrapper()(c)))
+}
+
+type resilientClient struct {
+	client.Client
+
+	conf     settings.Upstream
+	log      *zap.Logger
+	timeouts map[string]time.Duration
+	retry    map[string]bool
+
+	mutex    sync.Mutex
+	breakers map[string]*breaker
+}
+
+// NewClientWrapper returns a go-micro client wrapper that puts a deadline on every call,
+// retries idempotent reads when the service couldn't be reached and stops calling a
+// service altogether for a while once it keeps failing.
+func NewClientWrapper(conf settings.Upstream, log *zap.Logger) client.Wrapper {
+	return func(c client.Client) client.Client {
+		r := &resilientClient{
+			Client:   c,
+			conf:     conf,
+			log:      log,
+			timeouts: make(map[string]time.Duration),
+			retry:    make(map[string]bool),
+			breakers: make(map[string]*breaker),
+		}
+
+		for _, t := range conf.Timeouts {
+			r.timeouts[t.Endpoint] = t.Timeout
+		}
+		for _, endpoint := range conf.RetryEndpoints {
+			r.retry[endpoint] = true
+		}
+
+		return r
+	}
+}
+
+func (r *resilientClient) breaker(service string) *breaker {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	b, ok := r.breakers[service]
+	if !ok {
+		b = &breaker{threshold: r.conf.BreakerThreshold, cooldown: r.conf.BreakerCooldown}
+		r.breakers[service] = b
+	}
+
+	return b
+}
+
+func (r *resilientClient) timeout(endpoint string) time.Duration {
+	if t, ok := r.timeouts[endpoint]; ok {
+		return t
+	}
+	return r.conf.Timeout
+}
+
+func (r *resilientClient) Call(ctx context.Context, req client.Request, rsp interface{}, opts ...client.CallOption) error {
+	b := r.breaker(req.Service())
+
+	attempts := 1
+	if r.retry[req.Endpoint()] {
+		attempts += r.conf.Retries
+	}
+
+	// We do our own retrying, go-micro's would retry writes too
+	opts = append(opts, client.WithRetries(0))
+
+	var err error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			backoff := r.conf.RetryBackoff * time.Duration(1<<uint(attempt-1))
+			r.log.Debug("Retrying upstream call",
+				zap.String("service", req.Service()),
+				zap.String("endpoint", req.Endpoint()),
+				zap.Int("attempt", attempt),
+				zap.Duration("backoff", backoff),
+				zap.Error(err),
+			)
+
+			select {
+			case <-ctx.Done():
+				return err
+			case <-time.After(backoff):
+			}
+		}
+
+		if !b.allow() {
+			return &UnavailableError{Service: req.Service()}
+		}
+
+		callCtx, cancel := context.WithTimeout(ctx, r.timeout(req.Endpoint()))
+		err = r.Client.Call(callCtx, req, rsp, opts...)
+		cancel()
+
+		if !IsUnavailable(err) {
+			b.success()
+			return err
+		}
+
+		if b.failure() {
+			r.log.Warn("Circuit breaker opened",
+				zap.String("service", req.Service()),
+				zap.Duration("cooldown", r.conf.BreakerCooldown),
+				zap.Error(err),
+			)
+		}
+	}
+
+	return err
+}
+
+// breaker opens after threshold consecutive failures and stays open for cooldown. After
+// that one call is let through, if it works the breaker closes again.
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mutex     sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+func (b *breaker) allow() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.threshold <= 0 || b.failures < b.threshold {
+		return true
+	}
+
+	if time.Now().Before(b.openUntil) || b.probing {
+		return false
+	}
+
+	b.probing = true
+	return true
+}
+
+func (b *breaker) success() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.failures = 0
+	b.probing = false
+}
+
+// failure records a failed call and reports whether that opened the breaker.
+func (b *breaker) failure() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.failures++
+	b.probing = false
+
+	if b.threshold > 0 && b.failures >= b.threshold {
+		b.openUntil = time.Now().Add(b.cooldown)
+		return b.failures == b.threshold
+	}
+
+	return false
+}
@@ -0,0 +1,385 @@
+// Package webhooks POSTs role change events to the URLs configured for them, signed so
+// the receiver can tell they came from us.
+package webhooks
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+
+	"github.com/chremoas/role-cmd/events"
+	"github.com/chremoas/role-cmd/settings"
+)
+
+// Headers sent with every delivery
+const (
+	SignatureHeader = "X-Chremoas-Signature"
+	TimestampHeader = "X-Chremoas-Timestamp"
+	EventHeader     = "X-Chremoas-Event"
+	DeliveryHeader  = "X-Chremoas-Delivery"
+)
+
+var deliveries = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "role_cmd_webhook_deliveries_total",
+	Help: "Webhook deliveries, by webhook and result (success, retry, dead_letter).",
+}, []string{"webhook", "result"})
+
+// Sign returns the signature header value for a delivery: sha256= and the hex
+// HMAC-SHA256 of the timestamp header, a dot and the body. The timestamp is signed so a
+// receiver can refuse old deliveries instead of having one replayed at it.
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+type delivery struct {
+	ID        string    `json:"id"`
+	Webhook   string    `json:"webhook"`
+	EventType string    `json:"eventType"`
+	Body      string    `json:"body"`
+	Attempts  int       `json:"attempts"`
+	Error     string    `json:"error,omitempty"`
+	Failed    time.Time `json:"failed,omitempty"`
+}
+
+// Hook is one configured webhook and how it has been doing.
+type Hook struct {
+	conf  settings.Webhook
+	queue chan *delivery
+
+	mutex     sync.Mutex
+	delivered int
+	failed    int
+	lastError string
+}
+
+func (h *Hook) Name() string {
+	return h.conf.Name
+}
+
+// Target is the URL without any credentials or query, which might hold secrets.
+func (h *Hook) Target() string {
+	u, err := url.Parse(h.conf.URL)
+	if err != nil {
+		return "(invalid URL)"
+	}
+	return fmt.Sprintf("%s://%s%s", u.Scheme, u.Host, u.Path)
+}
+
+func (h *Hook) Events() []string {
+	return h.conf.Events
+}
+
+// Stats returns how many deliveries worked, how many ended up as dead letters and the
+// last error.
+func (h *Hook) Stats() (delivered, failed int, lastError string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	return h.delivered, h.failed, h.lastError
+}
+
+// wants reports whether the webhook asked for events of this type.
+func (h *Hook) wants(eventType string) bool {
+	if len(h.conf.Events) == 0 {
+		return true
+	}
+
+	for _, pattern := range h.conf.Events {
+		if pattern == "*" || pattern == eventType {
+			return true
+		}
+		if strings.HasSuffix(pattern, ".*") && strings.HasPrefix(eventType, strings.TrimSuffix(pattern, "*")) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Dispatcher delivers events to every webhook that wants them. Each webhook has its own
+// queue and worker so one slow receiver doesn't hold the others up.
+type Dispatcher struct {
+	conf   settings.Webhooks
+	log    *zap.Logger
+	client *http.Client
+	hooks  []*Hook
+	wg     sync.WaitGroup
+
+	// Held for reading while publishing, so Close can't close a queue under Publish
+	closeMutex sync.RWMutex
+	closed     bool
+	// Cancelled when Close runs out of time, giving up on whatever is left
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	deadLetterMutex sync.Mutex
+}
+
+func NewDispatcher(conf settings.Webhooks, log *zap.Logger) (*Dispatcher, error) {
+	d := &Dispatcher{
+		conf:   conf,
+		log:    log,
+		client: &http.Client{Timeout: conf.Timeout},
+	}
+	d.ctx, d.cancel = context.WithCancel(context.Background())
+
+	if len(conf.Hooks) != 0 && conf.QueueSize < 1 {
+		return nil, fmt.Errorf("webhooks need a queueSize of at least 1, otherwise every event goes straight to the dead letters")
+	}
+
+	names := make(map[string]bool)
+	for _, hook := range conf.Hooks {
+		if len(hook.Name) == 0 || len(hook.URL) == 0 {
+			return nil, fmt.Errorf("webhooks need a name and a url")
+		}
+		// Unsigned, a receiver can't tell our events from anyone else's
+		if len(hook.Secret) == 0 {
+			return nil, fmt.Errorf("webhook %s needs a secret to sign its deliveries with", hook.Name)
+		}
+		if names[hook.Name] {
+			return nil, fmt.Errorf("duplicate webhook: %s", hook.Name)
+		}
+		if _, err := url.ParseRequestURI(hook.URL); err != nil {
+			return nil, fmt.Errorf("webhook %s: %s", hook.Name, err)
+		}
+		names[hook.Name] = true
+
+		h := &Hook{conf: hook, queue: make(chan *delivery, conf.QueueSize)}
+		d.hooks = append(d.hooks, h)
+		d.wg.Add(1)
+		go d.run(h)
+	}
+
+	return d, nil
+}
+
+func (d *Dispatcher) Hooks() []*Hook {
+	return d.hooks
+}
+
+func (d *Dispatcher) Hook(name string) *Hook {
+	for _, h := range d.hooks {
+		if h.conf.Name == name {
+			return h
+		}
+	}
+	return nil
+}
+
+// Publish queues the event for every webhook that wants it. It never waits on a
+// receiver, a full queue sends the delivery straight to the dead letters. Events
+// published after Close are dropped.
+func (d *Dispatcher) Publish(event events.Event) error {
+	d.closeMutex.RLock()
+	defer d.closeMutex.RUnlock()
+	if d.closed {
+		return nil
+	}
+
+	header := events.Stamp(event)
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	for _, h := range d.hooks {
+		if !h.wants(header.Type) {
+			continue
+		}
+
+		dl := &delivery{ID: header.ID, Webhook: h.conf.Name, EventType: header.Type, Body: string(body)}
+		select {
+		case h.queue <- dl:
+		default:
+			dl.Error = "queue full"
+			d.deadLetter(h, dl)
+		}
+	}
+
+	return nil
+}
+
+// Test sends a test event to the webhook once, without retrying, and returns what
+// went wrong if anything.
+func (d *Dispatcher) Test(ctx context.Context, h *Hook, message string) error {
+	event := &events.Test{Header: events.Header{Type: events.WebhookTest}, Message: message}
+	header := events.Stamp(event)
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	return d.send(ctx, h, &delivery{ID: header.ID, Webhook: h.conf.Name, EventType: header.Type, Body: string(body)})
+}
+
+// Close waits for everything already queued to be delivered or dead lettered, until ctx
+// is done. Then whatever is left is dead lettered without another attempt.
+func (d *Dispatcher) Close(ctx context.Context) {
+	d.closeMutex.Lock()
+	if d.closed {
+		d.closeMutex.Unlock()
+		return
+	}
+	d.closed = true
+	for _, h := range d.hooks {
+		close(h.queue)
+	}
+	d.closeMutex.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		d.log.Warn("Gave up waiting for webhook deliveries", zap.Error(ctx.Err()))
+		d.cancel()
+		<-drained
+	}
+	d.cancel()
+}
+
+func (d *Dispatcher) run(h *Hook) {
+	defer d.wg.Done()
+
+	for dl := range h.queue {
+		backoff := d.conf.RetryBackoff
+
+		for {
+			if d.ctx.Err() != nil {
+				dl.Error = "shut down before it could be delivered"
+				d.deadLetter(h, dl)
+				break
+			}
+
+			dl.Attempts++
+			err := d.send(d.ctx, h, dl)
+			if err == nil {
+				h.mutex.Lock()
+				h.delivered++
+				h.mutex.Unlock()
+				deliveries.WithLabelValues(h.conf.Name, "success").Inc()
+				break
+			}
+
+			dl.Error = err.Error()
+			if dl.Attempts > d.conf.Retries {
+				d.deadLetter(h, dl)
+				break
+			}
+
+			deliveries.WithLabelValues(h.conf.Name, "retry").Inc()
+			d.log.Debug("Retrying webhook",
+				zap.String("webhook", h.conf.Name),
+				zap.String("event_id", dl.ID),
+				zap.Int("attempts", dl.Attempts),
+				zap.Error(err),
+			)
+			select {
+			case <-time.After(backoff):
+			case <-d.ctx.Done():
+			}
+			backoff *= 2
+		}
+	}
+}
+
+func (d *Dispatcher) send(ctx context.Context, h *Hook, dl *delivery) error {
+	req, err := http.NewRequest("POST", h.conf.URL, strings.NewReader(dl.Body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, dl.EventType)
+	req.Header.Set(DeliveryHeader, dl.ID)
+	timestamp := time.Now().Unix()
+	req.Header.Set(TimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(SignatureHeader, Sign(h.conf.Secret, timestamp, []byte(dl.Body)))
+
+	rsp, err := d.client.Do(req)
+	if err != nil {
+		// The error names the whole URL, which is shown in chat and might hold secrets
+		if urlErr, ok := err.(*url.Error); ok {
+			err = urlErr.Err
+		}
+		return fmt.Errorf("unable to reach %s: %v", h.Target(), err)
+	}
+	rsp.Body.Close()
+
+	if rsp.StatusCode < 200 || rsp.StatusCode >= 300 {
+		return fmt.Errorf("%s answered %s", h.Target(), rsp.Status)
+	}
+
+	return nil
+}
+
+// deadLetter gives up on a delivery, logging it and appending it to the dead letter file
+// so it can be replayed by hand.
+func (d *Dispatcher) deadLetter(h *Hook, dl *delivery) {
+	dl.Failed = time.Now().UTC()
+
+	h.mutex.Lock()
+	h.failed++
+	h.lastError = dl.Error
+	h.mutex.Unlock()
+	deliveries.WithLabelValues(h.conf.Name, "dead_letter").Inc()
+
+	d.log.Error("Gave up on webhook delivery",
+		zap.String("webhook", dl.Webhook),
+		zap.String("event_id", dl.ID),
+		zap.String("event_type", dl.EventType),
+		zap.Int("attempts", dl.Attempts),
+		zap.String("error", dl.Error),
+		zap.String("body", dl.Body),
+	)
+
+	if len(d.conf.DeadLetterFile) == 0 {
+		return
+	}
+
+	line, err := json.Marshal(dl)
+	if err != nil {
+		return
+	}
+
+	d.deadLetterMutex.Lock()
+	defer d.deadLetterMutex.Unlock()
+
+	f, err := os.OpenFile(d.conf.DeadLetterFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		d.log.Error("Unable to open dead letter file", zap.String("file", d.conf.DeadLetterFile), zap.Error(err))
+		return
+	}
+	defer f.Close()
+
+	if _, err = f.Write(append(line, '\n')); err != nil {
+		d.log.Error("Unable to write dead letter", zap.String("file", d.conf.DeadLetterFile), zap.Error(err))
+	}
+}
+
+// Compile time check that the dispatcher can sit behind events.Fanout
+var _ events.Sink = (*Dispatcher)(nil)
@@ -0,0 +1,158 @@
+package webhooks
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/chremoas/role-cmd/events"
+	"github.com/chremoas/role-cmd/settings"
+)
+
+func testConf(hooks ...settings.Webhook) settings.Webhooks {
+	return settings.Webhooks{
+		Hooks:        hooks,
+		Timeout:      time.Second,
+		Retries:      0,
+		RetryBackoff: time.Millisecond,
+		QueueSize:    8,
+	}
+}
+
+func TestNewDispatcher(t *testing.T) {
+	valid := settings.Webhook{Name: "portal", URL: "https://portal.example/hook", Secret: "s3cret"}
+
+	tests := []struct {
+		name  string
+		conf  settings.Webhooks
+		valid bool
+	}{
+		{"no webhooks", settings.Webhooks{}, true},
+		{"one webhook", testConf(valid), true},
+		{"no secret", testConf(settings.Webhook{Name: "portal", URL: "https://portal.example/hook"}), false},
+		{"no name", testConf(settings.Webhook{URL: "https://portal.example/hook", Secret: "s3cret"}), false},
+		{"not a URL", testConf(settings.Webhook{Name: "portal", URL: "portal", Secret: "s3cret"}), false},
+		{"duplicate", testConf(valid, valid), false},
+		{"no queue", settings.Webhooks{Hooks: []settings.Webhook{valid}}, false},
+	}
+
+	for _, test := range tests {
+		d, err := NewDispatcher(test.conf, zap.NewNop())
+		if valid := err == nil; valid != test.valid {
+			t.Errorf("%s: NewDispatcher() = %v, want valid %t", test.name, err, test.valid)
+		}
+		if d != nil {
+			d.Close(context.Background())
+		}
+	}
+}
+
+type received struct {
+	header http.Header
+	body   []byte
+}
+
+func TestSignedDelivery(t *testing.T) {
+	deliveries := make(chan received, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		deliveries <- received{header: r.Header, body: body}
+	}))
+	defer server.Close()
+
+	d, err := NewDispatcher(testConf(settings.Webhook{Name: "portal", URL: server.URL + "/hook", Secret: "s3cret"}), zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event := &events.RoleChanged{Header: events.Header{Type: events.RoleCreated}, Target: "pilots"}
+	if err = d.Publish(event); err != nil {
+		t.Fatal(err)
+	}
+
+	var got received
+	select {
+	case got = <-deliveries:
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing delivered")
+	}
+	d.Close(context.Background())
+
+	timestamp, err := strconv.ParseInt(got.header.Get(TimestampHeader), 10, 64)
+	if err != nil {
+		t.Fatalf("%s = %q", TimestampHeader, got.header.Get(TimestampHeader))
+	}
+	if age := time.Since(time.Unix(timestamp, 0)); age < -time.Minute || age > time.Minute {
+		t.Errorf("timestamp is %s old", age)
+	}
+
+	// What a receiver would do
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "."))
+	mac.Write(got.body)
+	want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if got.header.Get(SignatureHeader) != want {
+		t.Errorf("%s = %q, want %q", SignatureHeader, got.header.Get(SignatureHeader), want)
+	}
+
+	// The same body signed at another time doesn't verify, so it can't be replayed later
+	if Sign("s3cret", timestamp+600, got.body) == want {
+		t.Error("the signature doesn't cover the timestamp")
+	}
+
+	if got.header.Get(EventHeader) != events.RoleCreated || got.header.Get(DeliveryHeader) != event.ID {
+		t.Errorf("event headers = %q, %q", got.header.Get(EventHeader), got.header.Get(DeliveryHeader))
+	}
+	var body events.RoleChanged
+	if err = json.Unmarshal(got.body, &body); err != nil || body.Target != "pilots" {
+		t.Errorf("body = %s (%v)", got.body, err)
+	}
+
+	if delivered, failed, _ := d.Hook("portal").Stats(); delivered != 1 || failed != 0 {
+		t.Errorf("delivered %d, failed %d, want 1 and 0", delivered, failed)
+	}
+}
+
+func TestErrorsHideTheURL(t *testing.T) {
+	// Nothing listens on the server once it's closed
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+
+	d, err := NewDispatcher(testConf(settings.Webhook{Name: "portal", URL: server.URL + "/hook?token=hunter2", Secret: "s3cret"}), zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := d.Hook("portal")
+
+	err = d.Test(context.Background(), h, "test")
+	if err == nil {
+		t.Fatal("test delivery to a closed server worked")
+	}
+	if strings.Contains(err.Error(), "hunter2") || !strings.Contains(err.Error(), h.Target()) {
+		t.Errorf("error %q should name %s and nothing more", err, h.Target())
+	}
+
+	if err = d.Publish(&events.Test{Header: events.Header{Type: events.WebhookTest}}); err != nil {
+		t.Fatal(err)
+	}
+	d.Close(context.Background())
+
+	_, failed, lastError := h.Stats()
+	if failed != 1 {
+		t.Fatalf("%d dead letters, want 1", failed)
+	}
+	if strings.Contains(lastError, "hunter2") {
+		t.Errorf("last error %q shows the query", lastError)
+	}
+}